@@ -1,3 +1,5 @@
+import { toMoney } from './money';
+
 const getApiBase = () => {
     if (window.location.hostname === 'localhost') {
       return 'http://localhost:8000';
@@ -16,7 +18,7 @@ const getApiBase = () => {
     ]);
   };
   
-  export const createOrder = async (userId, amount, description) => {
+  export const createOrder = async (userId, items, description) => {
     try {
       console.log(`Creating order via ${API_BASE}`);
       const response = await fetchWithTimeout(`${API_BASE}/orders/create`, {
@@ -26,8 +28,13 @@ const getApiBase = () => {
         },
         body: JSON.stringify({
           user_id: userId,
-          amount: parseFloat(amount),
-          description
+          description,
+          items: items.map((item) => ({
+            sku: item.sku,
+            name: item.name,
+            quantity: parseInt(item.quantity, 10),
+            unit_price: toMoney(item.unitPrice)
+          }))
         })
       });
   
@@ -53,7 +60,7 @@ const getApiBase = () => {
       }
   
       const data = await response.json();
-      return Array.isArray(data) ? data : [];
+      return Array.isArray(data.orders) ? data.orders : [];
     } catch (error) {
       console.error('Network error:', error);
       throw new Error(`Failed to fetch orders: ${error.message}`);
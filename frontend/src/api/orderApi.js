@@ -1,3 +1,5 @@
+import { toMoney } from '../money';
+
 const API_BASE_URL = process.env.REACT_APP_API_BASE_URL || 'http://localhost:8080';
 
 const handleResponse = async (response) => {
@@ -18,7 +20,7 @@ const handleResponse = async (response) => {
   }
 };
 
-export const createOrder = async (userId, amount, description) => {
+export const createOrder = async (userId, items, description) => {
   const response = await fetch(`${API_BASE_URL}/api/orders/create`, {
     method: 'POST',
     headers: {
@@ -26,8 +28,13 @@ export const createOrder = async (userId, amount, description) => {
     },
     body: JSON.stringify({ 
       user_id: userId,
-      amount: parseFloat(amount),
-      description
+      description,
+      items: items.map((item) => ({
+        sku: item.sku,
+        name: item.name,
+        quantity: parseInt(item.quantity, 10),
+        unit_price: toMoney(item.unitPrice)
+      }))
     }),
   });
   return handleResponse(response);
@@ -1,3 +1,5 @@
+import { toMoney } from '../money';
+
 const API_BASE_URL = process.env.REACT_APP_API_BASE_URL || 'http://localhost:8081';
 
 const handleResponse = async (response) => {
@@ -30,7 +32,7 @@ export const deposit = async (userId, amount) => {
     headers: {
       'Content-Type': 'application/json',
     },
-    body: JSON.stringify({ user_id: userId, amount: parseFloat(amount) }),
+    body: JSON.stringify({ user_id: userId, amount: toMoney(amount) }),
   });
   return handleResponse(response);
 };
@@ -44,7 +46,7 @@ export const processPayment = async (orderId, userId, amount) => {
     body: JSON.stringify({
       order_id: orderId,
       user_id: userId,
-      amount: parseFloat(amount)
+      amount: toMoney(amount)
     }),
   });
   return handleResponse(response);
@@ -17,6 +17,7 @@ import {
   Box
 } from '@mui/material';
 import { createAccount, getAccount, deposit } from '../api/paymentApi';
+import { formatMoney } from '../money';
 
 const AccountTab = () => {
   const [userId, setUserId] = useState('');
@@ -59,7 +60,7 @@ const AccountTab = () => {
     try {
       setLoading(true);
       setError(null);
-      await deposit(userId, parseFloat(amount));
+      await deposit(userId, amount);
       setSuccess('Deposit successful');
       await handleGetAccount(); 
       setAmount('');
@@ -162,6 +163,7 @@ const AccountTab = () => {
               <TableCell>ID</TableCell>
               <TableCell>User ID</TableCell>
               <TableCell>Balance</TableCell>
+              <TableCell>Available</TableCell>
             </TableRow>
           </TableHead>
           <TableBody>
@@ -169,7 +171,8 @@ const AccountTab = () => {
               <TableRow key={account.id}>
                 <TableCell>{account.id}</TableCell>
                 <TableCell>{account.user_id}</TableCell>
-                <TableCell>${account.balance?.toFixed(2)}</TableCell>
+                <TableCell>{formatMoney(account.balance)}</TableCell>
+                <TableCell>{formatMoney(account.available_balance)}</TableCell>
               </TableRow>
             ))}
           </TableBody>
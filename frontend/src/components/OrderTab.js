@@ -10,10 +10,13 @@ import {
   CircularProgress
 } from '@mui/material';
 import { createOrder } from '../api/orderApi';
+import { formatMoney } from '../money';
 
 const OrderTab = () => {
   const [userId, setUserId] = useState('');
-  const [amount, setAmount] = useState('');
+  const [sku, setSku] = useState('');
+  const [quantity, setQuantity] = useState('1');
+  const [unitPrice, setUnitPrice] = useState('');
   const [description, setDescription] = useState('');
   const [loading, setLoading] = useState(false);
   const [error, setError] = useState(null);
@@ -24,11 +27,17 @@ const OrderTab = () => {
       setLoading(true);
       setError(null);
       
-      const order = await createOrder(userId, amount, description);
-      setSuccess(`Order created with ID: ${order.id}`);
+      const order = await createOrder(
+        userId,
+        [{ sku, name: description, quantity, unitPrice }],
+        description
+      );
+      setSuccess(`Order created with ID: ${order.id}, total: ${formatMoney(order.amount)}`);
       
       setUserId('');
-      setAmount('');
+      setSku('');
+      setQuantity('1');
+      setUnitPrice('');
       setDescription('');
     } catch (err) {
       setError(err.message);
@@ -44,7 +53,7 @@ const OrderTab = () => {
       <Typography variant="h5" gutterBottom>Create Order</Typography>
       
       <Grid container spacing={2}>
-        <Grid item xs={12} sm={4}>
+        <Grid item xs={12} sm={6}>
           <TextField
             fullWidth
             label="User ID"
@@ -53,13 +62,32 @@ const OrderTab = () => {
             disabled={loading}
           />
         </Grid>
+        <Grid item xs={12} sm={6}>
+          <TextField
+            fullWidth
+            label="SKU"
+            value={sku}
+            onChange={(e) => setSku(e.target.value)}
+            disabled={loading}
+          />
+        </Grid>
+        <Grid item xs={12} sm={4}>
+          <TextField
+            fullWidth
+            label="Quantity"
+            type="number"
+            value={quantity}
+            onChange={(e) => setQuantity(e.target.value)}
+            disabled={loading}
+          />
+        </Grid>
         <Grid item xs={12} sm={4}>
           <TextField
             fullWidth
-            label="Amount"
+            label="Unit price"
             type="number"
-            value={amount}
-            onChange={(e) => setAmount(e.target.value)}
+            value={unitPrice}
+            onChange={(e) => setUnitPrice(e.target.value)}
             disabled={loading}
           />
         </Grid>
@@ -76,7 +104,7 @@ const OrderTab = () => {
           <Button
             variant="contained"
             onClick={handleCreateOrder}
-            disabled={loading || !userId || !amount || !description}
+            disabled={loading || !userId || !sku || !quantity || !unitPrice || !description}
           >
             Create Order
           </Button>
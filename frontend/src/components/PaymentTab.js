@@ -31,7 +31,7 @@ const PaymentTab = () => {
     try {
       setLoading(true);
       setError(null);
-      const result = await processPayment(orderId, userId, parseFloat(amount));
+      const result = await processPayment(orderId, userId, amount);
       setPayments([result, ...payments]);
       setSuccess(`Payment processed: ${result.success ? 'Success' : 'Failed'}`);
       setOrderId('');
@@ -0,0 +1,10 @@
+export const DEFAULT_CURRENCY = 'RUB';
+
+// Amounts are sent as decimal strings so that they never lose precision.
+export const toMoney = (value, currency = DEFAULT_CURRENCY) => ({
+  value: String(value).trim().replace(',', '.'),
+  currency,
+});
+
+export const formatMoney = (money) =>
+  money ? `${money.value} ${money.currency}` : '';
@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/AnechkaShv/KPO_BHW2/order-service/internal"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	"github.com/rs/cors"
@@ -41,13 +45,73 @@ func main() {
 			description TEXT NOT NULL,
 			status TEXT NOT NULL
 		);
+
+		ALTER TABLE orders ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+		ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'RUB';
+
+		CREATE INDEX IF NOT EXISTS idx_orders_user_created ON orders(user_id, created_at, id);
+		CREATE INDEX IF NOT EXISTS idx_orders_user_status_created ON orders(user_id, status, created_at, id);
+
+		CREATE TABLE IF NOT EXISTS order_items (
+			id TEXT PRIMARY KEY,
+			order_id TEXT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+			sku TEXT NOT NULL,
+			name TEXT NOT NULL,
+			quantity INTEGER NOT NULL CHECK (quantity > 0),
+			unit_price DECIMAL(10, 2) NOT NULL CHECK (unit_price >= 0)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON order_items(order_id);
+
+		CREATE TABLE IF NOT EXISTS order_status_history (
+			id TEXT PRIMARY KEY,
+			order_id TEXT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+			old_status TEXT NOT NULL DEFAULT '',
+			new_status TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			source TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history(order_id, created_at);
 		
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			user_id TEXT NOT NULL,
+			key TEXT NOT NULL,
+			request_hash TEXT NOT NULL,
+			response_status INTEGER,
+			response_body BYTEA,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			PRIMARY KEY (user_id, key)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
+		ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS order_id TEXT;
+		ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS lease_token TEXT;
+		ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+
 		CREATE TABLE IF NOT EXISTS outbox_messages (
 			id TEXT PRIMARY KEY,
 			order_id TEXT NOT NULL,
 			payload TEXT NOT NULL,
 			processed BOOLEAN NOT NULL DEFAULT false
 		);
+
+		ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+		ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS locked_by TEXT;
+		ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE;
+		ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'PENDING';
+		ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS last_error TEXT;
+		ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+		UPDATE outbox_messages SET status = 'PROCESSED' WHERE processed = true AND status = 'PENDING';
+
+		DROP INDEX IF EXISTS idx_outbox_unprocessed;
+		CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox_messages(next_attempt_at) WHERE status = 'PENDING';
+		CREATE INDEX IF NOT EXISTS idx_outbox_failed ON outbox_messages(created_at) WHERE status = 'FAILED';
 	`); err != nil {
 		log.Fatal("Failed to create tables:", err)
 	}
@@ -67,21 +131,69 @@ func main() {
 
 	orderRepo := internal.NewOrderRepository(db)
 	outboxRepo := internal.NewOutboxRepository(db)
-	orderService := internal.NewOrderService(orderRepo, outboxRepo, paymentQueue)
-	orderHandler := internal.NewOrderHandler(orderService)
+	unitOfWork := internal.NewUnitOfWork(db)
+	orderService := internal.NewOrderService(orderRepo, outboxRepo, unitOfWork, paymentQueue)
+	idempotencyService := internal.NewIdempotencyService(
+		internal.NewIdempotencyRepository(db),
+		getEnvDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour),
+		getEnvDuration("IDEMPOTENCY_LEASE", 30*time.Second),
+	)
+	orderHandler := internal.NewOrderHandler(orderService, idempotencyService)
+	outboxHandler := internal.NewOutboxHandler(internal.NewOutboxService(outboxRepo))
+
+	relayConfig := outboxRelayConfig{
+		batchSize: getEnvInt("OUTBOX_BATCH_SIZE", 100),
+		interval:  getEnvDuration("OUTBOX_POLL_INTERVAL", 10*time.Second),
+		lease:     getEnvDuration("OUTBOX_LEASE", 30*time.Second),
+		retry: internal.RetryPolicy{
+			MaxAttempts: getEnvInt("OUTBOX_MAX_ATTEMPTS", 10),
+			BaseDelay:   getEnvDuration("OUTBOX_RETRY_BASE_DELAY", 5*time.Second),
+			MaxDelay:    getEnvDuration("OUTBOX_RETRY_MAX_DELAY", 10*time.Minute),
+		},
+	}
+	go processOutboxMessages(context.Background(), db, paymentQueue, orderService, relayConfig)
+
+	responseQueue := internal.NewRabbitMQPaymentQueue(
+		rabbitMQ,
+		"payments",
+		"payment.response",
+		"payment_responses",
+	)
+	parkingHandler := internal.NewParkingHandler(responseQueue)
 
-	go processOutboxMessages(context.Background(), db, paymentQueue)
+	consumerConfig := internal.ConsumerConfig{
+		Prefetch: getEnvInt("CONSUMER_PREFETCH", 10),
+		Retry: internal.RetryPolicy{
+			MaxAttempts: getEnvInt("CONSUMER_MAX_ATTEMPTS", 5),
+			BaseDelay:   getEnvDuration("CONSUMER_RETRY_BASE_DELAY", 5*time.Second),
+			MaxDelay:    getEnvDuration("CONSUMER_RETRY_MAX_DELAY", 5*time.Minute),
+		},
+	}
+	go consumePaymentUpdates(context.Background(), responseQueue, orderService, consumerConfig)
 
-	go consumePaymentUpdates(context.Background(), rabbitMQ, orderService)
+	go purgeExpiredIdempotencyKeys(context.Background(), idempotencyService, time.Hour)
 
 	r := mux.NewRouter()
 
 	r.HandleFunc("/api/orders/create", orderHandler.CreateOrder).Methods("POST")
 	r.HandleFunc("/api/orders/get", orderHandler.GetOrder).Methods("GET")
 	r.HandleFunc("/api/orders/list", orderHandler.ListOrders).Methods("GET")
+	r.HandleFunc("/api/orders/{id}/cancel", orderHandler.CancelOrder).Methods("POST")
+	r.HandleFunc("/api/orders/{id}/capture", orderHandler.CaptureOrder).Methods("POST")
+	r.HandleFunc("/api/orders/{id}/history", orderHandler.GetOrderHistory).Methods("GET")
 	r.HandleFunc("/api/orders/process-payment", orderHandler.ProcessPaymentEvent).Methods("POST")
 
+	r.HandleFunc("/api/admin/outbox/failed", outboxHandler.ListFailedMessages).Methods("GET")
+	r.HandleFunc("/api/admin/outbox/{id}/replay", outboxHandler.ReplayMessage).Methods("POST")
+	r.HandleFunc("/api/admin/outbox/{id}/discard", outboxHandler.DiscardMessage).Methods("POST")
+	r.HandleFunc("/api/admin/parked", parkingHandler.ListParkedMessages).Methods("GET")
+	r.HandleFunc("/api/admin/parked/redrive", parkingHandler.RedriveParkedMessages).Methods("POST")
+
 	r.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		if state := rabbitMQ.State(); state != internal.ConnectionStateConnected {
+			http.Error(w, "rabbitmq: "+strings.ToLower(string(state)), http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	}).Methods("GET")
@@ -89,7 +201,7 @@ func main() {
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "Idempotency-Key"},
 		AllowCredentials: true,
 	})
 
@@ -102,51 +214,161 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+port, corsHandler.Handler(r)))
 }
 
-func processOutboxMessages(ctx context.Context, db *sql.DB, queue *internal.RabbitMQPaymentQueue) {
+type outboxRelayConfig struct {
+	batchSize int
+	interval  time.Duration
+	lease     time.Duration
+	retry     internal.RetryPolicy
+}
+
+// processOutboxMessages publishes outbox messages in batches. Every batch is
+// leased to this instance with SELECT ... FOR UPDATE SKIP LOCKED, so several
+// replicas can run the relay at the same time without sending a message twice.
+func processOutboxMessages(ctx context.Context, db *sql.DB, queue *internal.RabbitMQPaymentQueue, orderService internal.OrderService, cfg outboxRelayConfig) {
 	outboxRepo := internal.NewOutboxRepository(db)
-	ticker := time.NewTicker(10 * time.Second)
+	owner := relayOwnerID()
+	ticker := time.NewTicker(cfg.interval)
 	defer ticker.Stop()
 
+	log.Printf("Outbox relay %s started: batch size %d, interval %s, lease %s",
+		owner, cfg.batchSize, cfg.interval, cfg.lease)
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			messages, err := outboxRepo.GetUnprocessedMessages(ctx)
-			if err != nil {
-				log.Printf("Failed to get unprocessed messages: %v", err)
-				continue
+			// Keep publishing while full batches come back so a backlog is
+			// drained without waiting for the next tick.
+			for {
+				if relayOutboxBatch(ctx, outboxRepo, queue, orderService, owner, cfg) < cfg.batchSize {
+					break
+				}
 			}
+		}
+	}
+}
 
-			for _, msg := range messages {
-				if err := queue.PublishPaymentRequest(ctx, []byte(msg.Payload)); err != nil {
-					log.Printf("Failed to publish message: %v", err)
-					continue
-				}
+func relayOutboxBatch(ctx context.Context, outboxRepo internal.OutboxRepository, queue *internal.RabbitMQPaymentQueue, orderService internal.OrderService, owner string, cfg outboxRelayConfig) int {
+	leaseDeadline := time.Now().Add(cfg.lease)
 
-				if err := outboxRepo.MarkMessageAsProcessed(ctx, msg.ID); err != nil {
-					log.Printf("Failed to mark message as processed: %v", err)
-				}
+	messages, err := outboxRepo.ClaimUnprocessedMessages(ctx, owner, cfg.batchSize, cfg.lease)
+	if err != nil {
+		log.Printf("Failed to claim unprocessed messages: %v", err)
+		return 0
+	}
+
+	for _, msg := range messages {
+		// Once the lease is over another relay may claim the rest of the
+		// batch, so stop here and let it do so.
+		if time.Now().After(leaseDeadline) {
+			log.Printf("Outbox lease expired, releasing the rest of the batch")
+			return 0
+		}
+
+		if err := queue.PublishPaymentRequest(ctx, msg.ID, []byte(msg.Payload)); err != nil {
+			attempts := msg.Attempts + 1
+			log.Printf("Failed to publish message %s (attempt %d/%d): %v", msg.ID, attempts, cfg.retry.MaxAttempts, err)
+
+			nextAttemptAt := time.Now().Add(cfg.retry.NextDelay(attempts))
+			if err := outboxRepo.RecordPublishFailure(ctx, msg.ID, owner, err.Error(), nextAttemptAt, cfg.retry.MaxAttempts); err != nil {
+				log.Printf("Failed to record publish failure: %v", err)
+			}
+			continue
+		}
+
+		if err := outboxRepo.MarkMessageAsProcessed(ctx, msg.ID, owner); err != nil {
+			log.Printf("Failed to mark message as processed: %v", err)
+		}
+
+		if eventType := msg.EventType(); eventType == internal.EventTypeAuthorize || eventType == internal.EventTypePayment {
+			if err := orderService.MarkPaymentPending(ctx, msg.OrderID); err != nil {
+				log.Printf("Failed to mark order %s as payment pending: %v", msg.OrderID, err)
 			}
 		}
 	}
+
+	return len(messages)
 }
 
-func consumePaymentUpdates(ctx context.Context, rabbitMQ *internal.RabbitMQ, orderService internal.OrderService) {
-	queue := internal.NewRabbitMQPaymentQueue(
-		rabbitMQ,
-		"payments",
-		"payment.response",
-		"payment_responses",
-	)
+func purgeExpiredIdempotencyKeys(ctx context.Context, idempotencyService internal.IdempotencyService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := idempotencyService.PurgeExpired(ctx)
+			if err != nil {
+				log.Printf("Failed to purge expired idempotency keys: %v", err)
+				continue
+			}
+			if deleted > 0 {
+				log.Printf("Purged %d expired idempotency keys", deleted)
+			}
+		}
+	}
+}
+
+func relayOwnerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "order-service"
+	}
+	return hostname + "-" + uuid.New().String()
+}
 
-	err := queue.SubscribeToPaymentUpdates(ctx, func(orderID string, success bool) {
-		if err := orderService.ProcessPaymentEvent(context.Background(), orderID, success); err != nil {
-			log.Printf("Failed to process payment event: %v", err)
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func consumePaymentUpdates(ctx context.Context, queue *internal.RabbitMQPaymentQueue, orderService internal.OrderService, config internal.ConsumerConfig) {
+	err := queue.SubscribeToPaymentUpdates(ctx, config, func(update internal.PaymentUpdate) error {
+		if err := applyPaymentUpdate(context.Background(), orderService, update); err != nil {
+			log.Printf("Failed to process %s event for order %s: %v", update.Type, update.OrderID, err)
+			return err
 		}
+		return nil
 	})
 
 	if err != nil {
 		log.Fatal("Failed to subscribe to payment updates:", err)
 	}
 }
+
+func applyPaymentUpdate(ctx context.Context, orderService internal.OrderService, update internal.PaymentUpdate) error {
+	change := internal.StatusChange{
+		Source:      internal.StatusSourcePaymentEvent,
+		Reason:      update.Message,
+		CausationID: update.MessageID,
+	}
+
+	switch update.Type {
+	case internal.EventTypePayment:
+		return orderService.ProcessPaymentEvent(ctx, update.OrderID, update.Success, change)
+	case internal.EventTypeAuthorize:
+		return orderService.ProcessAuthorizationEvent(ctx, update.OrderID, update.Success, change)
+	case internal.EventTypeCapture:
+		return orderService.ProcessCaptureEvent(ctx, update.OrderID, update.Success, change)
+	case internal.EventTypeRelease:
+		return orderService.ProcessReleaseEvent(ctx, update.OrderID, change)
+	case internal.EventTypeRefund:
+		return orderService.ProcessRefundEvent(ctx, update.OrderID, update.Success, update.Partial, change)
+	default:
+		return fmt.Errorf("%w: unknown payment update type %q", internal.ErrUnprocessableMessage, update.Type)
+	}
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectDelay_StaysWithinJitteredBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		backoff := reconnectBackoff.NextDelay(attempt)
+		for i := 0; i < 100; i++ {
+			delay := reconnectDelay(attempt)
+			assert.GreaterOrEqual(t, delay, backoff/2)
+			assert.LessOrEqual(t, delay, backoff)
+		}
+	}
+}
+
+func TestConfirmDispatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		confirms []amqp.Confirmation
+		returns  []amqp.Return
+		wantErr  error
+	}{
+		{
+			name:     "acked",
+			confirms: []amqp.Confirmation{{DeliveryTag: 3, Ack: true}},
+		},
+		{
+			name:     "nacked",
+			confirms: []amqp.Confirmation{{DeliveryTag: 3, Ack: false}},
+			wantErr:  ErrPublishNacked,
+		},
+		{
+			name:     "returned as unroutable",
+			confirms: []amqp.Confirmation{{DeliveryTag: 3, Ack: true}},
+			returns:  []amqp.Return{{MessageId: "msg-3", ReplyCode: 312, ReplyText: "NO_ROUTE"}},
+			wantErr:  ErrUnroutable,
+		},
+		{
+			name:     "skips the confirm and return of an earlier message",
+			confirms: []amqp.Confirmation{{DeliveryTag: 2, Ack: false}, {DeliveryTag: 3, Ack: true}},
+			returns:  []amqp.Return{{MessageId: "msg-2", ReplyCode: 312, ReplyText: "NO_ROUTE"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := &confirmDispatcher{}
+			waiter, err := dispatcher.expect(3, "msg-3")
+			assert.NoError(t, err)
+
+			// The broker sends returns before the ack of the same message.
+			returns := make(chan amqp.Return, len(tt.returns))
+			for _, ret := range tt.returns {
+				returns <- ret
+			}
+			confirms := make(chan amqp.Confirmation, len(tt.confirms))
+			for _, confirm := range tt.confirms {
+				confirms <- confirm
+			}
+			go dispatcher.run(confirms, returns)
+
+			err = dispatcher.wait(context.Background(), waiter)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfirmDispatcher_DrainsLateConfirms(t *testing.T) {
+	dispatcher := &confirmDispatcher{}
+	confirms := make(chan amqp.Confirmation)
+	returns := make(chan amqp.Return)
+	go dispatcher.run(confirms, returns)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	waiter, err := dispatcher.expect(1, "msg-1")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, dispatcher.wait(ctx, waiter), context.DeadlineExceeded)
+
+	// Nothing waits for these any more, yet the sends must not block.
+	for tag := uint64(1); tag <= 5; tag++ {
+		returns <- amqp.Return{MessageId: "msg-late"}
+		confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+	}
+
+	waiter, err = dispatcher.expect(6, "msg-6")
+	assert.NoError(t, err)
+	confirms <- amqp.Confirmation{DeliveryTag: 6, Ack: true}
+	assert.NoError(t, dispatcher.wait(context.Background(), waiter))
+}
+
+func TestConfirmDispatcher_ChannelClosed(t *testing.T) {
+	dispatcher := &confirmDispatcher{}
+	waiter, err := dispatcher.expect(1, "msg-1")
+	assert.NoError(t, err)
+
+	confirms := make(chan amqp.Confirmation)
+	close(confirms)
+	dispatcher.run(confirms, make(chan amqp.Return))
+
+	assert.ErrorIs(t, dispatcher.wait(context.Background(), waiter), ErrNotConnected)
+	_, err = dispatcher.expect(2, "msg-2")
+	assert.ErrorIs(t, err, ErrNotConnected)
+}
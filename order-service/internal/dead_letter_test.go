@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	amqp "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryAttempts(t *testing.T) {
+	assert.Equal(t, 0, deliveryAttempts(nil))
+	assert.Equal(t, 0, deliveryAttempts(amqp.Table{attemptsHeader: "3"}))
+	assert.Equal(t, 3, deliveryAttempts(amqp.Table{attemptsHeader: int32(3)}))
+	assert.Equal(t, 4, deliveryAttempts(amqp.Table{attemptsHeader: int64(4)}))
+}
+
+func TestRetriedHeaders_DropsFailureHeaders(t *testing.T) {
+	headers := retriedHeaders(amqp.Table{
+		attemptsHeader:  int32(2),
+		lastErrorHeader: "connection refused",
+		"x-death":       []interface{}{},
+		"trace-id":      "abc",
+	})
+
+	assert.Equal(t, amqp.Table{"trace-id": "abc"}, headers)
+}
+
+type fakeParkedMessageQueue struct {
+	messages []*ParkedMessage
+	limit    int
+}
+
+func (q *fakeParkedMessageQueue) ListParked(ctx context.Context, limit int) ([]*ParkedMessage, error) {
+	q.limit = limit
+	return q.messages, nil
+}
+
+func (q *fakeParkedMessageQueue) RedriveParked(ctx context.Context, limit int) (int, error) {
+	q.limit = limit
+	if len(q.messages) < limit {
+		return len(q.messages), nil
+	}
+	return limit, nil
+}
+
+func TestParkingHandler_ListParkedMessages(t *testing.T) {
+	queue := &fakeParkedMessageQueue{messages: []*ParkedMessage{{MessageID: "msg-1", Attempts: 5, LastError: "boom"}}}
+	h := NewParkingHandler(queue)
+
+	rec := httptest.NewRecorder()
+	h.ListParkedMessages(rec, httptest.NewRequest(http.MethodGet, "/api/admin/parked?limit=10", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 10, queue.limit)
+	var messages []*ParkedMessage
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&messages))
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "msg-1", messages[0].MessageID)
+}
+
+func TestParkingHandler_RedriveParkedMessages(t *testing.T) {
+	queue := &fakeParkedMessageQueue{messages: []*ParkedMessage{{MessageID: "msg-1"}, {MessageID: "msg-2"}}}
+	h := NewParkingHandler(queue)
+
+	rec := httptest.NewRecorder()
+	h.RedriveParkedMessages(rec, httptest.NewRequest(http.MethodPost, "/api/admin/parked/redrive", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 100, queue.limit)
+	assert.JSONEq(t, `{"redriven": 2}`, rec.Body.String())
+}
+
+func TestParkingHandler_RejectsInvalidLimit(t *testing.T) {
+	h := NewParkingHandler(&fakeParkedMessageQueue{})
+
+	rec := httptest.NewRecorder()
+	h.ListParkedMessages(rec, httptest.NewRequest(http.MethodGet, "/api/admin/parked?limit=0", nil))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,30 @@
+package internal
+
+import "errors"
+
+var (
+	ErrOrderNotFound      = errors.New("order not found")
+	ErrInvalidOrder       = errors.New("invalid order")
+	ErrCannotCancel       = errors.New("order cannot be cancelled")
+	ErrCannotCapture      = errors.New("order cannot be captured")
+	ErrInvalidOrderFilter = errors.New("invalid order filter")
+
+	ErrInvalidTransition = errors.New("invalid order status transition")
+	// ErrStatusConflict means the order changed status between being read
+	// and being updated, so the conditional update did not match any row.
+	ErrStatusConflict = errors.New("order status was changed concurrently")
+
+	ErrOutboxMessageNotFound = errors.New("failed outbox message not found")
+	// ErrUnprocessableMessage means a received message is malformed or of an
+	// unknown type, so delivering it again cannot help.
+	ErrUnprocessableMessage = errors.New("unprocessable message")
+	// ErrUnsupportedSchemaVersion means a received message was written with
+	// a schema version this service does not know.
+	ErrUnsupportedSchemaVersion = errors.New("unsupported message schema version")
+
+	ErrInvalidMoney     = errors.New("invalid money amount")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+
+	ErrIdempotencyKeyMismatch   = errors.New("idempotency key was already used with a different request")
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is still being processed")
+)
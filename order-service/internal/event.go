@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EventSchemaVersion is the version of the envelope and payloads written by
+// this service. Messages of any other version, except the legacy flat
+// messages without a version, are rejected.
+const EventSchemaVersion = 1
+
+// EventEnvelope wraps every message exchanged with payment-service.
+// CorrelationID is shared by all the messages about the same order, and
+// CausationID is the MessageID of the message that caused this one, if any.
+type EventEnvelope struct {
+	MessageID     string          `json:"message_id"`
+	EventType     string          `json:"event_type"`
+	SchemaVersion int             `json:"schema_version"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	CorrelationID string          `json:"correlation_id"`
+	CausationID   string          `json:"causation_id,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// PaymentRequest is the payload of the requests sent to payment-service.
+type PaymentRequest struct {
+	OrderID     string               `json:"order_id"`
+	UserID      string               `json:"user_id"`
+	Amount      Money                `json:"amount"`
+	Description string               `json:"description,omitempty"`
+	Items       []PaymentRequestItem `json:"items,omitempty"`
+}
+
+type PaymentRequestItem struct {
+	SKU       string `json:"sku"`
+	Name      string `json:"name"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice Money  `json:"unit_price"`
+}
+
+func NewEventEnvelope(eventType, correlationID, causationID string, payload interface{}) (*EventEnvelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s payload: %w", eventType, err)
+	}
+
+	return &EventEnvelope{
+		MessageID:     uuid.New().String(),
+		EventType:     eventType,
+		SchemaVersion: EventSchemaVersion,
+		OccurredAt:    time.Now().UTC(),
+		CorrelationID: correlationID,
+		CausationID:   causationID,
+		Payload:       data,
+	}, nil
+}
+
+// DecodeEventEnvelope reads a received message. Messages written before the
+// envelope was introduced have no schema_version and carry their fields and
+// their "type" at the top level; they are read as an envelope without a
+// message ID whose payload is the whole message.
+func DecodeEventEnvelope(data []byte) (*EventEnvelope, error) {
+	var envelope EventEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnprocessableMessage, err)
+	}
+
+	switch envelope.SchemaVersion {
+	case EventSchemaVersion:
+		if envelope.EventType == "" {
+			return nil, fmt.Errorf("%w: message %s without an event type", ErrUnprocessableMessage, envelope.MessageID)
+		}
+		return &envelope, nil
+	case 0:
+		var legacy struct {
+			Type    string `json:"type"`
+			OrderID string `json:"order_id"`
+		}
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnprocessableMessage, err)
+		}
+		if legacy.Type == "" {
+			legacy.Type = EventTypePayment
+		}
+		return &EventEnvelope{
+			EventType:     legacy.Type,
+			CorrelationID: legacy.OrderID,
+			Payload:       data,
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedSchemaVersion, envelope.SchemaVersion)
+	}
+}
+
+// DecodePayload unmarshals the payload of the envelope into v.
+func (e *EventEnvelope) DecodePayload(v interface{}) error {
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("%w: invalid %s payload: %v", ErrUnprocessableMessage, e.EventType, err)
+	}
+	return nil
+}
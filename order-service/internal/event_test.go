@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventEnvelope_RoundTrip(t *testing.T) {
+	request := PaymentRequest{OrderID: "order1", UserID: "user1", Amount: Money{Amount: 1050, Currency: "RUB"}}
+	envelope, err := NewEventEnvelope(EventTypeCapture, "order1", "msg0", request)
+	if err != nil {
+		t.Fatalf("failed to create envelope: %v", err)
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("failed to marshal envelope: %v", err)
+	}
+
+	decoded, err := DecodeEventEnvelope(data)
+	if err != nil {
+		t.Fatalf("failed to decode envelope: %v", err)
+	}
+	assert.Equal(t, envelope.MessageID, decoded.MessageID)
+	assert.Equal(t, EventTypeCapture, decoded.EventType)
+	assert.Equal(t, EventSchemaVersion, decoded.SchemaVersion)
+	assert.Equal(t, "order1", decoded.CorrelationID)
+	assert.Equal(t, "msg0", decoded.CausationID)
+
+	var payload PaymentRequest
+	assert.NoError(t, decoded.DecodePayload(&payload))
+	assert.Equal(t, request, payload)
+}
+
+func TestDecodePaymentUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    *PaymentUpdate
+		wantErr error
+	}{
+		{
+			name: "envelope",
+			body: `{"message_id":"msg1","event_type":"refund","schema_version":1,"correlation_id":"order1","payload":{"order_id":"order1","success":true,"partial":true}}`,
+			want: &PaymentUpdate{Type: EventTypeRefund, MessageID: "msg1", OrderID: "order1", Success: true, Partial: true},
+		},
+		{
+			name: "legacy message",
+			body: `{"type":"authorize","order_id":"order1","success":false,"message":"insufficient funds"}`,
+			want: &PaymentUpdate{Type: EventTypeAuthorize, OrderID: "order1", Message: "insufficient funds"},
+		},
+		{
+			name: "legacy message without a type",
+			body: `{"order_id":"order1","success":true}`,
+			want: &PaymentUpdate{Type: EventTypePayment, OrderID: "order1", Success: true},
+		},
+		{
+			name:    "unknown schema version",
+			body:    `{"message_id":"msg1","event_type":"refund","schema_version":2,"payload":{}}`,
+			wantErr: ErrUnsupportedSchemaVersion,
+		},
+		{
+			name:    "envelope without an event type",
+			body:    `{"message_id":"msg1","schema_version":1,"payload":{}}`,
+			wantErr: ErrUnprocessableMessage,
+		},
+		{
+			name:    "malformed payload",
+			body:    `{"message_id":"msg1","event_type":"refund","schema_version":1,"payload":"oops"}`,
+			wantErr: ErrUnprocessableMessage,
+		},
+		{
+			name:    "not json",
+			body:    `oops`,
+			wantErr: ErrUnprocessableMessage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update, err := decodePaymentUpdate([]byte(tt.body))
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, update)
+		})
+	}
+}
@@ -1,41 +1,169 @@
 package internal
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 type OrderHandler struct {
-	service OrderService
+	service     OrderService
+	idempotency IdempotencyService
 }
 
-func NewOrderHandler(service OrderService) *OrderHandler {
-	return &OrderHandler{service: service}
+func NewOrderHandler(service OrderService, idempotency IdempotencyService) *OrderHandler {
+	return &OrderHandler{service: service, idempotency: idempotency}
 }
 
-func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	var req struct {
-		UserID      string  `json:"user_id"`
-		Amount      float64 `json:"amount"`
-		Description string  `json:"description"`
-	}
+const maxIdempotencyKeyLength = 255
 
+type createOrderRequest struct {
+	UserID      string      `json:"user_id"`
+	Description string      `json:"description"`
+	Items       []OrderItem `json:"items"`
+}
+
+// CreateOrder honours the Idempotency-Key header: a repeated request with the
+// same key and body gets the stored response back instead of creating another
+// order, and reusing a key with a different body is rejected with 422.
+func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
+	var req createOrderRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	order, err := h.service.CreateOrder(r.Context(), req.UserID, req.Amount, req.Description)
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		h.createOrder(w, r, req, nil)
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, "idempotency key is too long", http.StatusBadRequest)
+		return
+	}
+
+	// Hash the decoded request rather than the raw body so that formatting
+	// differences between retries do not count as a different request.
+	canonical, err := json.Marshal(req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	sum := sha256.Sum256(canonical)
+	requestHash := hex.EncodeToString(sum[:])
+
+	claim, record, err := h.idempotency.Begin(r.Context(), req.UserID, key, requestHash)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrIdempotencyKeyMismatch):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case errors.Is(err, ErrIdempotencyKeyInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if record != nil && record.ResponseStatus == 0 {
+		// The order was created but its response was never stored, so the
+		// order is returned as it is now.
+		order, err := h.service.GetOrder(r.Context(), record.OrderID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		json.NewEncoder(w).Encode(order)
+		return
+	}
+	if record != nil {
+		if record.ResponseStatus < http.StatusBadRequest {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(record.ResponseStatus)
+		w.Write(record.ResponseBody)
+		return
+	}
+
+	rec := newResponseRecorder()
+	h.createOrder(rec, r, req, claim)
+
+	if rec.status >= http.StatusInternalServerError {
+		if err := h.idempotency.Abort(r.Context(), claim); err != nil {
+			log.Printf("Failed to release idempotency key %q: %v", key, err)
+		}
+	} else if err := h.idempotency.Complete(r.Context(), claim, rec.status, rec.body.Bytes()); err != nil {
+		log.Printf("Failed to store idempotent response for key %q: %v", key, err)
+	}
+
+	rec.flush(w)
+}
+
+func (h *OrderHandler) createOrder(w http.ResponseWriter, r *http.Request, req createOrderRequest, claim *IdempotencyClaim) {
+	order, err := h.service.CreateOrder(r.Context(), req.UserID, req.Description, req.Items, claim)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidOrder):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrIdempotencyKeyInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(order)
 }
 
+// responseRecorder buffers a response so that it can be stored before it is
+// sent to the client.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *responseRecorder) flush(w http.ResponseWriter) {
+	for key, values := range r.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(r.status)
+	w.Write(r.body.Bytes())
+}
+
 func (h *OrderHandler) GetOrder(w http.ResponseWriter, r *http.Request) {
 	orderID := r.URL.Query().Get("id")
 	if orderID == "" {
@@ -45,22 +173,33 @@ func (h *OrderHandler) GetOrder(w http.ResponseWriter, r *http.Request) {
 
 	order, err := h.service.GetOrder(r.Context(), orderID)
 	if err != nil {
+		if errors.Is(err, ErrOrderNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	items := order.Items
+	if items == nil {
+		items = []OrderItem{}
+	}
+
 	response := struct {
-		ID          string  `json:"id"`
-		UserID      string  `json:"user_id"`
-		Amount      float64 `json:"amount"`
-		Description string  `json:"description"`
-		Status      string  `json:"status"`
+		ID          string      `json:"id"`
+		UserID      string      `json:"user_id"`
+		Amount      Money       `json:"amount"`
+		Description string      `json:"description"`
+		Status      string      `json:"status"`
+		Items       []OrderItem `json:"items"`
 	}{
 		ID:          order.ID,
 		UserID:      order.UserID,
 		Amount:      order.Amount,
 		Description: order.Description,
 		Status:      string(order.Status),
+		Items:       items,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -74,20 +213,160 @@ func (h *OrderHandler) ListOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	orders, err := h.service.ListOrders(r.Context(), userID)
+	filter, err := parseOrderFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.UserID = userID
+
+	page, err := h.service.ListOrders(r.Context(), filter)
 	if err != nil {
+		if errors.Is(err, ErrInvalidOrderFilter) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(orders)
+	json.NewEncoder(w).Encode(page)
+}
+
+func parseOrderFilter(query url.Values) (OrderFilter, error) {
+	var filter OrderFilter
+	var err error
+
+	filter.Status = OrderStatus(query.Get("status"))
+
+	if filter.CreatedFrom, err = parseFilterTime(query.Get("created_from"), false); err != nil {
+		return filter, fmt.Errorf("%w: created_from: %v", ErrInvalidOrderFilter, err)
+	}
+	if filter.CreatedTo, err = parseFilterTime(query.Get("created_to"), true); err != nil {
+		return filter, fmt.Errorf("%w: created_to: %v", ErrInvalidOrderFilter, err)
+	}
+
+	switch query.Get("sort") {
+	case "", "desc":
+	case "asc":
+		filter.Ascending = true
+	default:
+		return filter, fmt.Errorf("%w: sort must be asc or desc", ErrInvalidOrderFilter)
+	}
+
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit <= 0 {
+			return filter, fmt.Errorf("%w: limit must be a positive integer", ErrInvalidOrderFilter)
+		}
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		if filter.Cursor, err = DecodeOrderCursor(value); err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
+
+// parseFilterTime accepts either an RFC 3339 timestamp or a plain date. A
+// plain date used as an upper bound covers the whole day.
+func parseFilterTime(value string, upperBound bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 timestamp or YYYY-MM-DD date")
+	}
+	if upperBound {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func (h *OrderHandler) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+	if orderID == "" {
+		http.Error(w, "order id is required", http.StatusBadRequest)
+		return
+	}
+
+	order, err := h.service.CancelOrder(r.Context(), orderID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrOrderNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrCannotCancel), errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrStatusConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+func (h *OrderHandler) CaptureOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+	if orderID == "" {
+		http.Error(w, "order id is required", http.StatusBadRequest)
+		return
+	}
+
+	order, err := h.service.CaptureOrder(r.Context(), orderID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrOrderNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrCannotCapture), errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrStatusConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+func (h *OrderHandler) GetOrderHistory(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["id"]
+	if orderID == "" {
+		http.Error(w, "order id is required", http.StatusBadRequest)
+		return
+	}
+
+	history, err := h.service.GetOrderHistory(r.Context(), orderID)
+	if err != nil {
+		if errors.Is(err, ErrOrderNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if history == nil {
+		history = []*OrderStatusHistoryEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
 }
 
 func (h *OrderHandler) ProcessPaymentEvent(w http.ResponseWriter, r *http.Request) {
 	var event struct {
 		OrderID string `json:"order_id"`
 		Success bool   `json:"success"`
+		Message string `json:"message"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
@@ -95,8 +374,16 @@ func (h *OrderHandler) ProcessPaymentEvent(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := h.service.ProcessPaymentEvent(r.Context(), event.OrderID, event.Success); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	change := StatusChange{Source: StatusSourceHTTP, Reason: event.Message}
+	if err := h.service.ProcessPaymentEvent(r.Context(), event.OrderID, event.Success, change); err != nil {
+		switch {
+		case errors.Is(err, ErrOrderNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrStatusConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 
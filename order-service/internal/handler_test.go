@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeIdempotencyKey struct {
+	record      IdempotencyRecord
+	token       string
+	lockedUntil time.Time
+}
+
+type fakeIdempotencyRepository struct {
+	mu   sync.Mutex
+	keys map[string]*fakeIdempotencyKey
+}
+
+func newFakeIdempotencyRepository() *fakeIdempotencyRepository {
+	return &fakeIdempotencyRepository{keys: make(map[string]*fakeIdempotencyKey)}
+}
+
+// owned returns the key if it is still leased to claim.
+func (r *fakeIdempotencyRepository) owned(claim *IdempotencyClaim) *fakeIdempotencyKey {
+	k, ok := r.keys[claim.UserID+"/"+claim.Key]
+	if !ok || k.token != claim.Token {
+		return nil
+	}
+	return k
+}
+
+func (r *fakeIdempotencyRepository) Reserve(ctx context.Context, claim *IdempotencyClaim, requestHash string, ttl, lease time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := r.keys[claim.UserID+"/"+claim.Key]; ok && existing.record.ExpiresAt.After(now) {
+		abandoned := existing.record.ResponseStatus == 0 && existing.record.OrderID == "" &&
+			existing.lockedUntil.Before(now) && existing.record.RequestHash == requestHash
+		if !abandoned {
+			return false, nil
+		}
+	}
+	r.keys[claim.UserID+"/"+claim.Key] = &fakeIdempotencyKey{
+		record: IdempotencyRecord{
+			UserID:      claim.UserID,
+			Key:         claim.Key,
+			RequestHash: requestHash,
+			ExpiresAt:   now.Add(ttl),
+		},
+		token:       claim.Token,
+		lockedUntil: now.Add(lease),
+	}
+	return true, nil
+}
+
+func (r *fakeIdempotencyRepository) Get(ctx context.Context, userID, key string) (*IdempotencyRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.keys[userID+"/"+key]
+	if !ok {
+		return nil, nil
+	}
+	record := k.record
+	return &record, nil
+}
+
+func (r *fakeIdempotencyRepository) AttachOrder(ctx context.Context, claim *IdempotencyClaim, orderID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := r.owned(claim)
+	if k == nil || k.record.OrderID != "" {
+		return ErrIdempotencyKeyInProgress
+	}
+	k.record.OrderID = orderID
+	return nil
+}
+
+func (r *fakeIdempotencyRepository) SaveResponse(ctx context.Context, claim *IdempotencyClaim, status int, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if k := r.owned(claim); k != nil {
+		k.record.ResponseStatus = status
+		k.record.ResponseBody = body
+	}
+	return nil
+}
+
+func (r *fakeIdempotencyRepository) Delete(ctx context.Context, claim *IdempotencyClaim) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if k := r.owned(claim); k != nil && k.record.OrderID == "" {
+		delete(r.keys, claim.UserID+"/"+claim.Key)
+	}
+	return nil
+}
+
+func (r *fakeIdempotencyRepository) DeleteExpired(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func newTestOrderHandler() (*OrderHandler, *fakeOrderRepository, *fakeOutboxRepository) {
+	h, orderRepo, outboxRepo, _ := newTestOrderHandlerWithKeys(time.Minute)
+	return h, orderRepo, outboxRepo
+}
+
+func newTestOrderHandlerWithKeys(lease time.Duration) (*OrderHandler, *fakeOrderRepository, *fakeOutboxRepository, *fakeIdempotencyRepository) {
+	orderRepo := newFakeOrderRepository()
+	outboxRepo := &fakeOutboxRepository{}
+	keys := newFakeIdempotencyRepository()
+	uow := &fakeUnitOfWork{orders: orderRepo, outbox: outboxRepo, keys: keys}
+	service := NewOrderService(orderRepo, outboxRepo, uow, nil)
+	idempotency := NewIdempotencyService(keys, time.Hour, lease)
+	return NewOrderHandler(service, idempotency), orderRepo, outboxRepo, keys
+}
+
+func postOrder(h *OrderHandler, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/orders/create", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	rec := httptest.NewRecorder()
+	h.CreateOrder(rec, req)
+	return rec
+}
+
+const testOrderBody = `{"user_id":"user1","items":[{"sku":"sku-1","quantity":1,"unit_price":{"value":"10.00","currency":"RUB"}}]}`
+
+func TestOrderHandler_CreateOrder_Idempotency(t *testing.T) {
+	t.Run("repeated request replays the stored response", func(t *testing.T) {
+		h, orderRepo, outboxRepo := newTestOrderHandler()
+
+		first := postOrder(h, "key-1", testOrderBody)
+		assert.Equal(t, http.StatusOK, first.Code)
+
+		second := postOrder(h, "key-1", `{ "items":[{"sku":"sku-1","quantity":1,"unit_price":{"value":"10.00","currency":"RUB"}}], "user_id":"user1" }`)
+		assert.Equal(t, http.StatusOK, second.Code)
+		assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, first.Body.String(), second.Body.String())
+
+		assert.Len(t, orderRepo.orders, 1)
+		assert.Len(t, outboxRepo.payloads, 1)
+	})
+
+	t.Run("same key with a different body is rejected", func(t *testing.T) {
+		h, orderRepo, _ := newTestOrderHandler()
+
+		assert.Equal(t, http.StatusOK, postOrder(h, "key-1", testOrderBody).Code)
+
+		rec := postOrder(h, "key-1", `{"user_id":"user1","items":[{"sku":"sku-2","quantity":1,"unit_price":{"value":"10.00","currency":"RUB"}}]}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		assert.Len(t, orderRepo.orders, 1)
+	})
+
+	t.Run("validation errors are replayed as well", func(t *testing.T) {
+		h, _, _ := newTestOrderHandler()
+		body := `{"user_id":"user1","items":[]}`
+
+		assert.Equal(t, http.StatusBadRequest, postOrder(h, "key-1", body).Code)
+		rec := postOrder(h, "key-1", body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	})
+
+	t.Run("requests without a key are not deduplicated", func(t *testing.T) {
+		h, orderRepo, _ := newTestOrderHandler()
+
+		assert.Equal(t, http.StatusOK, postOrder(h, "", testOrderBody).Code)
+		assert.Equal(t, http.StatusOK, postOrder(h, "", `{"user_id":"user2","items":[{"sku":"sku-1","quantity":1,"unit_price":{"value":"10.00","currency":"RUB"}}]}`).Code)
+		assert.Len(t, orderRepo.orders, 2)
+	})
+
+	t.Run("key in progress", func(t *testing.T) {
+		h, _, _ := newTestOrderHandler()
+
+		_, _, err := h.idempotency.Begin(context.Background(), "user1", "key-1", testOrderHash(t))
+		assert.NoError(t, err)
+
+		rec := postOrder(h, "key-1", testOrderBody)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+	})
+
+	t.Run("key with a lapsed lease is taken over", func(t *testing.T) {
+		h, orderRepo, _, _ := newTestOrderHandlerWithKeys(-time.Second)
+
+		_, _, err := h.idempotency.Begin(context.Background(), "user1", "key-1", testOrderHash(t))
+		assert.NoError(t, err)
+
+		rec := postOrder(h, "key-1", testOrderBody)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Len(t, orderRepo.orders, 1)
+	})
+
+	t.Run("created order is replayed when its response was not stored", func(t *testing.T) {
+		h, orderRepo, _, keys := newTestOrderHandlerWithKeys(-time.Second)
+
+		claim, _, err := h.idempotency.Begin(context.Background(), "user1", "key-1", testOrderHash(t))
+		assert.NoError(t, err)
+		order, err := h.service.CreateOrder(context.Background(), "user1", "", testOrderItems(t), claim)
+		assert.NoError(t, err)
+
+		rec := postOrder(h, "key-1", testOrderBody)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+		assert.Contains(t, rec.Body.String(), order.ID)
+		assert.Len(t, orderRepo.orders, 1)
+
+		record, _ := keys.Get(context.Background(), "user1", "key-1")
+		assert.Equal(t, order.ID, record.OrderID)
+	})
+}
+
+func testOrderItems(t *testing.T) []OrderItem {
+	var req createOrderRequest
+	if err := json.Unmarshal([]byte(testOrderBody), &req); err != nil {
+		t.Fatalf("failed to decode test order: %v", err)
+	}
+	return req.Items
+}
+
+func testOrderHash(t *testing.T) string {
+	var req createOrderRequest
+	if err := json.Unmarshal([]byte(testOrderBody), &req); err != nil {
+		t.Fatalf("failed to decode test order: %v", err)
+	}
+	canonical, _ := json.Marshal(req)
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type IdempotencyRepository interface {
+	Reserve(ctx context.Context, claim *IdempotencyClaim, requestHash string, ttl, lease time.Duration) (bool, error)
+	Get(ctx context.Context, userID, key string) (*IdempotencyRecord, error)
+	AttachOrder(ctx context.Context, claim *IdempotencyClaim, orderID string) error
+	SaveResponse(ctx context.Context, claim *IdempotencyClaim, status int, body []byte) error
+	Delete(ctx context.Context, claim *IdempotencyClaim) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type idempotencyRepository struct {
+	db DBTX
+}
+
+func NewIdempotencyRepository(db *sql.DB) IdempotencyRepository {
+	return &idempotencyRepository{db: db}
+}
+
+// NewIdempotencyRepositoryTx returns a repository whose operations all run
+// inside tx. Committing or rolling back tx is up to the caller.
+func NewIdempotencyRepositoryTx(tx *sql.Tx) IdempotencyRepository {
+	return &idempotencyRepository{db: tx}
+}
+
+// Reserve stores a new key for the user, leased to claim.Token, and reports
+// whether it was created. An expired key is taken over as if it did not
+// exist. So is a key for the same request whose lease has lapsed before an
+// order was attached to it, because its request never committed.
+func (r *idempotencyRepository) Reserve(ctx context.Context, claim *IdempotencyClaim, requestHash string, ttl, lease time.Duration) (bool, error) {
+	res, err := r.db.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (user_id, key, request_hash, lease_token, locked_until, expires_at)
+		VALUES ($1, $2, $3, $4, NOW() + $5 * INTERVAL '1 millisecond', NOW() + $6 * INTERVAL '1 millisecond')
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash,
+			response_status = NULL,
+			response_body = NULL,
+			order_id = NULL,
+			lease_token = EXCLUDED.lease_token,
+			locked_until = EXCLUDED.locked_until,
+			created_at = NOW(),
+			expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < NOW()
+			OR (idempotency_keys.response_status IS NULL
+				AND idempotency_keys.order_id IS NULL
+				AND idempotency_keys.locked_until < NOW()
+				AND idempotency_keys.request_hash = EXCLUDED.request_hash)`,
+		claim.UserID, claim.Key, requestHash, claim.Token, lease.Milliseconds(), ttl.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func (r *idempotencyRepository) Get(ctx context.Context, userID, key string) (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	var status sql.NullInt64
+	err := r.db.QueryRowContext(ctx, `
+		SELECT user_id, key, request_hash, response_status, response_body, COALESCE(order_id, ''), created_at, expires_at
+		FROM idempotency_keys WHERE user_id = $1 AND key = $2`,
+		userID, key).
+		Scan(&record.UserID, &record.Key, &record.RequestHash, &status, &record.ResponseBody, &record.OrderID, &record.CreatedAt, &record.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	record.ResponseStatus = int(status.Int64)
+	return &record, nil
+}
+
+// AttachOrder records the order created for the key. It fails with
+// ErrIdempotencyKeyInProgress when the lease was taken over by another
+// request, which then creates the order instead.
+func (r *idempotencyRepository) AttachOrder(ctx context.Context, claim *IdempotencyClaim, orderID string) error {
+	res, err := r.db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET order_id = $4 WHERE user_id = $1 AND key = $2 AND lease_token = $3 AND order_id IS NULL",
+		claim.UserID, claim.Key, claim.Token, orderID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrIdempotencyKeyInProgress
+	}
+	return nil
+}
+
+func (r *idempotencyRepository) SaveResponse(ctx context.Context, claim *IdempotencyClaim, status int, body []byte) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET response_status = $4, response_body = $5 WHERE user_id = $1 AND key = $2 AND lease_token = $3",
+		claim.UserID, claim.Key, claim.Token, status, body)
+	return err
+}
+
+// Delete releases a key that has no order attached, unless it has been taken
+// over by another request in the meantime.
+func (r *idempotencyRepository) Delete(ctx context.Context, claim *IdempotencyClaim) error {
+	_, err := r.db.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND lease_token = $3 AND order_id IS NULL",
+		claim.UserID, claim.Key, claim.Token)
+	return err
+}
+
+func (r *idempotencyRepository) DeleteExpired(ctx context.Context) (int64, error) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < NOW()")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
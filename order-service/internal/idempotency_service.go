@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotencyService makes retried requests safe: the first request with a
+// key is processed and its response stored, later requests with the same key
+// and body get the stored response back.
+type IdempotencyService interface {
+	// Begin returns a claim when the caller should process the request, or
+	// the record whose response has to be replayed.
+	Begin(ctx context.Context, userID, key, requestHash string) (*IdempotencyClaim, *IdempotencyRecord, error)
+	Complete(ctx context.Context, claim *IdempotencyClaim, status int, body []byte) error
+	Abort(ctx context.Context, claim *IdempotencyClaim) error
+	PurgeExpired(ctx context.Context) (int64, error)
+}
+
+type idempotencyService struct {
+	repo  IdempotencyRepository
+	ttl   time.Duration
+	lease time.Duration
+}
+
+// NewIdempotencyService keeps keys for ttl. A request holds its key for
+// lease; if it has not created an order by then, for example because the
+// process died, a retry takes the key over.
+func NewIdempotencyService(repo IdempotencyRepository, ttl, lease time.Duration) IdempotencyService {
+	return &idempotencyService{repo: repo, ttl: ttl, lease: lease}
+}
+
+func (s *idempotencyService) Begin(ctx context.Context, userID, key, requestHash string) (*IdempotencyClaim, *IdempotencyRecord, error) {
+	claim := &IdempotencyClaim{UserID: userID, Key: key, Token: uuid.New().String()}
+	reserved, err := s.repo.Reserve(ctx, claim, requestHash, s.ttl, s.lease)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reserve idempotency key: %w", err)
+	}
+	if reserved {
+		return claim, nil, nil
+	}
+
+	record, err := s.repo.Get(ctx, userID, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	if record == nil {
+		// The key was released by a failed request between the two queries;
+		// the client can simply retry.
+		return nil, nil, ErrIdempotencyKeyInProgress
+	}
+	if record.RequestHash != requestHash {
+		return nil, nil, ErrIdempotencyKeyMismatch
+	}
+	if record.ResponseStatus == 0 && record.OrderID == "" {
+		return nil, nil, ErrIdempotencyKeyInProgress
+	}
+	return nil, record, nil
+}
+
+func (s *idempotencyService) Complete(ctx context.Context, claim *IdempotencyClaim, status int, body []byte) error {
+	return s.repo.SaveResponse(ctx, claim, status, body)
+}
+
+// Abort releases the key so that the request can be retried, used when
+// processing failed for a reason the client is not responsible for.
+func (s *idempotencyService) Abort(ctx context.Context, claim *IdempotencyClaim) error {
+	return s.repo.Delete(ctx, claim)
+}
+
+func (s *idempotencyService) PurgeExpired(ctx context.Context) (int64, error) {
+	return s.repo.DeleteExpired(ctx)
+}
@@ -1,24 +1,147 @@
 package internal
 
+import "time"
+
 type OrderStatus string
 
 const (
-	OrderStatusNew       OrderStatus = "NEW"
-	OrderStatusPaid      OrderStatus = "PAID"
-	OrderStatusCancelled OrderStatus = "CANCELLED"
+	OrderStatusNew            OrderStatus = "NEW"
+	OrderStatusPaymentPending OrderStatus = "PAYMENT_PENDING"
+	OrderStatusAuthorized     OrderStatus = "AUTHORIZED"
+	OrderStatusCapturePending OrderStatus = "CAPTURE_PENDING"
+	OrderStatusPaid           OrderStatus = "PAID"
+	OrderStatusCancelled      OrderStatus = "CANCELLED"
+	OrderStatusRefundPending  OrderStatus = "REFUND_PENDING"
+	OrderStatusRefunded       OrderStatus = "REFUNDED"
+)
+
+// Event types carried in the event_type of the envelope of messages exchanged
+// with payment-service. Messages without a type are treated as payments, which
+// charge the user at once; new orders are paid in two phases instead, by
+// authorizing a hold on the funds and capturing or releasing it later.
+const (
+	EventTypePayment   = "payment"
+	EventTypeRefund    = "refund"
+	EventTypeAuthorize = "authorize"
+	EventTypeCapture   = "capture"
+	EventTypeRelease   = "release"
 )
 
 type Order struct {
 	ID          string      `json:"id" db:"id"`
 	UserID      string      `json:"user_id" db:"user_id"`
-	Amount      float64     `json:"amount" db:"amount"`
+	Amount      Money       `json:"amount" db:"amount"`
 	Description string      `json:"description" db:"description"`
 	Status      OrderStatus `json:"status" db:"status"`
+	CreatedAt   time.Time   `json:"created_at" db:"created_at"`
+	Items       []OrderItem `json:"items,omitempty"`
 }
 
-type OutboxMessage struct {
+type OrderItem struct {
 	ID        string `json:"id" db:"id"`
 	OrderID   string `json:"order_id" db:"order_id"`
-	Payload   string `json:"payload" db:"payload"`
-	Processed bool   `json:"processed" db:"processed"`
+	SKU       string `json:"sku" db:"sku"`
+	Name      string `json:"name" db:"name"`
+	Quantity  int    `json:"quantity" db:"quantity"`
+	UnitPrice Money  `json:"unit_price" db:"unit_price"`
+}
+
+// PaymentUpdate is a payment or refund result received from payment-service.
+// Partial is set on refunds that gave back only part of the order amount.
+// Type and MessageID are taken from the envelope of the message.
+type PaymentUpdate struct {
+	Type      string `json:"-"`
+	MessageID string `json:"-"`
+	OrderID   string `json:"order_id"`
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	Partial   bool   `json:"partial"`
+}
+
+// StatusSource identifies the part of the system that changed an order
+// status.
+type StatusSource string
+
+const (
+	StatusSourceHTTP         StatusSource = "HTTP"
+	StatusSourcePaymentEvent StatusSource = "PAYMENT_EVENT"
+	// StatusSourceSweeper is used by background jobs such as the outbox relay.
+	StatusSourceSweeper StatusSource = "SWEEPER"
+)
+
+// StatusChange describes who changes an order status and why. It is stored
+// in the order status history together with the old and new status.
+// CausationID is the ID of the message that led to the change, if any, and
+// is passed on to the requests sent to payment-service because of it.
+type StatusChange struct {
+	Source      StatusSource
+	Reason      string
+	CausationID string
+}
+
+type OrderStatusHistoryEntry struct {
+	ID        string       `json:"id" db:"id"`
+	OrderID   string       `json:"order_id" db:"order_id"`
+	OldStatus OrderStatus  `json:"old_status,omitempty" db:"old_status"`
+	NewStatus OrderStatus  `json:"new_status" db:"new_status"`
+	Reason    string       `json:"reason" db:"reason"`
+	Source    StatusSource `json:"source" db:"source"`
+	CreatedAt time.Time    `json:"created_at" db:"created_at"`
+}
+
+// IdempotencyRecord is the stored outcome of a request sent with an
+// Idempotency-Key header. ResponseStatus is zero while the request is still
+// being processed. OrderID is set in the same transaction that creates the
+// order, so it is known even when the response was never stored.
+type IdempotencyRecord struct {
+	UserID         string    `db:"user_id"`
+	Key            string    `db:"key"`
+	RequestHash    string    `db:"request_hash"`
+	ResponseStatus int       `db:"response_status"`
+	ResponseBody   []byte    `db:"response_body"`
+	OrderID        string    `db:"order_id"`
+	CreatedAt      time.Time `db:"created_at"`
+	ExpiresAt      time.Time `db:"expires_at"`
+}
+
+// IdempotencyClaim identifies the request that holds the lease on a key.
+// Token is unique per request, so a request whose lease was taken over can
+// no longer change the key.
+type IdempotencyClaim struct {
+	UserID string
+	Key    string
+	Token  string
+}
+
+type OutboxStatus string
+
+const (
+	OutboxStatusPending   OutboxStatus = "PENDING"
+	OutboxStatusProcessed OutboxStatus = "PROCESSED"
+	// OutboxStatusFailed is terminal: the relay gave up on the message and
+	// it stays there until an operator replays or discards it.
+	OutboxStatusFailed    OutboxStatus = "FAILED"
+	OutboxStatusDiscarded OutboxStatus = "DISCARDED"
+)
+
+type OutboxMessage struct {
+	ID            string       `json:"id" db:"id"`
+	OrderID       string       `json:"order_id" db:"order_id"`
+	Payload       string       `json:"payload" db:"payload"`
+	Processed     bool         `json:"processed" db:"processed"`
+	Status        OutboxStatus `json:"status" db:"status"`
+	Attempts      int          `json:"attempts" db:"attempts"`
+	LastError     string       `json:"last_error,omitempty" db:"last_error"`
+	NextAttemptAt time.Time    `json:"next_attempt_at" db:"next_attempt_at"`
+	CreatedAt     time.Time    `json:"created_at" db:"created_at"`
+}
+
+// EventType returns the event type of the message, defaulting to a payment
+// for messages that cannot be read.
+func (m *OutboxMessage) EventType() string {
+	envelope, err := DecodeEventEnvelope([]byte(m.Payload))
+	if err != nil {
+		return EventTypePayment
+	}
+	return envelope.EventType
 }
@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const DefaultCurrency = "RUB"
+
+// currencyExponents lists the supported ISO 4217 currencies and the number of
+// minor units (digits after the decimal point) each of them has.
+var currencyExponents = map[string]int{
+	"RUB": 2,
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"CNY": 2,
+	"JPY": 0,
+}
+
+// maxMoneyDigits bounds the integer part of an amount to what the
+// DECIMAL(10, 2) amount columns can store.
+const maxMoneyDigits = 8
+
+// Money is an exact amount in the minor units (kopecks, cents) of Currency.
+// It never goes through float64: in JSON the amount is a decimal string,
+// {"value": "100.50", "currency": "RUB"}, and in the database it is stored in
+// a DECIMAL column next to a currency column.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// ParseMoney parses a decimal amount such as "100.50" in the given currency.
+// It rejects amounts with more fraction digits than the currency has minor
+// units, except for trailing zeros, so "10.500" is accepted for RUB but
+// "10.505" is not, and amounts of more than maxMoneyDigits integer digits.
+func ParseMoney(value, currency string) (Money, error) {
+	return parseMoney(value, currency, maxMoneyDigits)
+}
+
+// parseMoney parses an amount of up to maxDigits integer digits. maxDigits
+// must keep the amount within int64 minor units.
+func parseMoney(value, currency string, maxDigits int) (Money, error) {
+	exponent, err := currencyExponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+
+	s := strings.TrimSpace(value)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, fraction, _ := strings.Cut(s, ".")
+	if whole == "" || !isDigits(whole) || !isDigits(fraction) {
+		return Money{}, fmt.Errorf("%w: %q is not a decimal number", ErrInvalidMoney, value)
+	}
+	if len(strings.TrimLeft(whole, "0")) > maxDigits {
+		return Money{}, fmt.Errorf("%w: %q is too large", ErrInvalidMoney, value)
+	}
+	if len(fraction) > exponent {
+		if strings.Trim(fraction[exponent:], "0") != "" {
+			return Money{}, fmt.Errorf("%w: %s allows at most %d decimal places", ErrInvalidMoney, currency, exponent)
+		}
+		fraction = fraction[:exponent]
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	amount, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: %q: %v", ErrInvalidMoney, value, err)
+	}
+	if negative {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// checkRange returns ErrInvalidMoney when m has more than maxMoneyDigits
+// integer digits.
+func (m Money) checkRange() error {
+	limit := int64(1)
+	for i := 0; i < maxMoneyDigits+currencyExponents[m.Currency]; i++ {
+		limit *= 10
+	}
+	if m.Amount >= limit || m.Amount <= -limit {
+		return fmt.Errorf("%w: %s is too large", ErrInvalidMoney, m)
+	}
+	return nil
+}
+
+func currencyExponent(currency string) (int, error) {
+	exponent, ok := currencyExponents[currency]
+	if !ok {
+		return 0, fmt.Errorf("%w: unsupported currency %q", ErrInvalidMoney, currency)
+	}
+	return exponent, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Decimal formats the amount without the currency, e.g. "100.50". This is
+// the form stored in DECIMAL columns.
+func (m Money) Decimal() string {
+	exponent := currencyExponents[m.Currency]
+
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	digits := strconv.FormatInt(amount, 10)
+	if exponent == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exponent] + "." + digits[len(digits)-exponent:]
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	if (other.Amount > 0 && m.Amount > math.MaxInt64-other.Amount) ||
+		(other.Amount < 0 && m.Amount < math.MinInt64-other.Amount) {
+		return Money{}, fmt.Errorf("%w: amount overflow", ErrInvalidMoney)
+	}
+	sum := Money{Amount: m.Amount + other.Amount, Currency: m.Currency}
+	if err := sum.checkRange(); err != nil {
+		return Money{}, err
+	}
+	return sum, nil
+}
+
+func (m Money) Sub(other Money) (Money, error) {
+	return m.Add(Money{Amount: -other.Amount, Currency: other.Currency})
+}
+
+// Mul multiplies the amount by a whole number, such as an item quantity.
+func (m Money) Mul(n int64) (Money, error) {
+	if n != 0 && (m.Amount*n)/n != m.Amount {
+		return Money{}, fmt.Errorf("%w: amount overflow", ErrInvalidMoney)
+	}
+	product := Money{Amount: m.Amount * n, Currency: m.Currency}
+	if err := product.checkRange(); err != nil {
+		return Money{}, err
+	}
+	return product, nil
+}
+
+// Cmp returns -1, 0 or +1 depending on whether m is less than, equal to or
+// greater than other. Amounts in different currencies cannot be compared.
+func (m Money) Cmp(other Money) (int, error) {
+	if m.Currency != other.Currency {
+		return 0, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, other.Currency)
+	}
+	switch {
+	case m.Amount < other.Amount:
+		return -1, nil
+	case m.Amount > other.Amount:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+type moneyJSON struct {
+	Value    json.RawMessage `json:"value"`
+	Currency string          `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	value, err := json.Marshal(m.Decimal())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(moneyJSON{Value: value, Currency: m.Currency})
+}
+
+// UnmarshalJSON only accepts the amount as a string, so that a client cannot
+// send a float that has already lost precision.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var raw moneyJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("%w: expected an object with value and currency", ErrInvalidMoney)
+	}
+
+	var value string
+	if err := json.Unmarshal(raw.Value, &value); err != nil {
+		return fmt.Errorf("%w: value must be a decimal string", ErrInvalidMoney)
+	}
+
+	parsed, err := ParseMoney(value, raw.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		value    string
+		currency string
+		want     Money
+		wantErr  bool
+	}{
+		{value: "100.50", currency: "RUB", want: Money{Amount: 10050, Currency: "RUB"}},
+		{value: "100.5", currency: "RUB", want: Money{Amount: 10050, Currency: "RUB"}},
+		{value: "100", currency: "USD", want: Money{Amount: 10000, Currency: "USD"}},
+		{value: "0.01", currency: "EUR", want: Money{Amount: 1, Currency: "EUR"}},
+		{value: "-3.20", currency: "RUB", want: Money{Amount: -320, Currency: "RUB"}},
+		{value: "10.500", currency: "RUB", want: Money{Amount: 1050, Currency: "RUB"}},
+		{value: "500.00", currency: "JPY", want: Money{Amount: 500, Currency: "JPY"}},
+		{value: "10.505", currency: "RUB", wantErr: true},
+		{value: "1.5", currency: "JPY", wantErr: true},
+		{value: "10", currency: "XXX", wantErr: true},
+		{value: "10", currency: "", wantErr: true},
+		{value: "", currency: "RUB", wantErr: true},
+		{value: ".50", currency: "RUB", wantErr: true},
+		{value: "1e3", currency: "RUB", wantErr: true},
+		{value: "1,50", currency: "RUB", wantErr: true},
+		{value: "99999999.99", currency: "RUB", want: Money{Amount: 9999999999, Currency: "RUB"}},
+		{value: "99999999", currency: "JPY", want: Money{Amount: 99999999, Currency: "JPY"}},
+		{value: "100000000", currency: "RUB", wantErr: true},
+		{value: "9999999999999999", currency: "RUB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value+" "+tt.currency, func(t *testing.T) {
+			got, err := ParseMoney(tt.value, tt.currency)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidMoney)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMoney_Decimal(t *testing.T) {
+	assert.Equal(t, "100.50", Money{Amount: 10050, Currency: "RUB"}.Decimal())
+	assert.Equal(t, "0.05", Money{Amount: 5, Currency: "RUB"}.Decimal())
+	assert.Equal(t, "-0.05", Money{Amount: -5, Currency: "RUB"}.Decimal())
+	assert.Equal(t, "0.00", Money{Currency: "USD"}.Decimal())
+	assert.Equal(t, "500", Money{Amount: 500, Currency: "JPY"}.Decimal())
+}
+
+func TestMoney_Arithmetic(t *testing.T) {
+	a := Money{Amount: 1010, Currency: "RUB"}
+	b := Money{Amount: 20, Currency: "RUB"}
+
+	sum, err := a.Add(b)
+	assert.NoError(t, err)
+	assert.Equal(t, Money{Amount: 1030, Currency: "RUB"}, sum)
+
+	diff, err := b.Sub(a)
+	assert.NoError(t, err)
+	assert.Equal(t, Money{Amount: -990, Currency: "RUB"}, diff)
+
+	product, err := a.Mul(3)
+	assert.NoError(t, err)
+	assert.Equal(t, Money{Amount: 3030, Currency: "RUB"}, product)
+
+	cmp, err := a.Cmp(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cmp)
+
+	_, err = a.Add(Money{Amount: 1, Currency: "USD"})
+	assert.ErrorIs(t, err, ErrCurrencyMismatch)
+	_, err = a.Cmp(Money{Amount: 1, Currency: "USD"})
+	assert.ErrorIs(t, err, ErrCurrencyMismatch)
+
+	_, err = Money{Amount: 1 << 62, Currency: "RUB"}.Mul(4)
+	assert.ErrorIs(t, err, ErrInvalidMoney)
+
+	largest := Money{Amount: 9999999999, Currency: "RUB"}
+	_, err = largest.Add(Money{Amount: 1, Currency: "RUB"})
+	assert.ErrorIs(t, err, ErrInvalidMoney)
+	_, err = largest.Mul(2)
+	assert.ErrorIs(t, err, ErrInvalidMoney)
+	_, err = Money{Amount: 99999999, Currency: "JPY"}.Add(Money{Amount: 1, Currency: "JPY"})
+	assert.ErrorIs(t, err, ErrInvalidMoney)
+}
+
+func TestMoney_JSON(t *testing.T) {
+	data, err := json.Marshal(Money{Amount: 10050, Currency: "RUB"})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"value":"100.50","currency":"RUB"}`, string(data))
+
+	var m Money
+	assert.NoError(t, json.Unmarshal(data, &m))
+	assert.Equal(t, Money{Amount: 10050, Currency: "RUB"}, m)
+
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"value":100.5,"currency":"RUB"}`), &m), ErrInvalidMoney)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"value":"100.505","currency":"RUB"}`), &m), ErrInvalidMoney)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"value":"100.50"}`), &m), ErrInvalidMoney)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`"100.50"`), &m), ErrInvalidMoney)
+}
+
+func TestOrderTotal(t *testing.T) {
+	rub := func(amount int64) Money { return Money{Amount: amount, Currency: "RUB"} }
+
+	total, err := orderTotal([]OrderItem{
+		{SKU: "sku-1", Quantity: 3, UnitPrice: rub(10)},
+		{SKU: "sku-2", Quantity: 1, UnitPrice: rub(1999)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, rub(2029), total)
+
+	_, err = orderTotal([]OrderItem{
+		{SKU: "sku-1", Quantity: 1, UnitPrice: rub(10)},
+		{SKU: "sku-2", Quantity: 1, UnitPrice: Money{Amount: 10, Currency: "USD"}},
+	})
+	assert.ErrorIs(t, err, ErrInvalidOrder)
+
+	_, err = orderTotal([]OrderItem{{SKU: "sku-1", Quantity: 1}})
+	assert.ErrorIs(t, err, ErrInvalidOrder)
+}
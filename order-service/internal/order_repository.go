@@ -3,47 +3,181 @@ package internal
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/google/uuid"
 )
 
 type OrderRepository interface {
 	CreateOrder(ctx context.Context, order *Order) error
 	GetOrderByID(ctx context.Context, id string) (*Order, error)
-	GetOrdersByUserID(ctx context.Context, userID string) ([]*Order, error)
-	UpdateOrderStatus(ctx context.Context, orderID string, status OrderStatus) error
+	ListOrders(ctx context.Context, filter OrderFilter) ([]*Order, error)
+	UpdateOrderStatus(ctx context.Context, orderID string, from, to OrderStatus, change StatusChange) error
+	GetOrderStatusHistory(ctx context.Context, orderID string) ([]*OrderStatusHistoryEntry, error)
 }
 
 type orderRepository struct {
 	db *sql.DB
+	tx *sql.Tx
 }
 
 func NewOrderRepository(db *sql.DB) OrderRepository {
 	return &orderRepository{db: db}
 }
 
+// NewOrderRepositoryTx returns a repository whose operations all run inside
+// tx. Committing or rolling back tx is up to the caller.
+func NewOrderRepositoryTx(tx *sql.Tx) OrderRepository {
+	return &orderRepository{tx: tx}
+}
+
+func (r *orderRepository) conn() DBTX {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db
+}
+
 func (r *orderRepository) CreateOrder(ctx context.Context, order *Order) error {
 	order.ID = uuid.New().String()
 	order.Status = OrderStatusNew
-	_, err := r.db.ExecContext(ctx,
-		"INSERT INTO orders (id, user_id, amount, description, status) VALUES ($1, $2, $3, $4, $5)",
-		order.ID, order.UserID, order.Amount, order.Description, order.Status)
-	return err
+	order.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	return runInTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		return insertOrder(ctx, tx, order)
+	})
+}
+
+func insertOrder(ctx context.Context, tx *sql.Tx, order *Order) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO orders (id, user_id, amount, currency, description, status, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		order.ID, order.UserID, order.Amount.Decimal(), order.Amount.Currency, order.Description, order.Status, order.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = insertStatusHistory(ctx, tx, order.ID, "", order.Status, StatusChange{
+		Source: StatusSourceHTTP,
+		Reason: "order created",
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range order.Items {
+		item := &order.Items[i]
+		item.ID = uuid.New().String()
+		item.OrderID = order.ID
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO order_items (id, order_id, sku, name, quantity, unit_price) VALUES ($1, $2, $3, $4, $5, $6)",
+			item.ID, item.OrderID, item.SKU, item.Name, item.Quantity, item.UnitPrice.Decimal())
+		if err != nil {
+			return fmt.Errorf("failed to insert order item: %w", err)
+		}
+	}
+	return nil
 }
 
 func (r *orderRepository) GetOrderByID(ctx context.Context, id string) (*Order, error) {
-	var order Order
-	err := r.db.QueryRowContext(ctx,
-		"SELECT id, user_id, amount, description, status FROM orders WHERE id = $1", id).
-		Scan(&order.ID, &order.UserID, &order.Amount, &order.Description, &order.Status)
+	order, err := scanOrder(r.conn().QueryRowContext(ctx,
+		"SELECT "+orderColumns+" FROM orders WHERE id = $1", id))
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
 		return nil, err
 	}
+
+	items, err := r.getOrderItems(ctx, order.ID, order.Amount.Currency)
+	if err != nil {
+		return nil, err
+	}
+	order.Items = items
+
+	return order, nil
+}
+
+const orderColumns = "id, user_id, amount, currency, description, status, created_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrder(row rowScanner) (*Order, error) {
+	var order Order
+	var amount, currency string
+	if err := row.Scan(&order.ID, &order.UserID, &amount, &currency, &order.Description, &order.Status, &order.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if order.Amount, err = ParseMoney(amount, currency); err != nil {
+		return nil, fmt.Errorf("failed to read amount of order %s: %w", order.ID, err)
+	}
 	return &order, nil
 }
 
-func (r *orderRepository) GetOrdersByUserID(ctx context.Context, userID string) ([]*Order, error) {
-	rows, err := r.db.QueryContext(ctx,
-		"SELECT id, user_id, amount, description, status FROM orders WHERE user_id = $1", userID)
+// getOrderItems loads the line items of an order. Item prices are always in
+// the currency of the order, so it is not stored per item.
+func (r *orderRepository) getOrderItems(ctx context.Context, orderID, currency string) ([]OrderItem, error) {
+	rows, err := r.conn().QueryContext(ctx,
+		"SELECT id, order_id, sku, name, quantity, unit_price FROM order_items WHERE order_id = $1", orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order items: %w", err)
+	}
+	defer rows.Close()
+
+	var items []OrderItem
+	for rows.Next() {
+		var item OrderItem
+		var unitPrice string
+		if err := rows.Scan(&item.ID, &item.OrderID, &item.SKU, &item.Name, &item.Quantity, &unitPrice); err != nil {
+			return nil, err
+		}
+		if item.UnitPrice, err = ParseMoney(unitPrice, currency); err != nil {
+			return nil, fmt.Errorf("failed to read price of order item %s: %w", item.ID, err)
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// ListOrders returns up to filter.Limit orders of a user ordered by creation
+// time, starting after filter.Cursor when it is set. The (user_id,
+// created_at, id) indexes keep this a range scan however many orders the user
+// has.
+func (r *orderRepository) ListOrders(ctx context.Context, filter OrderFilter) ([]*Order, error) {
+	query := "SELECT " + orderColumns + " FROM orders WHERE user_id = $1"
+	args := []interface{}{filter.UserID}
+
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		query += fmt.Sprintf(" AND status = $%d", len(args))
+	}
+	if !filter.CreatedFrom.IsZero() {
+		args = append(args, filter.CreatedFrom)
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !filter.CreatedTo.IsZero() {
+		args = append(args, filter.CreatedTo)
+		query += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+
+	direction, comparison := "DESC", "<"
+	if filter.Ascending {
+		direction, comparison = "ASC", ">"
+	}
+	if filter.Cursor != nil {
+		args = append(args, filter.Cursor.CreatedAt, filter.Cursor.ID)
+		query += fmt.Sprintf(" AND (created_at, id) %s ($%d, $%d)", comparison, len(args)-1, len(args))
+	}
+
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY created_at %s, id %s LIMIT $%d", direction, direction, len(args))
+
+	rows, err := r.conn().QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -51,17 +185,64 @@ func (r *orderRepository) GetOrdersByUserID(ctx context.Context, userID string)
 
 	var orders []*Order
 	for rows.Next() {
-		var order Order
-		if err := rows.Scan(&order.ID, &order.UserID, &order.Amount, &order.Description, &order.Status); err != nil {
+		order, err := scanOrder(rows)
+		if err != nil {
 			return nil, err
 		}
-		orders = append(orders, &order)
+		orders = append(orders, order)
 	}
-	return orders, nil
+	return orders, rows.Err()
 }
 
-func (r *orderRepository) UpdateOrderStatus(ctx context.Context, orderID string, status OrderStatus) error {
-	_, err := r.db.ExecContext(ctx,
-		"UPDATE orders SET status = $1 WHERE id = $2", status, orderID)
-	return err
+// UpdateOrderStatus moves the order to status to only if it is still in
+// status from, and returns ErrStatusConflict otherwise. Every successful
+// change is recorded in the order status history in the same transaction.
+func (r *orderRepository) UpdateOrderStatus(ctx context.Context, orderID string, from, to OrderStatus, change StatusChange) error {
+	return runInTx(ctx, r.db, r.tx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx,
+			"UPDATE orders SET status = $1 WHERE id = $2 AND status = $3", to, orderID, from)
+		if err != nil {
+			return err
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return ErrStatusConflict
+		}
+
+		return insertStatusHistory(ctx, tx, orderID, from, to, change)
+	})
+}
+
+func insertStatusHistory(ctx context.Context, tx *sql.Tx, orderID string, from, to OrderStatus, change StatusChange) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO order_status_history (id, order_id, old_status, new_status, reason, source) VALUES ($1, $2, $3, $4, $5, $6)",
+		uuid.New().String(), orderID, from, to, change.Reason, change.Source)
+	if err != nil {
+		return fmt.Errorf("failed to insert status history: %w", err)
+	}
+	return nil
+}
+
+func (r *orderRepository) GetOrderStatusHistory(ctx context.Context, orderID string) ([]*OrderStatusHistoryEntry, error) {
+	rows, err := r.conn().QueryContext(ctx,
+		"SELECT id, order_id, old_status, new_status, reason, source, created_at FROM order_status_history WHERE order_id = $1 ORDER BY created_at, id",
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*OrderStatusHistoryEntry
+	for rows.Next() {
+		var entry OrderStatusHistoryEntry
+		if err := rows.Scan(&entry.ID, &entry.OrderID, &entry.OldStatus, &entry.NewStatus, &entry.Reason, &entry.Source, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
 }
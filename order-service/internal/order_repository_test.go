@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/google/uuid"
@@ -22,27 +23,57 @@ func TestOrderRepository_CreateOrder(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		testOrder := &Order{
 			UserID:      "user1",
-			Amount:      100.50,
+			Amount:      Money{Amount: 10050, Currency: "RUB"},
 			Description: "test order",
+			Items: []OrderItem{
+				{SKU: "sku-1", Name: "item", Quantity: 2, UnitPrice: Money{Amount: 5025, Currency: "RUB"}},
+			},
 		}
 
+		mock.ExpectBegin()
 		mock.ExpectExec("INSERT INTO orders").
-			WithArgs(sqlmock.AnyArg(), testOrder.UserID, testOrder.Amount, testOrder.Description, OrderStatusNew).
+			WithArgs(sqlmock.AnyArg(), testOrder.UserID, "100.50", "RUB", testOrder.Description, OrderStatusNew, sqlmock.AnyArg()).
 			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO order_status_history").
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), OrderStatus(""), OrderStatusNew, "order created", StatusSourceHTTP).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO order_items").
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "sku-1", "item", 2, "50.25").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
 
 		err := repo.CreateOrder(context.Background(), testOrder)
 		assert.NoError(t, err)
 		assert.NotEmpty(t, testOrder.ID)
 		assert.Equal(t, OrderStatusNew, testOrder.Status)
+		assert.Equal(t, testOrder.ID, testOrder.Items[0].OrderID)
 	})
 
 	t.Run("database error", func(t *testing.T) {
 		testOrder := &Order{UserID: "user1"}
+		mock.ExpectBegin()
 		mock.ExpectExec("INSERT INTO orders").WillReturnError(sql.ErrConnDone)
+		mock.ExpectRollback()
 
 		err := repo.CreateOrder(context.Background(), testOrder)
 		assert.Error(t, err)
 	})
+
+	t.Run("item insert error", func(t *testing.T) {
+		testOrder := &Order{
+			UserID: "user1",
+			Items:  []OrderItem{{SKU: "sku-1", Quantity: 1, UnitPrice: Money{Amount: 1000, Currency: "RUB"}}},
+		}
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO order_status_history").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO order_items").WillReturnError(sql.ErrConnDone)
+		mock.ExpectRollback()
+
+		err := repo.CreateOrder(context.Background(), testOrder)
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
 }
 
 func TestOrderRepository_GetOrderByID(t *testing.T) {
@@ -56,16 +87,24 @@ func TestOrderRepository_GetOrderByID(t *testing.T) {
 	testID := uuid.New().String()
 
 	t.Run("success", func(t *testing.T) {
-		rows := sqlmock.NewRows([]string{"id", "user_id", "amount", "description", "status"}).
-			AddRow(testID, "user1", 100.50, "test order", "NEW")
+		rows := sqlmock.NewRows([]string{"id", "user_id", "amount", "currency", "description", "status", "created_at"}).
+			AddRow(testID, "user1", "100.50", "RUB", "test order", "NEW", time.Now())
 
-		mock.ExpectQuery("SELECT id, user_id, amount, description, status FROM orders WHERE id = ?").
+		mock.ExpectQuery("SELECT id, user_id, amount, currency, description, status, created_at FROM orders WHERE id = ?").
 			WithArgs(testID).
 			WillReturnRows(rows)
+		mock.ExpectQuery("SELECT id, order_id, sku, name, quantity, unit_price FROM order_items").
+			WithArgs(testID).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "sku", "name", "quantity", "unit_price"}).
+				AddRow("item1", testID, "sku-1", "item", 2, "50.25"))
 
 		order, err := repo.GetOrderByID(context.Background(), testID)
 		assert.NoError(t, err)
 		assert.Equal(t, testID, order.ID)
+		assert.Len(t, order.Items, 1)
+		assert.Equal(t, "sku-1", order.Items[0].SKU)
+		assert.Equal(t, Money{Amount: 10050, Currency: "RUB"}, order.Amount)
+		assert.Equal(t, Money{Amount: 5025, Currency: "RUB"}, order.Items[0].UnitPrice)
 	})
 
 	t.Run("not found", func(t *testing.T) {
@@ -76,3 +115,113 @@ func TestOrderRepository_GetOrderByID(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestOrderRepository_UpdateOrderStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewOrderRepository(db)
+
+	change := StatusChange{Source: StatusSourcePaymentEvent, Reason: "insufficient funds"}
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE orders SET status = \\$1 WHERE id = \\$2 AND status = \\$3").
+			WithArgs(OrderStatusPaid, "order1", OrderStatusPaymentPending).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO order_status_history").
+			WithArgs(sqlmock.AnyArg(), "order1", OrderStatusPaymentPending, OrderStatusPaid, change.Reason, change.Source).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		err := repo.UpdateOrderStatus(context.Background(), "order1", OrderStatusPaymentPending, OrderStatusPaid, change)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("status changed concurrently", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE orders SET status").
+			WithArgs(OrderStatusCancelled, "order1", OrderStatusPaymentPending).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		err := repo.UpdateOrderStatus(context.Background(), "order1", OrderStatusPaymentPending, OrderStatusCancelled, change)
+		assert.ErrorIs(t, err, ErrStatusConflict)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestOrderRepository_GetOrderStatusHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewOrderRepository(db)
+	createdAt := time.Now()
+
+	rows := sqlmock.NewRows([]string{"id", "order_id", "old_status", "new_status", "reason", "source", "created_at"}).
+		AddRow("h1", "order1", "", "NEW", "order created", "HTTP", createdAt).
+		AddRow("h2", "order1", "NEW", "CANCELLED", "insufficient funds", "PAYMENT_EVENT", createdAt)
+	mock.ExpectQuery("SELECT (.+) FROM order_status_history WHERE order_id = \\$1 ORDER BY created_at").
+		WithArgs("order1").
+		WillReturnRows(rows)
+
+	history, err := repo.GetOrderStatusHistory(context.Background(), "order1")
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, OrderStatusCancelled, history[1].NewStatus)
+	assert.Equal(t, StatusSourcePaymentEvent, history[1].Source)
+	assert.Equal(t, "insufficient funds", history[1].Reason)
+}
+
+func TestOrderRepository_ListOrders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewOrderRepository(db)
+	columns := []string{"id", "user_id", "amount", "currency", "description", "status", "created_at"}
+	createdAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("first page", func(t *testing.T) {
+		mock.ExpectQuery("SELECT (.+) FROM orders WHERE user_id = \\$1 ORDER BY created_at DESC, id DESC LIMIT \\$2").
+			WithArgs("user1", 10).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow("order1", "user1", "10.00", "RUB", "", "PAID", createdAt))
+
+		orders, err := repo.ListOrders(context.Background(), OrderFilter{UserID: "user1", Limit: 10})
+		assert.NoError(t, err)
+		assert.Len(t, orders, 1)
+		assert.Equal(t, createdAt, orders[0].CreatedAt)
+	})
+
+	t.Run("all filters with cursor", func(t *testing.T) {
+		from := createdAt.AddDate(0, -1, 0)
+		to := createdAt.AddDate(0, 1, 0)
+
+		mock.ExpectQuery("WHERE user_id = \\$1 AND status = \\$2 AND created_at >= \\$3 AND created_at < \\$4 "+
+			"AND \\(created_at, id\\) > \\(\\$5, \\$6\\) ORDER BY created_at ASC, id ASC LIMIT \\$7").
+			WithArgs("user1", OrderStatusPaid, from, to, createdAt, "order1", 10).
+			WillReturnRows(sqlmock.NewRows(columns))
+
+		orders, err := repo.ListOrders(context.Background(), OrderFilter{
+			UserID:      "user1",
+			Status:      OrderStatusPaid,
+			CreatedFrom: from,
+			CreatedTo:   to,
+			Ascending:   true,
+			Cursor:      &OrderCursor{CreatedAt: createdAt, ID: "order1"},
+			Limit:       10,
+		})
+		assert.NoError(t, err)
+		assert.Empty(t, orders)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -3,51 +3,154 @@ package internal
 import (
 	"context"
 	"database/sql"
+	"time"
+
 	"github.com/google/uuid"
 )
 
 type OutboxRepository interface {
 	CreateOutboxMessage(ctx context.Context, orderID, payload string) error
-	GetUnprocessedMessages(ctx context.Context) ([]*OutboxMessage, error)
-	MarkMessageAsProcessed(ctx context.Context, id string) error
+	ClaimUnprocessedMessages(ctx context.Context, owner string, limit int, lease time.Duration) ([]*OutboxMessage, error)
+	MarkMessageAsProcessed(ctx context.Context, id, owner string) error
+	RecordPublishFailure(ctx context.Context, id, owner, lastError string, nextAttemptAt time.Time, maxAttempts int) error
+	GetFailedMessages(ctx context.Context, limit int) ([]*OutboxMessage, error)
+	ReplayFailedMessage(ctx context.Context, id string) error
+	DiscardFailedMessage(ctx context.Context, id string) error
 }
 
 type outboxRepository struct {
-	db *sql.DB
+	db DBTX
 }
 
 func NewOutboxRepository(db *sql.DB) OutboxRepository {
 	return &outboxRepository{db: db}
 }
 
-func (r *outboxRepository) CreateOutboxMessage(ctx context.Context, orderID, payload string) error {
-	_, err := r.db.ExecContext(ctx,
-		"INSERT INTO outbox_messages (id, order_id, payload, processed) VALUES ($1, $2, $3, $4)",
-		uuid.New().String(), orderID, payload, false)
-	return err
+// NewOutboxRepositoryTx returns a repository whose operations all run inside
+// tx. Committing or rolling back tx is up to the caller.
+func NewOutboxRepositoryTx(tx *sql.Tx) OutboxRepository {
+	return &outboxRepository{db: tx}
 }
 
-func (r *outboxRepository) GetUnprocessedMessages(ctx context.Context) ([]*OutboxMessage, error) {
-	rows, err := r.db.QueryContext(ctx,
-		"SELECT id, order_id, payload, processed FROM outbox_messages WHERE processed = false")
-	if err != nil {
-		return nil, err
-	}
+const outboxColumns = "id, order_id, payload, processed, status, attempts, COALESCE(last_error, ''), next_attempt_at, created_at"
+
+func scanOutboxMessages(rows *sql.Rows) ([]*OutboxMessage, error) {
 	defer rows.Close()
 
 	var messages []*OutboxMessage
 	for rows.Next() {
 		var msg OutboxMessage
-		if err := rows.Scan(&msg.ID, &msg.OrderID, &msg.Payload, &msg.Processed); err != nil {
+		if err := rows.Scan(&msg.ID, &msg.OrderID, &msg.Payload, &msg.Processed, &msg.Status,
+			&msg.Attempts, &msg.LastError, &msg.NextAttemptAt, &msg.CreatedAt); err != nil {
 			return nil, err
 		}
 		messages = append(messages, &msg)
 	}
-	return messages, nil
+	return messages, rows.Err()
 }
 
-func (r *outboxRepository) MarkMessageAsProcessed(ctx context.Context, id string) error {
+func (r *outboxRepository) CreateOutboxMessage(ctx context.Context, orderID, payload string) error {
 	_, err := r.db.ExecContext(ctx,
-		"UPDATE outbox_messages SET processed = true WHERE id = $1", id)
+		"INSERT INTO outbox_messages (id, order_id, payload, processed) VALUES ($1, $2, $3, $4)",
+		uuid.New().String(), orderID, payload, false)
+	return err
+}
+
+// ClaimUnprocessedMessages leases up to limit pending messages that are due
+// for an attempt to owner. Rows locked by a concurrent claim are skipped and
+// rows with a live lease are not returned, so several relays can poll the
+// same table without publishing a message twice. A lease that expires makes
+// the message claimable again.
+func (r *outboxRepository) ClaimUnprocessedMessages(ctx context.Context, owner string, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		WITH claimed AS (
+			UPDATE outbox_messages
+			SET locked_by = $1, locked_until = NOW() + $2 * INTERVAL '1 millisecond'
+			WHERE id IN (
+				SELECT id FROM outbox_messages
+				WHERE status = 'PENDING'
+					AND next_attempt_at <= NOW()
+					AND (locked_until IS NULL OR locked_until < NOW())
+				ORDER BY created_at
+				LIMIT $3
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING `+outboxColumns+`
+		)
+		SELECT * FROM claimed ORDER BY created_at`,
+		owner, lease.Milliseconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxMessages(rows)
+}
+
+// MarkMessageAsProcessed marks a message claimed by owner as processed and
+// releases its lease.
+func (r *outboxRepository) MarkMessageAsProcessed(ctx context.Context, id, owner string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE outbox_messages
+		SET processed = true, status = 'PROCESSED', locked_by = NULL, locked_until = NULL
+		WHERE id = $1 AND locked_by = $2`,
+		id, owner)
 	return err
 }
+
+// RecordPublishFailure counts a failed attempt, releases the lease and
+// schedules the next attempt. The message becomes FAILED once it has used up
+// maxAttempts.
+func (r *outboxRepository) RecordPublishFailure(ctx context.Context, id, owner, lastError string, nextAttemptAt time.Time, maxAttempts int) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE outbox_messages
+		SET attempts = attempts + 1,
+			last_error = $3,
+			next_attempt_at = $4,
+			status = CASE WHEN attempts + 1 >= $5 THEN 'FAILED' ELSE status END,
+			locked_by = NULL,
+			locked_until = NULL
+		WHERE id = $1 AND locked_by = $2`,
+		id, owner, lastError, nextAttemptAt, maxAttempts)
+	return err
+}
+
+func (r *outboxRepository) GetFailedMessages(ctx context.Context, limit int) ([]*OutboxMessage, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+outboxColumns+" FROM outbox_messages WHERE status = 'FAILED' ORDER BY created_at LIMIT $1",
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxMessages(rows)
+}
+
+// ReplayFailedMessage puts a FAILED message back in the queue with a fresh
+// attempt budget.
+func (r *outboxRepository) ReplayFailedMessage(ctx context.Context, id string) error {
+	return r.updateFailedMessage(ctx, `
+		UPDATE outbox_messages
+		SET status = 'PENDING', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND status = 'FAILED'`, id)
+}
+
+// DiscardFailedMessage gives up on a FAILED message for good. The row is
+// kept for auditing.
+func (r *outboxRepository) DiscardFailedMessage(ctx context.Context, id string) error {
+	return r.updateFailedMessage(ctx,
+		"UPDATE outbox_messages SET status = 'DISCARDED' WHERE id = $1 AND status = 'FAILED'", id)
+}
+
+func (r *outboxRepository) updateFailedMessage(ctx context.Context, query, id string) error {
+	res, err := r.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrOutboxMessageNotFound
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var outboxTestColumns = []string{"id", "order_id", "payload", "processed", "status", "attempts", "last_error", "next_attempt_at", "created_at"}
+
+func TestOutboxRepository_ClaimUnprocessedMessages(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewOutboxRepository(db)
+
+	now := time.Now()
+	rows := sqlmock.NewRows(outboxTestColumns).
+		AddRow("msg1", "order1", `{"type":"payment"}`, false, "PENDING", 0, "", now, now).
+		AddRow("msg2", "order2", `{"type":"refund"}`, false, "PENDING", 2, "channel closed", now, now)
+	mock.ExpectQuery("FOR UPDATE SKIP LOCKED").
+		WithArgs("relay-1", int64(30000), 50).
+		WillReturnRows(rows)
+
+	messages, err := repo.ClaimUnprocessedMessages(context.Background(), "relay-1", 50, 30*time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 2)
+	assert.Equal(t, EventTypePayment, messages[0].EventType())
+	assert.Equal(t, EventTypeRefund, messages[1].EventType())
+	assert.Equal(t, 2, messages[1].Attempts)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOutboxRepository_MarkMessageAsProcessed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewOutboxRepository(db)
+
+	mock.ExpectExec("UPDATE outbox_messages SET processed = true").
+		WithArgs("msg1", "relay-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, repo.MarkMessageAsProcessed(context.Background(), "msg1", "relay-1"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOutboxRepository_RecordPublishFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewOutboxRepository(db)
+	nextAttemptAt := time.Now().Add(time.Minute)
+
+	mock.ExpectExec("UPDATE outbox_messages SET attempts = attempts \\+ 1").
+		WithArgs("msg1", "relay-1", "broker unavailable", nextAttemptAt, 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = repo.RecordPublishFailure(context.Background(), "msg1", "relay-1", "broker unavailable", nextAttemptAt, 5)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOutboxRepository_ReplayAndDiscard(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewOutboxRepository(db)
+
+	t.Run("replay", func(t *testing.T) {
+		mock.ExpectExec("SET status = 'PENDING', attempts = 0").
+			WithArgs("msg1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		assert.NoError(t, repo.ReplayFailedMessage(context.Background(), "msg1"))
+	})
+
+	t.Run("discard", func(t *testing.T) {
+		mock.ExpectExec("SET status = 'DISCARDED'").
+			WithArgs("msg1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		assert.NoError(t, repo.DiscardFailedMessage(context.Background(), "msg1"))
+	})
+
+	t.Run("message is not failed", func(t *testing.T) {
+		mock.ExpectExec("SET status = 'PENDING', attempts = 0").
+			WithArgs("msg2").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		assert.ErrorIs(t, repo.ReplayFailedMessage(context.Background(), "msg2"), ErrOutboxMessageNotFound)
+	})
+}
+
+func TestRetryPolicy_NextDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	assert.Equal(t, time.Second, policy.NextDelay(1))
+	assert.Equal(t, 2*time.Second, policy.NextDelay(2))
+	assert.Equal(t, 8*time.Second, policy.NextDelay(4))
+	assert.Equal(t, 10*time.Second, policy.NextDelay(5))
+	assert.Equal(t, 10*time.Second, policy.NextDelay(50))
+}
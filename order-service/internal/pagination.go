@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultOrderPageSize = 50
+	maxOrderPageSize     = 200
+)
+
+// OrderFilter selects a page of a user's orders. CreatedFrom is inclusive and
+// CreatedTo is exclusive; zero values mean no bound.
+type OrderFilter struct {
+	UserID      string
+	Status      OrderStatus
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Ascending   bool
+	Cursor      *OrderCursor
+	Limit       int
+}
+
+type OrderPage struct {
+	Orders     []*Order `json:"orders"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// OrderCursor points at the last order of a page. Orders are sorted by
+// creation time with the id as a tie breaker, so the pair identifies a
+// position in the listing even when new orders are created meanwhile.
+type OrderCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func (c OrderCursor) Encode() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeOrderCursor(cursor string) (*OrderCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidOrderFilter)
+	}
+
+	createdAt, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidOrderFilter)
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidOrderFilter)
+	}
+	return &OrderCursor{CreatedAt: t, ID: id}, nil
+}
@@ -2,80 +2,13 @@ package internal
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"time"
 
 	amqp "github.com/streadway/amqp"
 )
 
-type RabbitMQ struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
-	url     string
-}
-
-func NewRabbitMQ(url string) (*RabbitMQ, error) {
-	var conn *amqp.Connection
-	var err error
-
-	retryDelay := 5 * time.Second
-	maxRetries := 10
-
-	for i := 0; i < maxRetries; i++ {
-		conn, err = amqp.Dial(url)
-		if err == nil {
-			break
-		}
-
-		log.Printf("Attempt %d/%d: Failed to connect to RabbitMQ at %s: %v",
-			i+1, maxRetries, url, err)
-
-		if i == maxRetries-1 {
-			return nil, fmt.Errorf("failed after %d attempts: %w", maxRetries, err)
-		}
-
-		time.Sleep(retryDelay)
-	}
-
-	ch, err := conn.Channel()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open channel: %w", err)
-	}
-
-	err = ch.ExchangeDeclare(
-		"payments",
-		"direct",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to declare exchange: %w", err)
-	}
-
-	log.Println("Successfully connected to RabbitMQ")
-
-	return &RabbitMQ{
-		conn:    conn,
-		channel: ch,
-		url:     url,
-	}, nil
-}
-
-func (r *RabbitMQ) Close() error {
-	if err := r.channel.Close(); err != nil {
-		return fmt.Errorf("failed to close channel: %w", err)
-	}
-	if err := r.conn.Close(); err != nil {
-		return fmt.Errorf("failed to close connection: %w", err)
-	}
-	return nil
-}
-
 type RabbitMQPaymentQueue struct {
 	rabbitMQ     *RabbitMQ
 	exchangeName string
@@ -97,20 +30,21 @@ func NewRabbitMQPaymentQueue(
 	}
 }
 
-func (q *RabbitMQPaymentQueue) PublishPaymentRequest(ctx context.Context, message []byte) error {
+// PublishPaymentRequest publishes message with the given AMQP message ID and
+// returns once the broker has confirmed it. The outbox message ID is used, so
+// a message that is published again after a failure keeps its ID and
+// payment-service can drop the duplicate.
+func (q *RabbitMQPaymentQueue) PublishPaymentRequest(ctx context.Context, messageID string, message []byte) error {
 	log.Printf("Publishing message to exchange '%s' with routing key '%s'",
 		q.exchangeName, q.routingKey)
 	log.Printf("Message content: %s", string(message))
 
-	err := q.rabbitMQ.channel.Publish(
-		q.exchangeName,
-		q.routingKey,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        message,
-		})
+	err := q.rabbitMQ.Publish(ctx, q.exchangeName, q.routingKey, amqp.Publishing{
+		ContentType:  "application/json",
+		MessageId:    messageID,
+		DeliveryMode: amqp.Persistent,
+		Body:         message,
+	})
 
 	if err != nil {
 		log.Printf("Publish failed with error: %v", err)
@@ -121,34 +55,31 @@ func (q *RabbitMQPaymentQueue) PublishPaymentRequest(ctx context.Context, messag
 	return nil
 }
 
-func (q *RabbitMQPaymentQueue) SubscribeToPaymentUpdates(ctx context.Context, callback func(orderID string, success bool)) error {
-	_, err := q.rabbitMQ.channel.QueueDeclare(
-		q.queueName,
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to declare queue: %w", err)
+// SubscribeToPaymentUpdates passes every received update to callback and
+// acknowledges it only once callback has returned, so an update is not lost
+// when handling it fails or the service stops half way. At most
+// config.Prefetch updates are delivered before they are acknowledged, and
+// failed updates are retried or parked as described by config.Retry.
+func (q *RabbitMQPaymentQueue) SubscribeToPaymentUpdates(ctx context.Context, config ConsumerConfig, callback func(update PaymentUpdate) error) error {
+	// The consumer is set up again on the new channel after a reconnect.
+	return q.rabbitMQ.Setup(func(ch *amqp.Channel) error {
+		return q.consume(ctx, ch, config, callback)
+	})
+}
+
+func (q *RabbitMQPaymentQueue) consume(ctx context.Context, ch *amqp.Channel, config ConsumerConfig, callback func(update PaymentUpdate) error) error {
+	if err := ch.Qos(config.Prefetch, 0, false); err != nil {
+		return fmt.Errorf("failed to set prefetch: %w", err)
 	}
 
-	err = q.rabbitMQ.channel.QueueBind(
-		q.queueName,
-		q.routingKey,
-		q.exchangeName,
-		false,
-		nil,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to bind queue: %w", err)
+	if err := q.declareConsumerTopology(ch, config.Retry); err != nil {
+		return err
 	}
 
-	msgs, err := q.rabbitMQ.channel.Consume(
+	msgs, err := ch.Consume(
 		q.queueName,
 		"",
-		true,
+		false,
 		false,
 		false,
 		false,
@@ -168,20 +99,42 @@ func (q *RabbitMQPaymentQueue) SubscribeToPaymentUpdates(ctx context.Context, ca
 					return
 				}
 
-				var result struct {
-					OrderID string `json:"order_id"`
-					Success bool   `json:"success"`
-				}
-
-				if err := json.Unmarshal(msg.Body, &result); err != nil {
-					log.Printf("Failed to unmarshal message: %v", err)
+				update, err := decodePaymentUpdate(msg.Body)
+				if err != nil {
+					q.settleDelivery(ctx, msg, config.Retry, err)
 					continue
 				}
 
-				callback(result.OrderID, result.Success)
+				q.settleDelivery(ctx, msg, config.Retry, callback(*update))
 			}
 		}
 	}()
 
 	return nil
 }
+
+// decodePaymentUpdate reads the envelope of a received message and its
+// payload.
+func decodePaymentUpdate(body []byte) (*PaymentUpdate, error) {
+	envelope, err := DecodeEventEnvelope(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var update PaymentUpdate
+	if err := envelope.DecodePayload(&update); err != nil {
+		return nil, err
+	}
+	update.Type = envelope.EventType
+	update.MessageID = envelope.MessageID
+	return &update, nil
+}
+
+// isPermanentFailure reports whether handling an update failed in a way
+// that would not change if the update were delivered again.
+func isPermanentFailure(err error) bool {
+	return errors.Is(err, ErrUnprocessableMessage) ||
+		errors.Is(err, ErrUnsupportedSchemaVersion) ||
+		errors.Is(err, ErrOrderNotFound) ||
+		errors.Is(err, ErrInvalidTransition)
+}
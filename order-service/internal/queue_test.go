@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPermanentFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{"unprocessable message", fmt.Errorf("%w: bad json", ErrUnprocessableMessage), true},
+		{"unsupported schema version", fmt.Errorf("%w: 2", ErrUnsupportedSchemaVersion), true},
+		{"unknown order", ErrOrderNotFound, true},
+		{"invalid transition", fmt.Errorf("%w: PAID -> NEW", ErrInvalidTransition), true},
+		{"concurrent status change", ErrStatusConflict, false},
+		{"database failure", errors.New("connection refused"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.permanent, isPermanentFailure(tt.err))
+		})
+	}
+}
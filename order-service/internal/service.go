@@ -3,83 +3,516 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 )
 
 type OrderService interface {
-	CreateOrder(ctx context.Context, userID string, amount float64, description string) (*Order, error)
+	CreateOrder(ctx context.Context, userID, description string, items []OrderItem, claim *IdempotencyClaim) (*Order, error)
 	GetOrder(ctx context.Context, id string) (*Order, error)
-	ListOrders(ctx context.Context, userID string) ([]*Order, error)
-	ProcessPaymentEvent(ctx context.Context, orderID string, success bool) error
+	ListOrders(ctx context.Context, filter OrderFilter) (*OrderPage, error)
+	CancelOrder(ctx context.Context, id string) (*Order, error)
+	CaptureOrder(ctx context.Context, id string) (*Order, error)
+	MarkPaymentPending(ctx context.Context, orderID string) error
+	GetOrderHistory(ctx context.Context, id string) ([]*OrderStatusHistoryEntry, error)
+	ProcessPaymentEvent(ctx context.Context, orderID string, success bool, change StatusChange) error
+	ProcessAuthorizationEvent(ctx context.Context, orderID string, success bool, change StatusChange) error
+	ProcessCaptureEvent(ctx context.Context, orderID string, success bool, change StatusChange) error
+	ProcessReleaseEvent(ctx context.Context, orderID string, change StatusChange) error
+	ProcessRefundEvent(ctx context.Context, orderID string, success, partial bool, change StatusChange) error
 }
 
 type orderService struct {
 	orderRepo    OrderRepository
 	outboxRepo   OutboxRepository
+	uow          UnitOfWork
 	paymentQueue *RabbitMQPaymentQueue
 }
 
 func NewOrderService(
 	orderRepo OrderRepository,
 	outboxRepo OutboxRepository,
+	uow UnitOfWork,
 	paymentQueue *RabbitMQPaymentQueue,
 ) OrderService {
 	return &orderService{
 		orderRepo:    orderRepo,
 		outboxRepo:   outboxRepo,
+		uow:          uow,
 		paymentQueue: paymentQueue,
 	}
 }
 
-func (s *orderService) CreateOrder(ctx context.Context, userID string, amount float64, description string) (*Order, error) {
+// CreateOrder creates an order and its authorization request. When claim is
+// set, the order is attached to the idempotency key in the same transaction.
+func (s *orderService) CreateOrder(ctx context.Context, userID, description string, items []OrderItem, claim *IdempotencyClaim) (*Order, error) {
+	if userID == "" {
+		return nil, fmt.Errorf("%w: user id is required", ErrInvalidOrder)
+	}
+
+	amount, err := orderTotal(items)
+	if err != nil {
+		return nil, err
+	}
+
 	order := &Order{
 		UserID:      userID,
 		Amount:      amount,
 		Description: description,
 		Status:      OrderStatusNew,
+		Items:       items,
+	}
+
+	// The order and its authorization request are committed together, so an
+	// order is never left without a payment and a payment never refers to a
+	// missing order.
+	err = s.uow.Do(ctx, func(orders OrderRepository, outbox OutboxRepository, keys IdempotencyRepository) error {
+		if err := orders.CreateOrder(ctx, order); err != nil {
+			return fmt.Errorf("failed to create order: %w", err)
+		}
+
+		if claim != nil {
+			if err := keys.AttachOrder(ctx, claim, order.ID); err != nil {
+				return fmt.Errorf("failed to attach order to idempotency key: %w", err)
+			}
+		}
+
+		payload, err := paymentTaskPayload(order)
+		if err != nil {
+			return err
+		}
+
+		if err := outbox.CreateOutboxMessage(ctx, order.ID, payload); err != nil {
+			return fmt.Errorf("failed to create outbox message: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+func paymentTaskPayload(order *Order) (string, error) {
+	items := make([]PaymentRequestItem, 0, len(order.Items))
+	for _, item := range order.Items {
+		items = append(items, PaymentRequestItem{
+			SKU:       item.SKU,
+			Name:      item.Name,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+		})
+	}
+
+	return encodePaymentRequest(EventTypeAuthorize, "", PaymentRequest{
+		OrderID:     order.ID,
+		UserID:      order.UserID,
+		Amount:      order.Amount,
+		Description: order.Description,
+		Items:       items,
+	})
+}
+
+// orderTotal validates the line items and sums them up. All items must be
+// priced in the same currency, which becomes the currency of the order.
+func orderTotal(items []OrderItem) (Money, error) {
+	if len(items) == 0 {
+		return Money{}, fmt.Errorf("%w: at least one item is required", ErrInvalidOrder)
+	}
+
+	total := Money{Currency: items[0].UnitPrice.Currency}
+	for i, item := range items {
+		if item.SKU == "" {
+			return Money{}, fmt.Errorf("%w: item %d: sku is required", ErrInvalidOrder, i)
+		}
+		if item.Quantity <= 0 {
+			return Money{}, fmt.Errorf("%w: item %d: quantity must be positive", ErrInvalidOrder, i)
+		}
+		if item.UnitPrice.Currency == "" {
+			return Money{}, fmt.Errorf("%w: item %d: unit price is required", ErrInvalidOrder, i)
+		}
+		if item.UnitPrice.IsNegative() {
+			return Money{}, fmt.Errorf("%w: item %d: unit price must not be negative", ErrInvalidOrder, i)
+		}
+
+		line, err := item.UnitPrice.Mul(int64(item.Quantity))
+		if err != nil {
+			return Money{}, fmt.Errorf("%w: item %d: %v", ErrInvalidOrder, i, err)
+		}
+		if total, err = total.Add(line); err != nil {
+			return Money{}, fmt.Errorf("%w: item %d: %v", ErrInvalidOrder, i, err)
+		}
+	}
+	return total, nil
+}
+
+func (s *orderService) GetOrder(ctx context.Context, id string) (*Order, error) {
+	order, err := s.orderRepo.GetOrderByID(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	if order == nil {
+		return nil, ErrOrderNotFound
+	}
+	return order, nil
+}
+
+func (s *orderService) GetOrderHistory(ctx context.Context, id string) ([]*OrderStatusHistoryEntry, error) {
+	if _, err := s.GetOrder(ctx, id); err != nil {
+		return nil, err
 	}
 
-	if err := s.orderRepo.CreateOrder(ctx, order); err != nil {
-		return nil, fmt.Errorf("failed to create order: %w", err)
+	history, err := s.orderRepo.GetOrderStatusHistory(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order history: %w", err)
 	}
+	return history, nil
+}
 
-	paymentTask := map[string]interface{}{
-		"order_id":    order.ID,
-		"user_id":     userID,
-		"amount":      amount,
-		"description": description,
+func (s *orderService) ListOrders(ctx context.Context, filter OrderFilter) (*OrderPage, error) {
+	if filter.UserID == "" {
+		return nil, fmt.Errorf("%w: user id is required", ErrInvalidOrderFilter)
+	}
+	if filter.Status != "" {
+		if _, ok := orderTransitions[filter.Status]; !ok {
+			return nil, fmt.Errorf("%w: unknown status %q", ErrInvalidOrderFilter, filter.Status)
+		}
+	}
+	if !filter.CreatedFrom.IsZero() && !filter.CreatedTo.IsZero() && !filter.CreatedFrom.Before(filter.CreatedTo) {
+		return nil, fmt.Errorf("%w: created_from must be before created_to", ErrInvalidOrderFilter)
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultOrderPageSize
+	}
+	if filter.Limit > maxOrderPageSize {
+		filter.Limit = maxOrderPageSize
 	}
 
-	payload, err := json.Marshal(paymentTask)
+	// Ask for one extra row to find out whether there is a next page.
+	pageSize := filter.Limit
+	filter.Limit++
+
+	orders, err := s.orderRepo.ListOrders(ctx, filter)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal payment task: %w", err)
+		return nil, fmt.Errorf("failed to list orders: %w", err)
+	}
+
+	page := &OrderPage{Orders: orders}
+	if len(orders) > pageSize {
+		page.Orders = orders[:pageSize]
+		last := page.Orders[pageSize-1]
+		page.NextCursor = OrderCursor{CreatedAt: last.CreatedAt, ID: last.ID}.Encode()
+	}
+	if page.Orders == nil {
+		page.Orders = []*Order{}
 	}
+	return page, nil
+}
 
-	if err := s.outboxRepo.CreateOutboxMessage(ctx, order.ID, string(payload)); err != nil {
-		return nil, fmt.Errorf("failed to create outbox message: %w", err)
+// CancelOrder cancels a NEW or PAYMENT_PENDING order right away. An
+// AUTHORIZED order is cancelled as well and its hold is released. A PAID
+// order is moved to REFUND_PENDING and a refund request is sent to
+// payment-service; the order becomes REFUNDED once the refund is confirmed.
+func (s *orderService) CancelOrder(ctx context.Context, id string) (*Order, error) {
+	order, err := s.GetOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	change := StatusChange{Source: StatusSourceHTTP, Reason: "cancelled by user"}
+
+	switch order.Status {
+	case OrderStatusNew, OrderStatusPaymentPending:
+		if err := s.transition(ctx, order, OrderStatusCancelled, change); err != nil {
+			return nil, err
+		}
+	case OrderStatusAuthorized:
+		if err := s.requestPaymentAction(ctx, order, OrderStatusCancelled, EventTypeRelease, change); err != nil {
+			return nil, err
+		}
+	case OrderStatusPaid:
+		if err := s.requestPaymentAction(ctx, order, OrderStatusRefundPending, EventTypeRefund, change); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: order is %s", ErrCannotCancel, order.Status)
 	}
 
 	return order, nil
 }
 
-func (s *orderService) GetOrder(ctx context.Context, id string) (*Order, error) {
-	return s.orderRepo.GetOrderByID(ctx, id)
+// CaptureOrder asks payment-service to take the funds held for an
+// AUTHORIZED order. The order is CAPTURE_PENDING until the capture is
+// confirmed and becomes PAID then. Authorized orders are normally captured
+// by ProcessAuthorizationEvent; this is for orders authorized before that.
+func (s *orderService) CaptureOrder(ctx context.Context, id string) (*Order, error) {
+	order, err := s.GetOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != OrderStatusAuthorized {
+		return nil, fmt.Errorf("%w: order is %s", ErrCannotCapture, order.Status)
+	}
+
+	change := StatusChange{Source: StatusSourceHTTP, Reason: "capture requested"}
+	if err := s.requestPaymentAction(ctx, order, OrderStatusCapturePending, EventTypeCapture, change); err != nil {
+		return nil, err
+	}
+	return order, nil
 }
 
-func (s *orderService) ListOrders(ctx context.Context, userID string) ([]*Order, error) {
-	return s.orderRepo.GetOrdersByUserID(ctx, userID)
+// MarkPaymentPending records that the payment request for the order has been
+// handed over to the broker. Orders that have already moved on, because the
+// payment result arrived first or the user cancelled, are left untouched.
+func (s *orderService) MarkPaymentPending(ctx context.Context, orderID string) error {
+	order, err := s.GetOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if order.Status != OrderStatusNew {
+		return nil
+	}
+
+	err = s.transition(ctx, order, OrderStatusPaymentPending, StatusChange{
+		Source: StatusSourceSweeper,
+		Reason: "payment request published",
+	})
+	if errors.Is(err, ErrStatusConflict) {
+		return nil
+	}
+	return err
 }
 
-func (s *orderService) ProcessPaymentEvent(ctx context.Context, orderID string, success bool) error {
-	var status OrderStatus
-	if success {
-		status = OrderStatusPaid
-	} else {
+// requestPaymentAction moves the order to status and, in the same
+// transaction, queues a request of eventType for payment-service.
+func (s *orderService) requestPaymentAction(ctx context.Context, order *Order, status OrderStatus, eventType string, change StatusChange) error {
+	payload, err := paymentActionPayload(order, eventType, change.CausationID)
+	if err != nil {
+		return err
+	}
+
+	return s.uow.Do(ctx, func(orders OrderRepository, outbox OutboxRepository, _ IdempotencyRepository) error {
+		if err := transition(ctx, orders, order, status, change); err != nil {
+			return err
+		}
+
+		if err := outbox.CreateOutboxMessage(ctx, order.ID, payload); err != nil {
+			return fmt.Errorf("failed to create outbox message: %w", err)
+		}
+		return nil
+	})
+}
+
+func paymentActionPayload(order *Order, eventType, causationID string) (string, error) {
+	return encodePaymentRequest(eventType, causationID, PaymentRequest{
+		OrderID: order.ID,
+		UserID:  order.UserID,
+		Amount:  order.Amount,
+	})
+}
+
+// encodePaymentRequest wraps request in an envelope correlated by the order
+// ID and returns it as an outbox payload.
+func encodePaymentRequest(eventType, causationID string, request PaymentRequest) (string, error) {
+	envelope, err := NewEventEnvelope(eventType, request.OrderID, causationID, request)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal %s task: %w", eventType, err)
+	}
+	return string(payload), nil
+}
+
+func (s *orderService) ProcessPaymentEvent(ctx context.Context, orderID string, success bool, change StatusChange) error {
+	order, err := s.GetOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	if !success {
+		if order.Status == OrderStatusCancelled {
+			return nil
+		}
+		if change.Reason == "" {
+			change.Reason = "payment failed"
+		}
+		return s.transition(ctx, order, OrderStatusCancelled, change)
+	}
+
+	switch order.Status {
+	case OrderStatusPaid, OrderStatusRefundPending, OrderStatusRefunded:
+		// Duplicate delivery of a payment that has already been applied.
+		return nil
+	case OrderStatusCancelled:
+		// The user cancelled the order while the payment was in flight, so
+		// the money that has just been taken has to be given back.
+		change.Reason = "payment received after cancellation"
+		return s.requestPaymentAction(ctx, order, OrderStatusRefundPending, EventTypeRefund, change)
+	default:
+		if change.Reason == "" {
+			change.Reason = "payment succeeded"
+		}
+		return s.transition(ctx, order, OrderStatusPaid, change)
+	}
+}
+
+// ProcessAuthorizationEvent applies the result of placing a hold on the
+// funds for a new order. An authorized order is captured right away.
+func (s *orderService) ProcessAuthorizationEvent(ctx context.Context, orderID string, success bool, change StatusChange) error {
+	order, err := s.GetOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	if !success {
+		if order.Status == OrderStatusCancelled {
+			return nil
+		}
+		if change.Reason == "" {
+			change.Reason = "authorization failed"
+		}
+		return s.transition(ctx, order, OrderStatusCancelled, change)
+	}
+
+	switch order.Status {
+	case OrderStatusNew, OrderStatusPaymentPending:
+		if change.Reason == "" {
+			change.Reason = "funds authorized"
+		}
+		// Nothing else captures the hold, so the capture request is queued
+		// together with the authorization; otherwise the hold would expire
+		// and the order would be cancelled.
+		payload, err := paymentActionPayload(order, EventTypeCapture, change.CausationID)
+		if err != nil {
+			return err
+		}
+		return s.uow.Do(ctx, func(orders OrderRepository, outbox OutboxRepository, _ IdempotencyRepository) error {
+			if err := transition(ctx, orders, order, OrderStatusAuthorized, change); err != nil {
+				return err
+			}
+			capture := StatusChange{Source: change.Source, Reason: "capture requested", CausationID: change.CausationID}
+			if err := transition(ctx, orders, order, OrderStatusCapturePending, capture); err != nil {
+				return err
+			}
+
+			if err := outbox.CreateOutboxMessage(ctx, order.ID, payload); err != nil {
+				return fmt.Errorf("failed to create outbox message: %w", err)
+			}
+			return nil
+		})
+	case OrderStatusCancelled:
+		// The user cancelled the order while the authorization was in
+		// flight, so the hold that has just been placed is released. The
+		// order itself stays cancelled.
+		payload, err := paymentActionPayload(order, EventTypeRelease, change.CausationID)
+		if err != nil {
+			return err
+		}
+		return s.uow.Do(ctx, func(_ OrderRepository, outbox OutboxRepository, _ IdempotencyRepository) error {
+			if err := outbox.CreateOutboxMessage(ctx, order.ID, payload); err != nil {
+				return fmt.Errorf("failed to create outbox message: %w", err)
+			}
+			return nil
+		})
+	default:
+		// Duplicate delivery of an authorization that has already been
+		// applied.
+		return nil
+	}
+}
+
+// ProcessCaptureEvent applies the result of capturing the held funds. A
+// capture fails when the hold is gone, so the order is cancelled then.
+func (s *orderService) ProcessCaptureEvent(ctx context.Context, orderID string, success bool, change StatusChange) error {
+	order, err := s.GetOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	status := OrderStatusPaid
+	reason := "payment captured"
+	if !success {
 		status = OrderStatusCancelled
+		reason = "capture failed"
+	}
+	if change.Reason == "" {
+		change.Reason = reason
+	}
+
+	if order.Status == status || (success && order.Status != OrderStatusCapturePending) {
+		return nil
+	}
+	return s.transition(ctx, order, status, change)
+}
+
+// ProcessReleaseEvent cancels an AUTHORIZED order whose hold has been
+// released by payment-service, usually because it expired. Releases of
+// holds that belong to orders that have already moved on are ignored.
+func (s *orderService) ProcessReleaseEvent(ctx context.Context, orderID string, change StatusChange) error {
+	order, err := s.GetOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if order.Status != OrderStatusAuthorized {
+		return nil
+	}
+
+	if change.Reason == "" {
+		change.Reason = "authorization released"
+	}
+	return s.transition(ctx, order, OrderStatusCancelled, change)
+}
+
+// ProcessRefundEvent applies the result of a refund. Refunds requested by
+// CancelOrder always give back everything that is left, while a partial
+// refund made through the payment-service API leaves the order status as it
+// is.
+func (s *orderService) ProcessRefundEvent(ctx context.Context, orderID string, success, partial bool, change StatusChange) error {
+	order, err := s.GetOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	if success && partial {
+		return nil
+	}
+
+	status := OrderStatusRefunded
+	reason := "refund completed"
+	if !success {
+		// The money was never returned, so the order stays paid and can be
+		// cancelled again later.
+		status = OrderStatusPaid
+		reason = "refund failed"
+	}
+	if change.Reason == "" {
+		change.Reason = reason
+	}
+
+	if order.Status == status {
+		return nil
+	}
+	return s.transition(ctx, order, status, change)
+}
+
+func (s *orderService) transition(ctx context.Context, order *Order, to OrderStatus, change StatusChange) error {
+	return transition(ctx, s.orderRepo, order, to, change)
+}
+
+// transition validates the move against the order state machine and applies
+// it with a conditional update, so a concurrent change is never overwritten.
+func transition(ctx context.Context, orders OrderRepository, order *Order, to OrderStatus, change StatusChange) error {
+	if err := checkTransition(order.ID, order.Status, to); err != nil {
+		return err
 	}
 
-	if err := s.orderRepo.UpdateOrderStatus(ctx, orderID, status); err != nil {
+	if err := orders.UpdateOrderStatus(ctx, order.ID, order.Status, to, change); err != nil {
 		return fmt.Errorf("failed to update order status: %w", err)
 	}
+	order.Status = to
 	return nil
 }
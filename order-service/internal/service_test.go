@@ -0,0 +1,457 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeOrderRepository struct {
+	orders  map[string]*Order
+	history []*OrderStatusHistoryEntry
+}
+
+func newFakeOrderRepository(orders ...*Order) *fakeOrderRepository {
+	repo := &fakeOrderRepository{orders: make(map[string]*Order)}
+	for _, order := range orders {
+		repo.orders[order.ID] = order
+	}
+	return repo
+}
+
+func (r *fakeOrderRepository) CreateOrder(ctx context.Context, order *Order) error {
+	order.ID = "order-" + order.UserID
+	order.Status = OrderStatusNew
+	stored := *order
+	r.orders[order.ID] = &stored
+	return nil
+}
+
+func (r *fakeOrderRepository) GetOrderByID(ctx context.Context, id string) (*Order, error) {
+	order, ok := r.orders[id]
+	if !ok {
+		return nil, nil
+	}
+	copied := *order
+	return &copied, nil
+}
+
+func (r *fakeOrderRepository) ListOrders(ctx context.Context, filter OrderFilter) ([]*Order, error) {
+	var orders []*Order
+	for _, order := range r.orders {
+		if order.UserID == filter.UserID && len(orders) < filter.Limit {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+func (r *fakeOrderRepository) UpdateOrderStatus(ctx context.Context, orderID string, from, to OrderStatus, change StatusChange) error {
+	order, ok := r.orders[orderID]
+	if !ok || order.Status != from {
+		return ErrStatusConflict
+	}
+	order.Status = to
+	r.history = append(r.history, &OrderStatusHistoryEntry{
+		OrderID:   orderID,
+		OldStatus: from,
+		NewStatus: to,
+		Reason:    change.Reason,
+		Source:    change.Source,
+	})
+	return nil
+}
+
+func (r *fakeOrderRepository) GetOrderStatusHistory(ctx context.Context, orderID string) ([]*OrderStatusHistoryEntry, error) {
+	var entries []*OrderStatusHistoryEntry
+	for _, entry := range r.history {
+		if entry.OrderID == orderID {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+type fakeOutboxRepository struct {
+	payloads []string
+}
+
+func (r *fakeOutboxRepository) CreateOutboxMessage(ctx context.Context, orderID, payload string) error {
+	r.payloads = append(r.payloads, payload)
+	return nil
+}
+
+func (r *fakeOutboxRepository) ClaimUnprocessedMessages(ctx context.Context, owner string, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	return nil, nil
+}
+
+func (r *fakeOutboxRepository) MarkMessageAsProcessed(ctx context.Context, id, owner string) error {
+	return nil
+}
+
+func (r *fakeOutboxRepository) RecordPublishFailure(ctx context.Context, id, owner, lastError string, nextAttemptAt time.Time, maxAttempts int) error {
+	return nil
+}
+
+func (r *fakeOutboxRepository) GetFailedMessages(ctx context.Context, limit int) ([]*OutboxMessage, error) {
+	return nil, nil
+}
+
+func (r *fakeOutboxRepository) ReplayFailedMessage(ctx context.Context, id string) error {
+	return nil
+}
+
+func (r *fakeOutboxRepository) DiscardFailedMessage(ctx context.Context, id string) error {
+	return nil
+}
+
+type fakeUnitOfWork struct {
+	orders OrderRepository
+	outbox OutboxRepository
+	keys   IdempotencyRepository
+}
+
+func (u *fakeUnitOfWork) Do(ctx context.Context, fn func(orders OrderRepository, outbox OutboxRepository, keys IdempotencyRepository) error) error {
+	return fn(u.orders, u.outbox, u.keys)
+}
+
+func newTestOrderService(status OrderStatus) (OrderService, *fakeOrderRepository, *fakeOutboxRepository) {
+	orderRepo := newFakeOrderRepository(&Order{ID: "order1", UserID: "user1", Amount: Money{Amount: 1000, Currency: "RUB"}, Status: status})
+	outboxRepo := &fakeOutboxRepository{}
+	uow := &fakeUnitOfWork{orders: orderRepo, outbox: outboxRepo}
+	return NewOrderService(orderRepo, outboxRepo, uow, nil), orderRepo, outboxRepo
+}
+
+func TestOrderService_ProcessPaymentEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     OrderStatus
+		success    bool
+		wantStatus OrderStatus
+		wantErr    error
+		wantRefund bool
+	}{
+		{name: "new paid", status: OrderStatusNew, success: true, wantStatus: OrderStatusPaid},
+		{name: "pending paid", status: OrderStatusPaymentPending, success: true, wantStatus: OrderStatusPaid},
+		{name: "pending failed", status: OrderStatusPaymentPending, success: false, wantStatus: OrderStatusCancelled},
+		{name: "duplicate success", status: OrderStatusPaid, success: true, wantStatus: OrderStatusPaid},
+		{name: "duplicate failure", status: OrderStatusCancelled, success: false, wantStatus: OrderStatusCancelled},
+		{name: "late failure on paid order", status: OrderStatusPaid, success: false, wantStatus: OrderStatusPaid, wantErr: ErrInvalidTransition},
+		{name: "late failure on refunded order", status: OrderStatusRefunded, success: false, wantStatus: OrderStatusRefunded, wantErr: ErrInvalidTransition},
+		{name: "success after user cancel", status: OrderStatusCancelled, success: true, wantStatus: OrderStatusRefundPending, wantRefund: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, orderRepo, outboxRepo := newTestOrderService(tt.status)
+
+			err := service.ProcessPaymentEvent(context.Background(), "order1", tt.success, StatusChange{Source: StatusSourcePaymentEvent})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantStatus, orderRepo.orders["order1"].Status)
+			assert.Equal(t, tt.wantRefund, len(outboxRepo.payloads) == 1)
+		})
+	}
+
+	t.Run("unknown order", func(t *testing.T) {
+		service, _, _ := newTestOrderService(OrderStatusNew)
+		err := service.ProcessPaymentEvent(context.Background(), "missing", true, StatusChange{Source: StatusSourcePaymentEvent})
+		assert.ErrorIs(t, err, ErrOrderNotFound)
+	})
+}
+
+func TestOrderService_ProcessRefundEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     OrderStatus
+		success    bool
+		partial    bool
+		wantStatus OrderStatus
+		wantErr    error
+	}{
+		{name: "refund confirmed", status: OrderStatusRefundPending, success: true, wantStatus: OrderStatusRefunded},
+		{name: "full refund of paid order", status: OrderStatusPaid, success: true, wantStatus: OrderStatusRefunded},
+		{name: "partial refund of paid order", status: OrderStatusPaid, success: true, partial: true, wantStatus: OrderStatusPaid},
+		{name: "refund failed", status: OrderStatusRefundPending, success: false, wantStatus: OrderStatusPaid},
+		{name: "duplicate confirmation", status: OrderStatusRefunded, success: true, wantStatus: OrderStatusRefunded},
+		{name: "failure after refund", status: OrderStatusRefunded, success: false, wantStatus: OrderStatusRefunded, wantErr: ErrInvalidTransition},
+		{name: "refund for new order", status: OrderStatusNew, success: true, wantStatus: OrderStatusNew, wantErr: ErrInvalidTransition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, orderRepo, _ := newTestOrderService(tt.status)
+
+			err := service.ProcessRefundEvent(context.Background(), "order1", tt.success, tt.partial, StatusChange{Source: StatusSourcePaymentEvent})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantStatus, orderRepo.orders["order1"].Status)
+		})
+	}
+}
+
+func TestOrderService_ProcessAuthorizationEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     OrderStatus
+		success    bool
+		wantStatus OrderStatus
+		wantEvent  string
+	}{
+		{name: "pending authorized", status: OrderStatusPaymentPending, success: true, wantStatus: OrderStatusCapturePending, wantEvent: EventTypeCapture},
+		{name: "new authorized", status: OrderStatusNew, success: true, wantStatus: OrderStatusCapturePending, wantEvent: EventTypeCapture},
+		{name: "pending declined", status: OrderStatusPaymentPending, success: false, wantStatus: OrderStatusCancelled},
+		{name: "duplicate authorization", status: OrderStatusAuthorized, success: true, wantStatus: OrderStatusAuthorized},
+		{name: "duplicate authorization during capture", status: OrderStatusCapturePending, success: true, wantStatus: OrderStatusCapturePending},
+		{name: "authorization after user cancel", status: OrderStatusCancelled, success: true, wantStatus: OrderStatusCancelled, wantEvent: EventTypeRelease},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, orderRepo, outboxRepo := newTestOrderService(tt.status)
+
+			change := StatusChange{Source: StatusSourcePaymentEvent, CausationID: "msg1"}
+			err := service.ProcessAuthorizationEvent(context.Background(), "order1", tt.success, change)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, orderRepo.orders["order1"].Status)
+			if tt.wantEvent == "" {
+				assert.Empty(t, outboxRepo.payloads)
+				return
+			}
+			if assert.Len(t, outboxRepo.payloads, 1) {
+				assert.Contains(t, outboxRepo.payloads[0], `"event_type":"`+tt.wantEvent+`"`)
+				assert.Contains(t, outboxRepo.payloads[0], `"causation_id":"msg1"`)
+			}
+		})
+	}
+}
+
+func TestOrderService_CreatedOrderIsPaid(t *testing.T) {
+	orderRepo := newFakeOrderRepository()
+	outboxRepo := &fakeOutboxRepository{}
+	uow := &fakeUnitOfWork{orders: orderRepo, outbox: outboxRepo}
+	service := NewOrderService(orderRepo, outboxRepo, uow, nil)
+	ctx := context.Background()
+
+	order, err := service.CreateOrder(ctx, "user1", "test", testItems, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, service.MarkPaymentPending(ctx, order.ID))
+
+	event := StatusChange{Source: StatusSourcePaymentEvent}
+	assert.NoError(t, service.ProcessAuthorizationEvent(ctx, order.ID, true, event))
+	assert.NoError(t, service.ProcessCaptureEvent(ctx, order.ID, true, event))
+
+	stored, err := service.GetOrder(ctx, order.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, OrderStatusPaid, stored.Status)
+
+	if assert.Len(t, outboxRepo.payloads, 2) {
+		assert.Contains(t, outboxRepo.payloads[0], `"event_type":"authorize"`)
+		assert.Contains(t, outboxRepo.payloads[1], `"event_type":"capture"`)
+	}
+
+	var statuses []OrderStatus
+	for _, entry := range orderRepo.history {
+		statuses = append(statuses, entry.NewStatus)
+	}
+	assert.Equal(t, []OrderStatus{OrderStatusPaymentPending, OrderStatusAuthorized, OrderStatusCapturePending, OrderStatusPaid}, statuses)
+}
+
+func TestOrderService_CaptureOrder(t *testing.T) {
+	t.Run("authorized", func(t *testing.T) {
+		service, orderRepo, outboxRepo := newTestOrderService(OrderStatusAuthorized)
+
+		_, err := service.CaptureOrder(context.Background(), "order1")
+		assert.NoError(t, err)
+		assert.Equal(t, OrderStatusCapturePending, orderRepo.orders["order1"].Status)
+		if assert.Len(t, outboxRepo.payloads, 1) {
+			assert.Contains(t, outboxRepo.payloads[0], `"event_type":"capture"`)
+		}
+	})
+
+	for _, status := range []OrderStatus{OrderStatusPaymentPending, OrderStatusCapturePending, OrderStatusPaid, OrderStatusCancelled} {
+		t.Run(string(status), func(t *testing.T) {
+			service, orderRepo, outboxRepo := newTestOrderService(status)
+
+			_, err := service.CaptureOrder(context.Background(), "order1")
+			assert.ErrorIs(t, err, ErrCannotCapture)
+			assert.Equal(t, status, orderRepo.orders["order1"].Status)
+			assert.Empty(t, outboxRepo.payloads)
+		})
+	}
+}
+
+func TestOrderService_ProcessCaptureEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     OrderStatus
+		success    bool
+		wantStatus OrderStatus
+		wantErr    error
+	}{
+		{name: "captured", status: OrderStatusCapturePending, success: true, wantStatus: OrderStatusPaid},
+		{name: "capture failed", status: OrderStatusCapturePending, success: false, wantStatus: OrderStatusCancelled},
+		{name: "duplicate success", status: OrderStatusPaid, success: true, wantStatus: OrderStatusPaid},
+		{name: "duplicate failure", status: OrderStatusCancelled, success: false, wantStatus: OrderStatusCancelled},
+		{name: "late failure on paid order", status: OrderStatusPaid, success: false, wantStatus: OrderStatusPaid, wantErr: ErrInvalidTransition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, orderRepo, _ := newTestOrderService(tt.status)
+
+			err := service.ProcessCaptureEvent(context.Background(), "order1", tt.success, StatusChange{Source: StatusSourcePaymentEvent})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantStatus, orderRepo.orders["order1"].Status)
+		})
+	}
+}
+
+func TestOrderService_ProcessReleaseEvent(t *testing.T) {
+	tests := []struct {
+		status     OrderStatus
+		wantStatus OrderStatus
+	}{
+		{status: OrderStatusAuthorized, wantStatus: OrderStatusCancelled},
+		{status: OrderStatusCapturePending, wantStatus: OrderStatusCapturePending},
+		{status: OrderStatusCancelled, wantStatus: OrderStatusCancelled},
+		{status: OrderStatusPaid, wantStatus: OrderStatusPaid},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.status), func(t *testing.T) {
+			service, orderRepo, _ := newTestOrderService(tt.status)
+
+			change := StatusChange{Source: StatusSourcePaymentEvent, Reason: "authorization expired"}
+			assert.NoError(t, service.ProcessReleaseEvent(context.Background(), "order1", change))
+			assert.Equal(t, tt.wantStatus, orderRepo.orders["order1"].Status)
+		})
+	}
+}
+
+func TestOrderService_CancelOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     OrderStatus
+		wantStatus OrderStatus
+		wantErr    error
+		wantRefund bool
+	}{
+		{name: "new", status: OrderStatusNew, wantStatus: OrderStatusCancelled},
+		{name: "payment pending", status: OrderStatusPaymentPending, wantStatus: OrderStatusCancelled},
+		{name: "authorized", status: OrderStatusAuthorized, wantStatus: OrderStatusCancelled, wantRefund: true},
+		{name: "capture pending", status: OrderStatusCapturePending, wantStatus: OrderStatusCapturePending, wantErr: ErrCannotCancel},
+		{name: "paid", status: OrderStatusPaid, wantStatus: OrderStatusRefundPending, wantRefund: true},
+		{name: "cancelled", status: OrderStatusCancelled, wantStatus: OrderStatusCancelled, wantErr: ErrCannotCancel},
+		{name: "refund pending", status: OrderStatusRefundPending, wantStatus: OrderStatusRefundPending, wantErr: ErrCannotCancel},
+		{name: "refunded", status: OrderStatusRefunded, wantStatus: OrderStatusRefunded, wantErr: ErrCannotCancel},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, orderRepo, outboxRepo := newTestOrderService(tt.status)
+
+			_, err := service.CancelOrder(context.Background(), "order1")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantStatus, orderRepo.orders["order1"].Status)
+			assert.Equal(t, tt.wantRefund, len(outboxRepo.payloads) == 1)
+		})
+	}
+}
+
+func TestOrderService_MarkPaymentPending(t *testing.T) {
+	for _, status := range []OrderStatus{OrderStatusNew, OrderStatusPaid, OrderStatusCancelled} {
+		t.Run(string(status), func(t *testing.T) {
+			service, orderRepo, _ := newTestOrderService(status)
+
+			assert.NoError(t, service.MarkPaymentPending(context.Background(), "order1"))
+
+			want := status
+			if status == OrderStatusNew {
+				want = OrderStatusPaymentPending
+			}
+			assert.Equal(t, want, orderRepo.orders["order1"].Status)
+		})
+	}
+}
+
+func TestOrderService_GetOrderHistory(t *testing.T) {
+	service, _, _ := newTestOrderService(OrderStatusPaymentPending)
+
+	change := StatusChange{Source: StatusSourcePaymentEvent, Reason: "insufficient funds"}
+	assert.NoError(t, service.ProcessPaymentEvent(context.Background(), "order1", false, change))
+
+	history, err := service.GetOrderHistory(context.Background(), "order1")
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, OrderStatusPaymentPending, history[0].OldStatus)
+	assert.Equal(t, OrderStatusCancelled, history[0].NewStatus)
+	assert.Equal(t, "insufficient funds", history[0].Reason)
+	assert.Equal(t, StatusSourcePaymentEvent, history[0].Source)
+
+	_, err = service.GetOrderHistory(context.Background(), "missing")
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+}
+
+func TestOrderService_ListOrders(t *testing.T) {
+	createdAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	orderRepo := newFakeOrderRepository(
+		&Order{ID: "a", UserID: "user1", CreatedAt: createdAt},
+		&Order{ID: "b", UserID: "user1", CreatedAt: createdAt},
+		&Order{ID: "c", UserID: "user1", CreatedAt: createdAt},
+	)
+	service := NewOrderService(orderRepo, &fakeOutboxRepository{}, nil, nil)
+
+	t.Run("sets next cursor when there are more orders", func(t *testing.T) {
+		page, err := service.ListOrders(context.Background(), OrderFilter{UserID: "user1", Limit: 2})
+		assert.NoError(t, err)
+		assert.Len(t, page.Orders, 2)
+
+		cursor, err := DecodeOrderCursor(page.NextCursor)
+		assert.NoError(t, err)
+		assert.Equal(t, page.Orders[1].ID, cursor.ID)
+		assert.True(t, createdAt.Equal(cursor.CreatedAt))
+	})
+
+	t.Run("last page has no cursor", func(t *testing.T) {
+		page, err := service.ListOrders(context.Background(), OrderFilter{UserID: "user1", Limit: 3})
+		assert.NoError(t, err)
+		assert.Len(t, page.Orders, 3)
+		assert.Empty(t, page.NextCursor)
+	})
+
+	t.Run("rejects unknown status", func(t *testing.T) {
+		_, err := service.ListOrders(context.Background(), OrderFilter{UserID: "user1", Status: "SHIPPED"})
+		assert.ErrorIs(t, err, ErrInvalidOrderFilter)
+	})
+
+	t.Run("rejects empty date range", func(t *testing.T) {
+		_, err := service.ListOrders(context.Background(), OrderFilter{
+			UserID:      "user1",
+			CreatedFrom: createdAt,
+			CreatedTo:   createdAt,
+		})
+		assert.ErrorIs(t, err, ErrInvalidOrderFilter)
+	})
+}
+
+func TestDecodeOrderCursor(t *testing.T) {
+	_, err := DecodeOrderCursor("not a cursor")
+	assert.ErrorIs(t, err, ErrInvalidOrderFilter)
+}
@@ -0,0 +1,80 @@
+package internal
+
+import "fmt"
+
+// orderTransitions lists every status an order may move to from a given
+// status. Anything not listed here is rejected by the service and, through
+// the conditional update in the repository, by the database.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusNew: {
+		OrderStatusPaymentPending,
+		OrderStatusAuthorized,
+		OrderStatusPaid,
+		OrderStatusCancelled,
+	},
+	OrderStatusPaymentPending: {
+		OrderStatusAuthorized,
+		OrderStatusPaid,
+		OrderStatusCancelled,
+	},
+	// An authorized order can be cancelled until the capture is requested;
+	// it is also cancelled when its hold expires.
+	OrderStatusAuthorized: {
+		OrderStatusCapturePending,
+		OrderStatusCancelled,
+	},
+	// A capture fails when the hold has expired in the meantime.
+	OrderStatusCapturePending: {
+		OrderStatusPaid,
+		OrderStatusCancelled,
+	},
+	// A paid order is refunded directly when the whole amount is given back
+	// through the payment-service refund API.
+	OrderStatusPaid: {
+		OrderStatusRefundPending,
+		OrderStatusRefunded,
+	},
+	// A payment that succeeds after the user cancelled the order has to be
+	// given back.
+	OrderStatusCancelled: {
+		OrderStatusRefundPending,
+	},
+	OrderStatusRefundPending: {
+		OrderStatusRefunded,
+		OrderStatusPaid,
+	},
+	OrderStatusRefunded: {},
+}
+
+// CanTransitionTo reports whether an order in status s may move to next.
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// InvalidTransitionError is returned when an order is asked to move to a
+// status that is not reachable from its current one.
+type InvalidTransitionError struct {
+	OrderID string
+	From    OrderStatus
+	To      OrderStatus
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("order %s: invalid status transition %s -> %s", e.OrderID, e.From, e.To)
+}
+
+func (e *InvalidTransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
+
+func checkTransition(orderID string, from, to OrderStatus) error {
+	if !from.CanTransitionTo(to) {
+		return &InvalidTransitionError{OrderID: orderID, From: from, To: to}
+	}
+	return nil
+}
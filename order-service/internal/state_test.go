@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderStatus_CanTransitionTo(t *testing.T) {
+	statuses := []OrderStatus{
+		OrderStatusNew,
+		OrderStatusPaymentPending,
+		OrderStatusAuthorized,
+		OrderStatusCapturePending,
+		OrderStatusPaid,
+		OrderStatusCancelled,
+		OrderStatusRefundPending,
+		OrderStatusRefunded,
+	}
+
+	allowed := map[OrderStatus]map[OrderStatus]bool{
+		OrderStatusNew: {
+			OrderStatusPaymentPending: true,
+			OrderStatusAuthorized:     true,
+			OrderStatusPaid:           true,
+			OrderStatusCancelled:      true,
+		},
+		OrderStatusPaymentPending: {
+			OrderStatusAuthorized: true,
+			OrderStatusPaid:       true,
+			OrderStatusCancelled:  true,
+		},
+		OrderStatusAuthorized: {
+			OrderStatusCapturePending: true,
+			OrderStatusCancelled:      true,
+		},
+		OrderStatusCapturePending: {
+			OrderStatusPaid:      true,
+			OrderStatusCancelled: true,
+		},
+		OrderStatusPaid: {
+			OrderStatusRefundPending: true,
+			OrderStatusRefunded:      true,
+		},
+		OrderStatusCancelled: {
+			OrderStatusRefundPending: true,
+		},
+		OrderStatusRefundPending: {
+			OrderStatusRefunded: true,
+			OrderStatusPaid:     true,
+		},
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := allowed[from][to]
+			t.Run(string(from)+"->"+string(to), func(t *testing.T) {
+				assert.Equal(t, want, from.CanTransitionTo(to))
+
+				err := checkTransition("order1", from, to)
+				if want {
+					assert.NoError(t, err)
+					return
+				}
+
+				assert.ErrorIs(t, err, ErrInvalidTransition)
+				var transitionErr *InvalidTransitionError
+				assert.True(t, errors.As(err, &transitionErr))
+				assert.Equal(t, from, transitionErr.From)
+				assert.Equal(t, to, transitionErr.To)
+			})
+		}
+	}
+}
+
+func TestOrderStatus_UnknownStatus(t *testing.T) {
+	assert.False(t, OrderStatus("UNKNOWN").CanTransitionTo(OrderStatusPaid))
+	assert.False(t, OrderStatusNew.CanTransitionTo(OrderStatus("UNKNOWN")))
+}
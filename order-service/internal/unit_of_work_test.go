@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSQLMockOrderService(t *testing.T) (OrderService, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	service := NewOrderService(NewOrderRepository(db), NewOutboxRepository(db), NewUnitOfWork(db), nil)
+	return service, mock
+}
+
+var testItems = []OrderItem{{SKU: "sku-1", Name: "item", Quantity: 2, UnitPrice: Money{Amount: 500, Currency: "RUB"}}}
+
+func TestOrderService_CreateOrder_Atomic(t *testing.T) {
+	t.Run("commits order and outbox message together", func(t *testing.T) {
+		service, mock := newSQLMockOrderService(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO order_status_history").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO order_items").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO outbox_messages").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		order, err := service.CreateOrder(context.Background(), "user1", "test", testItems, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, Money{Amount: 1000, Currency: "RUB"}, order.Amount)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rolls back when the order insert fails", func(t *testing.T) {
+		service, mock := newSQLMockOrderService(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO orders").WillReturnError(sql.ErrConnDone)
+		mock.ExpectRollback()
+
+		_, err := service.CreateOrder(context.Background(), "user1", "test", testItems, nil)
+		assert.ErrorIs(t, err, sql.ErrConnDone)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rolls back the order when the outbox insert fails", func(t *testing.T) {
+		service, mock := newSQLMockOrderService(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO order_status_history").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO order_items").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO outbox_messages").WillReturnError(sql.ErrConnDone)
+		mock.ExpectRollback()
+
+		_, err := service.CreateOrder(context.Background(), "user1", "test", testItems, nil)
+		assert.ErrorIs(t, err, sql.ErrConnDone)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("reports a failed commit", func(t *testing.T) {
+		service, mock := newSQLMockOrderService(t)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO orders").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO order_status_history").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO order_items").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("INSERT INTO outbox_messages").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit().WillReturnError(sql.ErrTxDone)
+
+		_, err := service.CreateOrder(context.Background(), "user1", "test", testItems, nil)
+		assert.ErrorIs(t, err, sql.ErrTxDone)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestOrderService_CancelPaidOrder_Atomic(t *testing.T) {
+	service, mock := newSQLMockOrderService(t)
+
+	mock.ExpectQuery("SELECT id, user_id, amount, currency, description, status, created_at FROM orders").
+		WithArgs("order1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "amount", "currency", "description", "status", "created_at"}).
+			AddRow("order1", "user1", "10.00", "RUB", "test", "PAID", time.Now()))
+	mock.ExpectQuery("SELECT (.+) FROM order_items").
+		WithArgs("order1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "sku", "name", "quantity", "unit_price"}))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE orders SET status").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO order_status_history").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO outbox_messages").WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	_, err := service.CancelOrder(context.Background(), "order1")
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOrderService_ReleaseAfterCancel_Atomic(t *testing.T) {
+	service, mock := newSQLMockOrderService(t)
+
+	mock.ExpectQuery("SELECT id, user_id, amount, currency, description, status, created_at FROM orders").
+		WithArgs("order1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "amount", "currency", "description", "status", "created_at"}).
+			AddRow("order1", "user1", "10.00", "RUB", "test", "CANCELLED", time.Now()))
+	mock.ExpectQuery("SELECT (.+) FROM order_items").
+		WithArgs("order1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "sku", "name", "quantity", "unit_price"}))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO outbox_messages").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err := service.ProcessAuthorizationEvent(context.Background(), "order1", true, StatusChange{Source: StatusSourcePaymentEvent})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOrderService_CaptureAfterAuthorization_Atomic(t *testing.T) {
+	service, mock := newSQLMockOrderService(t)
+
+	mock.ExpectQuery("SELECT id, user_id, amount, currency, description, status, created_at FROM orders").
+		WithArgs("order1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "amount", "currency", "description", "status", "created_at"}).
+			AddRow("order1", "user1", "10.00", "RUB", "test", "PAYMENT_PENDING", time.Now()))
+	mock.ExpectQuery("SELECT (.+) FROM order_items").
+		WithArgs("order1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "sku", "name", "quantity", "unit_price"}))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE orders SET status").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO order_status_history").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE orders SET status").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO order_status_history").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO outbox_messages").WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	err := service.ProcessAuthorizationEvent(context.Background(), "order1", true, StatusChange{Source: StatusSourcePaymentEvent})
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
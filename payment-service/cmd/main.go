@@ -6,9 +6,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/AnechkaShv/KPO_BHW2/payment-service/internal"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	"github.com/rs/cors"
@@ -39,13 +42,130 @@ func main() {
 			user_id TEXT NOT NULL UNIQUE,
 			balance DECIMAL(10, 2) NOT NULL
 		);
+
+		ALTER TABLE accounts ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'RUB';
+		ALTER TABLE accounts ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'ACTIVE';
+		ALTER TABLE accounts ADD COLUMN IF NOT EXISTS status_reason TEXT;
+		ALTER TABLE accounts ADD COLUMN IF NOT EXISTS status_changed_at TIMESTAMP WITH TIME ZONE;
 		
+		CREATE TABLE IF NOT EXISTS ledger_entries (
+			id TEXT PRIMARY KEY,
+			transaction_id TEXT NOT NULL,
+			account_id TEXT NOT NULL,
+			direction TEXT NOT NULL CHECK (direction IN ('DEBIT', 'CREDIT')),
+			amount DECIMAL(10, 2) NOT NULL CHECK (amount > 0),
+			currency TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			reference_id TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_ledger_entries_account_created ON ledger_entries(account_id, created_at, id);
+		CREATE INDEX IF NOT EXISTS idx_ledger_entries_transaction ON ledger_entries(transaction_id);
+
+		-- Balances that existed before the ledger get an opening entry, so that
+		-- every balance equals the sum of its entries.
+		WITH opening AS (
+			SELECT a.id, a.balance, a.currency, gen_random_uuid()::text AS transaction_id
+			FROM accounts a
+			WHERE a.balance > 0
+				AND NOT EXISTS (SELECT 1 FROM ledger_entries e WHERE e.account_id = a.id)
+		)
+		INSERT INTO ledger_entries (id, transaction_id, account_id, direction, amount, currency, operation, reference_id)
+		SELECT gen_random_uuid()::text, transaction_id, id, 'CREDIT', balance, currency, 'OPENING_BALANCE', id FROM opening
+		UNION ALL
+		SELECT gen_random_uuid()::text, transaction_id, 'system:external', 'DEBIT', balance, currency, 'OPENING_BALANCE', id FROM opening;
+
 		CREATE TABLE IF NOT EXISTS inbox_messages (
 			id TEXT PRIMARY KEY,
 			order_id TEXT NOT NULL,
 			payload TEXT NOT NULL,
 			processed BOOLEAN NOT NULL DEFAULT false
 		);
+
+		ALTER TABLE inbox_messages ADD COLUMN IF NOT EXISTS event_type TEXT NOT NULL DEFAULT 'payment';
+		ALTER TABLE inbox_messages ADD COLUMN IF NOT EXISTS received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+		ALTER TABLE inbox_messages ADD COLUMN IF NOT EXISTS processed_at TIMESTAMP WITH TIME ZONE;
+		ALTER TABLE inbox_messages ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE inbox_messages ADD COLUMN IF NOT EXISTS last_error TEXT;
+		ALTER TABLE inbox_messages ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+		CREATE INDEX IF NOT EXISTS idx_inbox_unprocessed ON inbox_messages(order_id, received_at) WHERE processed = false;
+
+		CREATE TABLE IF NOT EXISTS outbox_messages (
+			id TEXT PRIMARY KEY,
+			order_id TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			processed BOOLEAN NOT NULL DEFAULT false,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			locked_by TEXT,
+			locked_until TIMESTAMP WITH TIME ZONE,
+			status TEXT NOT NULL DEFAULT 'PENDING',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox_messages(next_attempt_at) WHERE status = 'PENDING';
+		CREATE INDEX IF NOT EXISTS idx_outbox_failed ON outbox_messages(created_at) WHERE status = 'FAILED';
+
+		CREATE TABLE IF NOT EXISTS refunds (
+			id TEXT PRIMARY KEY,
+			order_id TEXT NOT NULL,
+			account_id TEXT NOT NULL REFERENCES accounts(id),
+			amount DECIMAL(10,2) NOT NULL CHECK (amount > 0),
+			currency TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_refunds_order ON refunds(order_id);
+
+		CREATE TABLE IF NOT EXISTS transfers (
+			id TEXT PRIMARY KEY,
+			from_account_id TEXT NOT NULL REFERENCES accounts(id),
+			to_account_id TEXT NOT NULL REFERENCES accounts(id),
+			amount DECIMAL(10,2) NOT NULL CHECK (amount > 0),
+			currency TEXT NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			CHECK (from_account_id <> to_account_id)
+		);
+
+		CREATE TABLE IF NOT EXISTS holds (
+			id TEXT PRIMARY KEY,
+			order_id TEXT NOT NULL UNIQUE,
+			account_id TEXT NOT NULL REFERENCES accounts(id),
+			amount DECIMAL(10,2) NOT NULL CHECK (amount > 0),
+			currency TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'ACTIVE',
+			expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_holds_active ON holds(account_id) WHERE status = 'ACTIVE';
+		CREATE INDEX IF NOT EXISTS idx_holds_expiry ON holds(expires_at) WHERE status = 'ACTIVE';
+
+		ALTER TABLE holds ADD COLUMN IF NOT EXISTS order_amount DECIMAL(10,2);
+		ALTER TABLE holds ADD COLUMN IF NOT EXISTS order_currency TEXT;
+		ALTER TABLE holds ADD COLUMN IF NOT EXISTS exchange_rate NUMERIC(20,10);
+
+		CREATE TABLE IF NOT EXISTS exchange_rates (
+			base_currency TEXT NOT NULL,
+			quote_currency TEXT NOT NULL,
+			rate NUMERIC(20,10) NOT NULL CHECK (rate > 0),
+			updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (base_currency, quote_currency)
+		);
+
+		CREATE TABLE IF NOT EXISTS account_limits (
+			account_id TEXT PRIMARY KEY REFERENCES accounts(id),
+			per_transaction DECIMAL(10,2) CHECK (per_transaction > 0),
+			daily DECIMAL(10,2) CHECK (daily > 0),
+			monthly DECIMAL(10,2) CHECK (monthly > 0),
+			updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_holds_account_created ON holds(account_id, created_at);
 	`); err != nil {
 		log.Fatal("Failed to create tables:", err)
 	}
@@ -80,17 +200,48 @@ func main() {
 
 	accountRepo := internal.NewAccountRepository(db)
 	inboxRepo := internal.NewInboxRepository(db)
-	paymentService := internal.NewPaymentService(db, accountRepo, inboxRepo, paymentResponseQueue)
+	ledgerRepo := internal.NewLedgerRepository(db)
+	paymentService := internal.NewPaymentService(db, accountRepo, inboxRepo, ledgerRepo,
+		getEnvDuration("HOLD_TTL", 24*time.Hour),
+		internal.RetryPolicy{
+			MaxAttempts: getEnvInt("INBOX_MAX_ATTEMPTS", 5),
+			BaseDelay:   getEnvDuration("INBOX_RETRY_BASE_DELAY", time.Second),
+			MaxDelay:    getEnvDuration("INBOX_RETRY_MAX_DELAY", time.Minute),
+		})
 	paymentHandler := internal.NewPaymentHandler(paymentService)
+	outboxRepo := internal.NewOutboxRepository(db)
+	outboxHandler := internal.NewOutboxHandler(internal.NewOutboxService(outboxRepo))
+	parkingHandler := internal.NewParkingHandler(paymentRequestQueue)
+	rateHandler := internal.NewExchangeRateHandler(internal.NewExchangeRateService(internal.NewExchangeRateRepository(db)))
 
 	r := mux.NewRouter()
 
 	r.HandleFunc("/api/payments/create-account", paymentHandler.CreateAccount).Methods("POST")
 	r.HandleFunc("/api/payments/get-account", paymentHandler.GetAccount).Methods("GET")
 	r.HandleFunc("/api/payments/deposit", paymentHandler.Deposit).Methods("POST")
+	r.HandleFunc("/api/payments/withdraw", paymentHandler.Withdraw).Methods("POST")
+	r.HandleFunc("/api/payments/transfer", paymentHandler.Transfer).Methods("POST")
 	r.HandleFunc("/api/payments/process", paymentHandler.ProcessPayment).Methods("POST")
+	r.HandleFunc("/api/payments/transactions", paymentHandler.ListTransactions).Methods("GET")
+	r.HandleFunc("/api/payments/refund", paymentHandler.Refund).Methods("POST")
+	r.HandleFunc("/api/payments/limits", paymentHandler.SetLimits).Methods("PUT")
+
+	r.HandleFunc("/api/admin/outbox/failed", outboxHandler.ListFailedMessages).Methods("GET")
+	r.HandleFunc("/api/admin/outbox/{id}/replay", outboxHandler.ReplayMessage).Methods("POST")
+	r.HandleFunc("/api/admin/outbox/{id}/discard", outboxHandler.DiscardMessage).Methods("POST")
+	r.HandleFunc("/api/admin/parked", parkingHandler.ListParkedMessages).Methods("GET")
+	r.HandleFunc("/api/admin/parked/redrive", parkingHandler.RedriveParkedMessages).Methods("POST")
+	r.HandleFunc("/api/admin/rates", rateHandler.ListRates).Methods("GET")
+	r.HandleFunc("/api/admin/rates", rateHandler.SetRate).Methods("PUT")
+	r.HandleFunc("/api/admin/accounts/{user_id}/freeze", paymentHandler.FreezeAccount).Methods("POST")
+	r.HandleFunc("/api/admin/accounts/{user_id}/unfreeze", paymentHandler.UnfreezeAccount).Methods("POST")
+	r.HandleFunc("/api/admin/accounts/{user_id}/close", paymentHandler.CloseAccount).Methods("POST")
 
 	r.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		if state := rabbitMQ.State(); state != internal.ConnectionStateConnected {
+			http.Error(w, "rabbitmq: "+strings.ToLower(string(state)), http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	}).Methods("GET")
@@ -103,7 +254,33 @@ func main() {
 	})
 
 	ctx := context.Background()
-	go processPaymentRequests(ctx, paymentRequestQueue, paymentService)
+	consumerConfig := internal.ConsumerConfig{
+		Prefetch: getEnvInt("CONSUMER_PREFETCH", 10),
+		Retry: internal.RetryPolicy{
+			MaxAttempts: getEnvInt("CONSUMER_MAX_ATTEMPTS", 5),
+			BaseDelay:   getEnvDuration("CONSUMER_RETRY_BASE_DELAY", 5*time.Second),
+			MaxDelay:    getEnvDuration("CONSUMER_RETRY_MAX_DELAY", 5*time.Minute),
+		},
+	}
+	go processPaymentRequests(ctx, paymentRequestQueue, paymentService, consumerConfig)
+	go processInboxMessages(ctx, paymentService,
+		getEnvInt("INBOX_BATCH_SIZE", 10),
+		getEnvDuration("INBOX_POLL_INTERVAL", time.Second))
+	go expireHolds(ctx, paymentService,
+		getEnvInt("HOLD_EXPIRY_BATCH_SIZE", 100),
+		getEnvDuration("HOLD_EXPIRY_INTERVAL", time.Minute))
+
+	relayConfig := outboxRelayConfig{
+		batchSize: getEnvInt("OUTBOX_BATCH_SIZE", 100),
+		interval:  getEnvDuration("OUTBOX_POLL_INTERVAL", time.Second),
+		lease:     getEnvDuration("OUTBOX_LEASE", 30*time.Second),
+		retry: internal.RetryPolicy{
+			MaxAttempts: getEnvInt("OUTBOX_MAX_ATTEMPTS", 10),
+			BaseDelay:   getEnvDuration("OUTBOX_RETRY_BASE_DELAY", 5*time.Second),
+			MaxDelay:    getEnvDuration("OUTBOX_RETRY_MAX_DELAY", 10*time.Minute),
+		},
+	}
+	go processOutboxMessages(ctx, outboxRepo, paymentResponseQueue, relayConfig)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -114,22 +291,166 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+port, corsHandler.Handler(r)))
 }
 
-func processPaymentRequests(ctx context.Context, queue *internal.RabbitMQPaymentQueue, paymentService internal.PaymentService) {
+// processPaymentRequests stores the received requests in the inbox. A
+// request is acknowledged only after it has been committed to the inbox.
+func processPaymentRequests(ctx context.Context, queue *internal.RabbitMQPaymentQueue, paymentService internal.PaymentService, config internal.ConsumerConfig) {
 	log.Println("Starting payment request processor...")
 
-	err := queue.SubscribeToPaymentUpdates(ctx, func(orderID, userID string, amount float64) {
-		log.Printf("Processing payment request: OrderID=%s, UserID=%s, Amount=%.2f", orderID, userID, amount)
+	err := queue.SubscribeToPaymentUpdates(ctx, config, func(msg *internal.InboxMessage) error {
+		log.Printf("Received %s request %s for order %s", msg.EventType, msg.ID, msg.OrderID)
 
-		result, err := paymentService.ProcessOrderPayment(ctx, orderID, userID, amount)
-		if err != nil {
-			log.Printf("Payment processing failed: %v", err)
-			return
+		if err := paymentService.ReceivePaymentRequest(ctx, msg); err != nil {
+			log.Printf("Failed to store %s request %s: %v", msg.EventType, msg.ID, err)
+			return err
 		}
-
-		log.Printf("Payment processed: OrderID=%s, Success=%v", orderID, result.Success)
+		return nil
 	})
 
 	if err != nil {
 		log.Fatalf("Failed to subscribe to payment requests: %v", err)
 	}
 }
+
+// processInboxMessages applies the requests stored in the inbox. Several
+// instances can run it at once: every message is claimed with SKIP LOCKED
+// and applied in its own transaction.
+func processInboxMessages(ctx context.Context, paymentService internal.PaymentService, batchSize int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				processed, err := paymentService.ProcessInboxMessages(ctx, batchSize)
+				if err != nil {
+					log.Printf("Failed to process inbox messages: %v", err)
+					break
+				}
+				if processed < batchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+type outboxRelayConfig struct {
+	batchSize int
+	interval  time.Duration
+	lease     time.Duration
+	retry     internal.RetryPolicy
+}
+
+// processOutboxMessages publishes payment results from the outbox to
+// payment.response. Batches are leased with SELECT ... FOR UPDATE SKIP LOCKED,
+// so several replicas can run the relay at the same time.
+func processOutboxMessages(ctx context.Context, outboxRepo internal.OutboxRepository, queue *internal.RabbitMQPaymentQueue, cfg outboxRelayConfig) {
+	owner := relayOwnerID()
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	log.Printf("Outbox relay %s started: batch size %d, interval %s, lease %s",
+		owner, cfg.batchSize, cfg.interval, cfg.lease)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				if relayOutboxBatch(ctx, outboxRepo, queue, owner, cfg) < cfg.batchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+func relayOutboxBatch(ctx context.Context, outboxRepo internal.OutboxRepository, queue *internal.RabbitMQPaymentQueue, owner string, cfg outboxRelayConfig) int {
+	leaseDeadline := time.Now().Add(cfg.lease)
+
+	messages, err := outboxRepo.ClaimUnprocessedMessages(ctx, owner, cfg.batchSize, cfg.lease)
+	if err != nil {
+		log.Printf("Failed to claim unprocessed messages: %v", err)
+		return 0
+	}
+
+	for _, msg := range messages {
+		if time.Now().After(leaseDeadline) {
+			log.Printf("Outbox lease expired, releasing the rest of the batch")
+			return 0
+		}
+
+		if err := queue.PublishPaymentRequest(ctx, msg.ID, []byte(msg.Payload)); err != nil {
+			attempts := msg.Attempts + 1
+			log.Printf("Failed to publish message %s (attempt %d/%d): %v", msg.ID, attempts, cfg.retry.MaxAttempts, err)
+
+			nextAttemptAt := time.Now().Add(cfg.retry.NextDelay(attempts))
+			if err := outboxRepo.RecordPublishFailure(ctx, msg.ID, owner, err.Error(), nextAttemptAt, cfg.retry.MaxAttempts); err != nil {
+				log.Printf("Failed to record publish failure: %v", err)
+			}
+			continue
+		}
+
+		if err := outboxRepo.MarkMessageAsProcessed(ctx, msg.ID, owner); err != nil {
+			log.Printf("Failed to mark message as processed: %v", err)
+		}
+	}
+
+	return len(messages)
+}
+
+func relayOwnerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "payment-service"
+	}
+	return hostname + "-" + uuid.New().String()
+}
+
+// expireHolds releases the holds that were neither captured nor released
+// before their TTL ran out.
+func expireHolds(ctx context.Context, paymentService internal.PaymentService, batchSize int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				expired, err := paymentService.ExpireHolds(ctx, batchSize)
+				if err != nil {
+					log.Printf("Failed to expire holds: %v", err)
+					break
+				}
+				if expired > 0 {
+					log.Printf("Expired %d holds", expired)
+				}
+				if expired < batchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
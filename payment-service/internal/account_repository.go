@@ -10,76 +10,112 @@ import (
 )
 
 type AccountRepository interface {
-	CreateAccount(ctx context.Context, userID string) (*Account, error)
+	CreateAccount(ctx context.Context, userID, currency string) (*Account, error)
 	GetAccountByUserID(ctx context.Context, userID string) (*Account, error)
-	Deposit(ctx context.Context, userID string, amount float64) error
-	Withdraw(ctx context.Context, userID string, amount float64) error
+	LockAccountByUserID(ctx context.Context, userID string) (*Account, error)
+	LockAccountByID(ctx context.Context, id string) (*Account, error)
+	UpdateAccountStatus(ctx context.Context, id string, status AccountStatus, reason string) error
 }
 
 type accountRepository struct {
-	db *sql.DB
+	db DBTX
 }
 
 func NewAccountRepository(db *sql.DB) AccountRepository {
 	return &accountRepository{db: db}
 }
 
-func (r *accountRepository) CreateAccount(ctx context.Context, userID string) (*Account, error) {
+// NewAccountRepositoryTx returns a repository whose operations all run inside
+// tx. Committing or rolling back tx is up to the caller.
+func NewAccountRepositoryTx(tx *sql.Tx) AccountRepository {
+	return &accountRepository{db: tx}
+}
+
+// accountColumns selects an account together with its available balance,
+// which is the ledger balance less the holds that still reserve funds.
+const accountColumns = `id, user_id, balance, currency,
+	balance - COALESCE((SELECT SUM(h.amount) FROM holds h WHERE h.account_id = accounts.id AND h.status = 'ACTIVE' AND h.expires_at > NOW()), 0),
+	status, COALESCE(status_reason, '')`
+
+func (r *accountRepository) CreateAccount(ctx context.Context, userID, currency string) (*Account, error) {
 	accountID := uuid.New().String()
-	var account Account
-	err := r.db.QueryRowContext(ctx,
-		"INSERT INTO accounts (id, user_id, balance) VALUES ($1, $2, $3) RETURNING id, user_id, balance",
-		accountID, userID, 0).Scan(&account.ID, &account.UserID, &account.Balance)
+	account, err := scanAccount(r.db.QueryRowContext(ctx,
+		"INSERT INTO accounts (id, user_id, balance, currency) VALUES ($1, $2, $3, $4) ON CONFLICT (user_id) DO NOTHING RETURNING "+accountColumns,
+		accountID, userID, 0, currency))
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAccountExists
+		}
 		return nil, fmt.Errorf("failed to create account: %w", err)
 	}
-	return &account, nil
+	return account, nil
 }
 
 func (r *accountRepository) GetAccountByUserID(ctx context.Context, userID string) (*Account, error) {
-	var account Account
+	return r.getAccount(ctx, "user_id", userID)
+}
+
+// LockAccountByUserID locks the account with SELECT ... FOR UPDATE, so that
+// its balance cannot change until the surrounding transaction ends.
+func (r *accountRepository) LockAccountByUserID(ctx context.Context, userID string) (*Account, error) {
+	return r.lockAccount(ctx, "user_id", userID)
+}
+
+func (r *accountRepository) LockAccountByID(ctx context.Context, id string) (*Account, error) {
+	return r.lockAccount(ctx, "id", id)
+}
+
+// lockAccount reads the account once the lock is taken, in a statement of
+// its own: a statement that had to wait for the lock would still see the
+// holds as they were before it started waiting.
+func (r *accountRepository) lockAccount(ctx context.Context, column, value string) (*Account, error) {
+	var id string
 	err := r.db.QueryRowContext(ctx,
-		"SELECT id, user_id, balance FROM accounts WHERE user_id = $1", userID).
-		Scan(&account.ID, &account.UserID, &account.Balance)
+		"SELECT id FROM accounts WHERE "+column+" = $1 FOR UPDATE", value).Scan(&id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
+			return nil, ErrAccountNotFound
 		}
-		return nil, fmt.Errorf("failed to get account: %w", err)
+		return nil, fmt.Errorf("failed to lock account: %w", err)
 	}
-	return &account, nil
+	return r.getAccount(ctx, "id", id)
 }
 
-func (r *accountRepository) Deposit(ctx context.Context, userID string, amount float64) error {
-	_, err := r.db.ExecContext(ctx,
-		"UPDATE accounts SET balance = balance + $1 WHERE user_id = $2", amount, userID)
-	return err
+func (r *accountRepository) getAccount(ctx context.Context, column, value string) (*Account, error) {
+	account, err := scanAccount(r.db.QueryRowContext(ctx,
+		"SELECT "+accountColumns+" FROM accounts WHERE "+column+" = $1", value))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAccountNotFound
+		}
+		return nil, fmt.Errorf("failed to get account: %w", err)
+	}
+	return account, nil
 }
 
-func (r *accountRepository) Withdraw(ctx context.Context, userID string, amount float64) error {
-	tx, err := r.db.BeginTx(ctx, nil)
+func (r *accountRepository) UpdateAccountStatus(ctx context.Context, id string, status AccountStatus, reason string) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE accounts SET status = $1, status_reason = $2, status_changed_at = NOW() WHERE id = $3",
+		status, reason, id)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return fmt.Errorf("failed to update account status: %w", err)
 	}
-	defer tx.Rollback()
+	return nil
+}
 
-	var currentBalance float64
-	err = tx.QueryRowContext(ctx,
-		"SELECT balance FROM accounts WHERE user_id = $1 FOR UPDATE", userID).
-		Scan(&currentBalance)
+func scanAccount(row *sql.Row) (*Account, error) {
+	var account Account
+	var balance, available, currency string
+	err := row.Scan(&account.ID, &account.UserID, &balance, &currency, &available, &account.Status, &account.StatusReason)
 	if err != nil {
-		return fmt.Errorf("failed to get balance: %w", err)
+		return nil, err
 	}
 
-	if currentBalance < amount {
-		return errors.New("insufficient funds")
+	if account.Balance, err = ParseMoney(balance, currency); err != nil {
+		return nil, fmt.Errorf("failed to read balance of account %s: %w", account.ID, err)
 	}
-
-	_, err = tx.ExecContext(ctx,
-		"UPDATE accounts SET balance = balance - $1 WHERE user_id = $2", amount, userID)
-	if err != nil {
-		return fmt.Errorf("failed to update balance: %w", err)
+	if account.AvailableBalance, err = ParseMoney(available, currency); err != nil {
+		return nil, fmt.Errorf("failed to read available balance of account %s: %w", account.ID, err)
 	}
-
-	return tx.Commit()
+	return &account, nil
 }
@@ -0,0 +1,430 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	amqp "github.com/streadway/amqp"
+)
+
+type ConnectionState string
+
+const (
+	ConnectionStateConnected    ConnectionState = "CONNECTED"
+	ConnectionStateReconnecting ConnectionState = "RECONNECTING"
+	ConnectionStateClosed       ConnectionState = "CLOSED"
+)
+
+var (
+	ErrNotConnected = errors.New("rabbitmq is not connected")
+	// ErrUnroutable means the broker returned a mandatory message because no
+	// queue is bound for its routing key.
+	ErrUnroutable = errors.New("message is unroutable")
+	// ErrPublishNacked means the broker refused to take responsibility for
+	// a message.
+	ErrPublishNacked = errors.New("message was nacked by the broker")
+)
+
+// publishConfirmTimeout bounds how long a publish waits for the broker to
+// confirm the message when the context has no earlier deadline.
+const publishConfirmTimeout = 10 * time.Second
+
+// reconnectBackoff is the delay between attempts to reconnect to the broker
+// after the connection has been lost.
+var reconnectBackoff = RetryPolicy{BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// setupFunc declares what has to exist on a fresh channel, such as queues
+// and consumers. It is run again on the new channel after every reconnect.
+type setupFunc func(ch *amqp.Channel) error
+
+// RabbitMQ keeps a connection and a channel to the broker open. When either
+// of them is closed, it reconnects in the background and replays the
+// registered setup on the new channel, so consumers come back by themselves.
+// Messages are published on a separate channel in confirm mode.
+type RabbitMQ struct {
+	url string
+
+	mu        sync.RWMutex
+	conn      *amqp.Connection
+	channel   *amqp.Channel
+	publisher *confirmingPublisher
+	state     ConnectionState
+	setups    []setupFunc
+
+	done chan struct{}
+}
+
+// confirmingPublisher publishes one message at a time on a channel in
+// confirm mode and waits for the broker's answer to each of them.
+type confirmingPublisher struct {
+	mu         sync.Mutex
+	channel    *amqp.Channel
+	dispatcher *confirmDispatcher
+	nextTag    uint64
+}
+
+func newConfirmingPublisher(conn *amqp.Connection) (*confirmingPublisher, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open publishing channel: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	dispatcher := &confirmDispatcher{}
+	go dispatcher.run(ch.NotifyPublish(make(chan amqp.Confirmation, 1)), ch.NotifyReturn(make(chan amqp.Return, 1)))
+	return &confirmingPublisher{
+		channel:    ch,
+		dispatcher: dispatcher,
+		nextTag:    1,
+	}, nil
+}
+
+// confirmDispatcher reads every confirmation and return of a publishing
+// channel, also those that arrive after their publish stopped waiting, so
+// that they never block the connection. It hands the ones for the message
+// that is being waited for to its publish and drops the rest.
+type confirmDispatcher struct {
+	mu     sync.Mutex
+	waiter *confirmWaiter
+	closed bool
+}
+
+type confirmWaiter struct {
+	tag       uint64
+	messageID string
+	returned  *amqp.Return
+	result    chan error
+}
+
+// expect registers the message about to be published with the given
+// delivery tag as the one being waited for.
+func (d *confirmDispatcher) expect(tag uint64, messageID string) (*confirmWaiter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil, ErrNotConnected
+	}
+	d.waiter = &confirmWaiter{tag: tag, messageID: messageID, result: make(chan error, 1)}
+	return d.waiter, nil
+}
+
+// wait returns the broker's answer for w. The broker sends a return for an
+// unroutable mandatory message before its ack, so an acked message that was
+// returned fails with ErrUnroutable.
+func (d *confirmDispatcher) wait(ctx context.Context, w *confirmWaiter) error {
+	select {
+	case err := <-w.result:
+		return err
+	case <-ctx.Done():
+		d.forget(w)
+		return fmt.Errorf("failed to get publisher confirm: %w", ctx.Err())
+	}
+}
+
+func (d *confirmDispatcher) forget(w *confirmWaiter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.waiter == w {
+		d.waiter = nil
+	}
+}
+
+func (d *confirmDispatcher) run(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			d.returned(ret)
+		case confirm, ok := <-confirms:
+			if !ok {
+				d.close()
+				return
+			}
+		drain:
+			for returns != nil {
+				select {
+				case ret, ok := <-returns:
+					if !ok {
+						returns = nil
+						break drain
+					}
+					d.returned(ret)
+				default:
+					break drain
+				}
+			}
+			d.confirmed(confirm)
+		}
+	}
+}
+
+func (d *confirmDispatcher) returned(ret amqp.Return) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.waiter != nil && d.waiter.messageID == ret.MessageId {
+		d.waiter.returned = &ret
+	}
+}
+
+func (d *confirmDispatcher) confirmed(confirm amqp.Confirmation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w := d.waiter
+	if w == nil || w.tag != confirm.DeliveryTag {
+		// The confirmation of a message whose publish has timed out.
+		return
+	}
+	d.waiter = nil
+
+	switch {
+	case !confirm.Ack:
+		w.result <- ErrPublishNacked
+	case w.returned != nil:
+		w.result <- fmt.Errorf("%w: %d %s", ErrUnroutable, w.returned.ReplyCode, w.returned.ReplyText)
+	default:
+		w.result <- nil
+	}
+}
+
+func (d *confirmDispatcher) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	if d.waiter != nil {
+		d.waiter.result <- ErrNotConnected
+		d.waiter = nil
+	}
+}
+
+func NewRabbitMQ(url string) (*RabbitMQ, error) {
+	r := &RabbitMQ{url: url, done: make(chan struct{})}
+
+	retryDelay := 5 * time.Second
+	maxRetries := 10
+
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		err = r.connect()
+		if err == nil {
+			break
+		}
+
+		log.Printf("Attempt %d/%d: Failed to connect to RabbitMQ at %s: %v",
+			i+1, maxRetries, url, err)
+
+		if i == maxRetries-1 {
+			return nil, fmt.Errorf("failed after %d attempts: %w", maxRetries, err)
+		}
+
+		time.Sleep(retryDelay)
+	}
+
+	log.Println("Successfully connected to RabbitMQ")
+
+	go r.supervise()
+	return r, nil
+}
+
+// connect dials the broker, opens a channel, declares the exchange and runs
+// every registered setup on the channel.
+func (r *RabbitMQ) connect() error {
+	conn, err := amqp.Dial(r.url)
+	if err != nil {
+		return err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	err = ch.ExchangeDeclare(
+		"payments",
+		"direct",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to declare exchange: %w", err)
+	}
+
+	publisher, err := newConfirmingPublisher(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == ConnectionStateClosed {
+		conn.Close()
+		return ErrNotConnected
+	}
+	for _, setup := range r.setups {
+		if err := setup(ch); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	r.conn = conn
+	r.channel = ch
+	r.publisher = publisher
+	r.state = ConnectionStateConnected
+	return nil
+}
+
+// supervise waits for the connection or the channel to close and then
+// reconnects, until Close is called.
+func (r *RabbitMQ) supervise() {
+	for {
+		r.mu.RLock()
+		connClosed := r.conn.NotifyClose(make(chan *amqp.Error, 1))
+		channelClosed := r.channel.NotifyClose(make(chan *amqp.Error, 1))
+		publisherClosed := r.publisher.channel.NotifyClose(make(chan *amqp.Error, 1))
+		r.mu.RUnlock()
+
+		var reason *amqp.Error
+		select {
+		case <-r.done:
+			return
+		case reason = <-connClosed:
+		case reason = <-channelClosed:
+		case reason = <-publisherClosed:
+		}
+
+		log.Printf("RabbitMQ connection lost: %v", reason)
+		r.mu.Lock()
+		r.state = ConnectionStateReconnecting
+		r.conn.Close()
+		r.mu.Unlock()
+
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-r.done:
+				return
+			case <-time.After(reconnectDelay(attempt)):
+			}
+
+			err := r.connect()
+			if err == nil {
+				log.Printf("Reconnected to RabbitMQ after %d attempts", attempt)
+				break
+			}
+			log.Printf("Reconnect attempt %d to RabbitMQ failed: %v", attempt, err)
+		}
+	}
+}
+
+// reconnectDelay returns the backoff before the given reconnect attempt with
+// jitter, so that instances that lost the broker together do not all come
+// back at the same moment.
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectBackoff.NextDelay(attempt)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Setup runs setup on the current channel and registers it to be run again
+// on the new channel after every reconnect.
+func (r *RabbitMQ) Setup(setup func(ch *amqp.Channel) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.setups = append(r.setups, setup)
+	if r.state != ConnectionStateConnected {
+		return nil
+	}
+	return setup(r.channel)
+}
+
+// Publish publishes msg as mandatory and waits until the broker confirms it.
+// It fails when the broker nacks the message or returns it as unroutable,
+// so the caller can publish it again later.
+func (r *RabbitMQ) Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	r.mu.RLock()
+	publisher, state := r.publisher, r.state
+	r.mu.RUnlock()
+
+	if state != ConnectionStateConnected {
+		return ErrNotConnected
+	}
+
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+
+	waiter, err := publisher.dispatcher.expect(publisher.nextTag, msg.MessageId)
+	if err != nil {
+		return err
+	}
+	if err := publisher.channel.Publish(exchange, routingKey, true, false, msg); err != nil {
+		publisher.dispatcher.forget(waiter)
+		return err
+	}
+	publisher.nextTag++
+
+	ctx, cancel := context.WithTimeout(ctx, publishConfirmTimeout)
+	defer cancel()
+	return publisher.dispatcher.wait(ctx, waiter)
+}
+
+// OpenChannel opens a separate channel on the current connection. The
+// caller has to close it.
+func (r *RabbitMQ) OpenChannel() (*amqp.Channel, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.state != ConnectionStateConnected {
+		return nil, ErrNotConnected
+	}
+	return r.conn.Channel()
+}
+
+func (r *RabbitMQ) State() ConnectionState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state
+}
+
+func (r *RabbitMQ) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == ConnectionStateClosed {
+		return nil
+	}
+	r.state = ConnectionStateClosed
+	close(r.done)
+
+	// While reconnecting, the channels and the connection are already closed.
+	if err := r.publisher.channel.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return fmt.Errorf("failed to close publishing channel: %w", err)
+	}
+	if err := r.channel.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return fmt.Errorf("failed to close channel: %w", err)
+	}
+	if err := r.conn.Close(); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		return fmt.Errorf("failed to close connection: %w", err)
+	}
+	return nil
+}
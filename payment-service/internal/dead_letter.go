@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/streadway/amqp"
+)
+
+// deadLetterExchange routes the messages that could not be handled to the
+// parking queue of the queue they came from.
+const deadLetterExchange = "payments.dlx"
+
+const (
+	attemptsHeader  = "x-attempts"
+	lastErrorHeader = "x-last-error"
+)
+
+// ConsumerConfig controls how a queue is consumed. A message that fails with
+// a transient error goes through a retry queue, which holds it for the
+// backoff delay of Retry before putting it back, and is parked after
+// Retry.MaxAttempts failed deliveries.
+type ConsumerConfig struct {
+	Prefetch int
+	Retry    RetryPolicy
+}
+
+// ParkedMessage is a message that was moved to a parking queue, either
+// because it could never be handled or because it failed too many times.
+type ParkedMessage struct {
+	MessageID string    `json:"message_id"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	ParkedAt  time.Time `json:"parked_at"`
+	Body      string    `json:"body"`
+}
+
+func (q *RabbitMQPaymentQueue) parkingQueueName() string {
+	return q.queueName + ".parking"
+}
+
+func (q *RabbitMQPaymentQueue) retryQueueName(delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", q.queueName, delay)
+}
+
+// declareConsumerTopology declares the consumed queue together with its
+// parking queue and one retry queue per backoff delay. A retry queue has no
+// consumers: its messages expire after the delay and are dead-lettered back
+// to the consumed queue.
+func (q *RabbitMQPaymentQueue) declareConsumerTopology(ch *amqp.Channel, retry RetryPolicy) error {
+	err := ch.ExchangeDeclare(deadLetterExchange, "direct", true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead letter exchange: %w", err)
+	}
+
+	// The consumed queue is declared without arguments, as it always was, so
+	// that the broker accepts queues created before the parking queues
+	// existed. Failed messages are moved by settleDelivery instead of being
+	// dead-lettered by the broker.
+	if _, err := ch.QueueDeclare(q.queueName, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare queue: %w", err)
+	}
+	if err := ch.QueueBind(q.queueName, q.routingKey, q.exchangeName, false, nil); err != nil {
+		return fmt.Errorf("failed to bind queue: %w", err)
+	}
+
+	if _, err := ch.QueueDeclare(q.parkingQueueName(), true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare parking queue: %w", err)
+	}
+	if err := ch.QueueBind(q.parkingQueueName(), q.parkingQueueName(), deadLetterExchange, false, nil); err != nil {
+		return fmt.Errorf("failed to bind parking queue: %w", err)
+	}
+
+	for attempt := 1; attempt < retry.MaxAttempts; attempt++ {
+		delay := retry.NextDelay(attempt)
+		_, err := ch.QueueDeclare(q.retryQueueName(delay), true, false, false, false, amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": q.queueName,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to declare retry queue: %w", err)
+		}
+	}
+	return nil
+}
+
+// settleDelivery acknowledges msg according to the result of handling it.
+// A message that can never be handled is parked at once. After any other
+// failure the message is sent to a retry queue, or parked once it has failed
+// retry.MaxAttempts times. The original delivery is only acked after the
+// broker has confirmed its copy, and otherwise it is returned to the queue,
+// so a copy that cannot be routed is never lost.
+func (q *RabbitMQPaymentQueue) settleDelivery(ctx context.Context, msg amqp.Delivery, retry RetryPolicy, err error) {
+	if err == nil {
+		if err := msg.Ack(false); err != nil {
+			log.Printf("Failed to ack message %s: %v", msg.MessageId, err)
+		}
+		return
+	}
+
+	attempts := deliveryAttempts(msg.Headers) + 1
+	exchange, routingKey := deadLetterExchange, q.parkingQueueName()
+	if !isPermanentFailure(err) && attempts < retry.MaxAttempts {
+		exchange, routingKey = "", q.retryQueueName(retry.NextDelay(attempts))
+		log.Printf("Retrying message %s after attempt %d: %v", msg.MessageId, attempts, err)
+	} else {
+		log.Printf("Parking message %s after attempt %d: %v", msg.MessageId, attempts, err)
+	}
+
+	headers := retriedHeaders(msg.Headers)
+	headers[attemptsHeader] = int32(attempts)
+	headers[lastErrorHeader] = err.Error()
+
+	publishErr := q.rabbitMQ.Publish(ctx, exchange, routingKey, amqp.Publishing{
+		ContentType:  msg.ContentType,
+		MessageId:    msg.MessageId,
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Headers:      headers,
+		Body:         msg.Body,
+	})
+	if publishErr != nil {
+		log.Printf("Failed to move message %s, requeueing it: %v", msg.MessageId, publishErr)
+		if err := msg.Nack(false, true); err != nil {
+			log.Printf("Failed to nack message %s: %v", msg.MessageId, err)
+		}
+		return
+	}
+	if err := msg.Ack(false); err != nil {
+		log.Printf("Failed to ack message %s: %v", msg.MessageId, err)
+	}
+}
+
+// retriedHeaders copies the headers of a message that is published again,
+// leaving out the ones that describe its earlier failures.
+func retriedHeaders(headers amqp.Table) amqp.Table {
+	copied := amqp.Table{}
+	for key, value := range headers {
+		if key != attemptsHeader && key != lastErrorHeader && key != "x-death" {
+			copied[key] = value
+		}
+	}
+	return copied
+}
+
+// deliveryAttempts returns how many times a message has already failed.
+func deliveryAttempts(headers amqp.Table) int {
+	switch value := headers[attemptsHeader].(type) {
+	case int32:
+		return int(value)
+	case int64:
+		return int(value)
+	case int:
+		return value
+	default:
+		return 0
+	}
+}
+
+// ListParked returns up to limit parked messages without removing them from
+// the parking queue.
+func (q *RabbitMQPaymentQueue) ListParked(ctx context.Context, limit int) ([]*ParkedMessage, error) {
+	ch, err := q.rabbitMQ.OpenChannel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+	// Closing the channel returns every message that was got but not acked
+	// to the parking queue.
+	defer ch.Close()
+
+	var messages []*ParkedMessage
+	for len(messages) < limit {
+		msg, ok, err := ch.Get(q.parkingQueueName(), false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read parking queue: %w", err)
+		}
+		if !ok {
+			break
+		}
+		lastError, _ := msg.Headers[lastErrorHeader].(string)
+		messages = append(messages, &ParkedMessage{
+			MessageID: msg.MessageId,
+			Attempts:  deliveryAttempts(msg.Headers),
+			LastError: lastError,
+			ParkedAt:  msg.Timestamp,
+			Body:      string(msg.Body),
+		})
+	}
+	return messages, nil
+}
+
+// RedriveParked moves up to limit parked messages back to the consumed queue
+// with their attempt count reset, and returns how many were moved. A parked
+// message is only acked once the broker has confirmed its copy.
+func (q *RabbitMQPaymentQueue) RedriveParked(ctx context.Context, limit int) (int, error) {
+	ch, err := q.rabbitMQ.OpenChannel()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+
+	redriven := 0
+	for redriven < limit {
+		msg, ok, err := ch.Get(q.parkingQueueName(), false)
+		if err != nil {
+			return redriven, fmt.Errorf("failed to read parking queue: %w", err)
+		}
+		if !ok {
+			break
+		}
+
+		err = q.rabbitMQ.Publish(ctx, "", q.queueName, amqp.Publishing{
+			ContentType:  msg.ContentType,
+			MessageId:    msg.MessageId,
+			DeliveryMode: amqp.Persistent,
+			Headers:      retriedHeaders(msg.Headers),
+			Body:         msg.Body,
+		})
+		if err != nil {
+			return redriven, fmt.Errorf("failed to redrive message %s: %w", msg.MessageId, err)
+		}
+		if err := msg.Ack(false); err != nil {
+			return redriven, fmt.Errorf("failed to ack parked message %s: %w", msg.MessageId, err)
+		}
+		redriven++
+	}
+	return redriven, nil
+}
@@ -0,0 +1,43 @@
+package internal
+
+import "errors"
+
+var (
+	ErrOutboxMessageNotFound = errors.New("failed outbox message not found")
+	// ErrUnprocessableMessage means a received message is malformed, so
+	// delivering it again cannot help.
+	ErrUnprocessableMessage = errors.New("unprocessable message")
+	// ErrUnsupportedSchemaVersion means a received message was written with
+	// a schema version this service does not know.
+	ErrUnsupportedSchemaVersion = errors.New("unsupported message schema version")
+
+	ErrAccountNotFound   = errors.New("account not found")
+	ErrAccountExists     = errors.New("account already exists")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrAccountFrozen     = errors.New("account is frozen")
+	ErrAccountClosed     = errors.New("account is closed")
+	// ErrAccountStatusConflict means the account cannot move to the
+	// requested status, for example because it is already closed or a
+	// closed account would still hold money.
+	ErrAccountStatusConflict = errors.New("account status cannot be changed")
+
+	ErrInvalidMoney     = errors.New("invalid money amount")
+	ErrCurrencyMismatch = errors.New("currency mismatch")
+
+	ErrInvalidLedgerFilter = errors.New("invalid transaction filter")
+
+	ErrInvalidRefund        = errors.New("invalid refund")
+	ErrPaymentNotFound      = errors.New("payment for the order not found")
+	ErrRefundExceedsPayment = errors.New("refund exceeds the amount charged for the order")
+	// ErrRefundConflict means the refund ID was already used for a different
+	// order or amount.
+	ErrRefundConflict = errors.New("refund id was already used with different parameters")
+
+	ErrInvalidTransfer  = errors.New("invalid transfer")
+	ErrTransferConflict = errors.New("transfer id was already used with different parameters")
+
+	ErrInvalidExchangeRate = errors.New("invalid exchange rate")
+
+	ErrInvalidSpendingLimit  = errors.New("invalid spending limit")
+	ErrSpendingLimitExceeded = errors.New("spending limit exceeded")
+)
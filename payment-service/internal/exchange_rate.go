@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// maxRateDigits and maxRateDecimals are the precision and scale of the rate
+// column.
+const (
+	maxRateDigits   = 20
+	maxRateDecimals = 10
+)
+
+// ExchangeRate says how many units of Quote one unit of Base is worth. Rate
+// is a decimal string, like amounts of Money, so it never goes through
+// float64.
+type ExchangeRate struct {
+	Base      string    `json:"base" db:"base_currency"`
+	Quote     string    `json:"quote" db:"quote_currency"`
+	Rate      string    `json:"rate" db:"rate"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// NewExchangeRate validates a rate between two supported currencies.
+func NewExchangeRate(base, quote, rate string) (*ExchangeRate, error) {
+	if _, err := currencyExponent(base); err != nil {
+		return nil, fmt.Errorf("%w: base: %v", ErrInvalidExchangeRate, err)
+	}
+	if _, err := currencyExponent(quote); err != nil {
+		return nil, fmt.Errorf("%w: quote: %v", ErrInvalidExchangeRate, err)
+	}
+	if base == quote {
+		return nil, fmt.Errorf("%w: base and quote currencies must differ", ErrInvalidExchangeRate)
+	}
+
+	normalized, err := normalizeRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	return &ExchangeRate{Base: base, Quote: quote, Rate: normalized}, nil
+}
+
+// normalizeRate checks that rate is a positive decimal with at most
+// maxRateDecimals fraction digits and strips its trailing zeros.
+func normalizeRate(rate string) (string, error) {
+	whole, fraction, _ := strings.Cut(strings.TrimSpace(rate), ".")
+	fraction = strings.TrimRight(fraction, "0")
+	if whole == "" || !isDigits(whole) || !isDigits(fraction) {
+		return "", fmt.Errorf("%w: %q is not a decimal number", ErrInvalidExchangeRate, rate)
+	}
+	if len(fraction) > maxRateDecimals {
+		return "", fmt.Errorf("%w: at most %d decimal places are allowed", ErrInvalidExchangeRate, maxRateDecimals)
+	}
+
+	whole = strings.TrimLeft(whole, "0")
+	if whole == "" {
+		whole = "0"
+	}
+	if len(whole) > maxRateDigits-maxRateDecimals {
+		return "", fmt.Errorf("%w: %q is too large", ErrInvalidExchangeRate, rate)
+	}
+	if whole == "0" && fraction == "" {
+		return "", fmt.Errorf("%w: rate must be positive", ErrInvalidExchangeRate)
+	}
+	if fraction == "" {
+		return whole, nil
+	}
+	return whole + "." + fraction, nil
+}
+
+// Convert turns an amount in the base currency into the quote currency,
+// rounding half away from zero to the minor units of the quote currency.
+func (r *ExchangeRate) Convert(m Money) (Money, error) {
+	if m.Currency != r.Base {
+		return Money{}, fmt.Errorf("%w: %s rate cannot convert %s", ErrCurrencyMismatch, r.Base, m.Currency)
+	}
+
+	rate, ok := new(big.Rat).SetString(r.Rate)
+	if !ok {
+		return Money{}, fmt.Errorf("%w: %q is not a decimal number", ErrInvalidExchangeRate, r.Rate)
+	}
+
+	// amount / 10^base exponent * rate * 10^quote exponent
+	value := new(big.Rat).Mul(new(big.Rat).SetInt64(m.Amount), rate)
+	value.Mul(value, new(big.Rat).SetFrac(pow10(currencyExponents[r.Quote]), pow10(currencyExponents[r.Base])))
+
+	// Add half away from zero and truncate.
+	half := big.NewRat(1, 2)
+	if value.Sign() < 0 {
+		half.Neg(half)
+	}
+	value.Add(value, half)
+	amount := new(big.Int).Quo(value.Num(), value.Denom())
+	if !amount.IsInt64() {
+		return Money{}, fmt.Errorf("%w: amount overflow", ErrInvalidMoney)
+	}
+	// A large rate can turn a valid amount into one the amount columns
+	// cannot store.
+	converted := Money{Amount: amount.Int64(), Currency: r.Quote}
+	if err := converted.checkRange(); err != nil {
+		return Money{}, err
+	}
+	return converted, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
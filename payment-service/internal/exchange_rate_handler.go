@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+type ExchangeRateHandler struct {
+	service ExchangeRateService
+}
+
+func NewExchangeRateHandler(service ExchangeRateService) *ExchangeRateHandler {
+	return &ExchangeRateHandler{service: service}
+}
+
+func (h *ExchangeRateHandler) ListRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := h.service.ListRates(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rates == nil {
+		rates = []*ExchangeRate{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+func (h *ExchangeRateHandler) SetRate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Base  string `json:"base"`
+		Quote string `json:"quote"`
+		Rate  string `json:"rate"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	rate, err := h.service.SetRate(r.Context(), req.Base, req.Quote, req.Rate)
+	if err != nil {
+		if errors.Is(err, ErrInvalidExchangeRate) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rate)
+}
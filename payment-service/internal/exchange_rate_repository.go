@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+type ExchangeRateRepository interface {
+	UpsertRate(ctx context.Context, rate *ExchangeRate) error
+	GetRate(ctx context.Context, base, quote string) (*ExchangeRate, error)
+	ListRates(ctx context.Context) ([]*ExchangeRate, error)
+}
+
+type exchangeRateRepository struct {
+	db DBTX
+}
+
+func NewExchangeRateRepository(db *sql.DB) ExchangeRateRepository {
+	return &exchangeRateRepository{db: db}
+}
+
+// NewExchangeRateRepositoryTx returns a repository whose operations all run
+// inside tx. Committing or rolling back tx is up to the caller.
+func NewExchangeRateRepositoryTx(tx *sql.Tx) ExchangeRateRepository {
+	return &exchangeRateRepository{db: tx}
+}
+
+func (r *exchangeRateRepository) UpsertRate(ctx context.Context, rate *ExchangeRate) error {
+	return r.db.QueryRowContext(ctx, `
+		INSERT INTO exchange_rates (base_currency, quote_currency, rate)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (base_currency, quote_currency) DO UPDATE SET rate = EXCLUDED.rate, updated_at = NOW()
+		RETURNING updated_at`,
+		rate.Base, rate.Quote, rate.Rate).Scan(&rate.UpdatedAt)
+}
+
+// GetRate returns the current rate from base to quote, or nil when none has
+// been set.
+func (r *exchangeRateRepository) GetRate(ctx context.Context, base, quote string) (*ExchangeRate, error) {
+	rate, err := scanExchangeRate(r.db.QueryRowContext(ctx,
+		"SELECT base_currency, quote_currency, rate, updated_at FROM exchange_rates WHERE base_currency = $1 AND quote_currency = $2",
+		base, quote))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get exchange rate: %w", err)
+	}
+	return rate, nil
+}
+
+func (r *exchangeRateRepository) ListRates(ctx context.Context) ([]*ExchangeRate, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT base_currency, quote_currency, rate, updated_at FROM exchange_rates ORDER BY base_currency, quote_currency")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list exchange rates: %w", err)
+	}
+	defer rows.Close()
+
+	var rates []*ExchangeRate
+	for rows.Next() {
+		rate, err := scanExchangeRate(rows)
+		if err != nil {
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
+
+func scanExchangeRate(row rowScanner) (*ExchangeRate, error) {
+	var rate ExchangeRate
+	if err := row.Scan(&rate.Base, &rate.Quote, &rate.Rate, &rate.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if rate.Rate, err = normalizeRate(rate.Rate); err != nil {
+		return nil, fmt.Errorf("failed to read %s/%s exchange rate: %w", rate.Base, rate.Quote, err)
+	}
+	return &rate, nil
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+)
+
+// ExchangeRateService lets operators maintain the rates used to pay orders
+// from accounts in another currency.
+type ExchangeRateService interface {
+	SetRate(ctx context.Context, base, quote, rate string) (*ExchangeRate, error)
+	ListRates(ctx context.Context) ([]*ExchangeRate, error)
+}
+
+type exchangeRateService struct {
+	rateRepo ExchangeRateRepository
+}
+
+func NewExchangeRateService(rateRepo ExchangeRateRepository) ExchangeRateService {
+	return &exchangeRateService{rateRepo: rateRepo}
+}
+
+func (s *exchangeRateService) SetRate(ctx context.Context, base, quote, rate string) (*ExchangeRate, error) {
+	exchangeRate, err := NewExchangeRate(base, quote, rate)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.rateRepo.UpsertRate(ctx, exchangeRate); err != nil {
+		return nil, fmt.Errorf("failed to save exchange rate: %w", err)
+	}
+	return exchangeRate, nil
+}
+
+func (s *exchangeRateService) ListRates(ctx context.Context) ([]*ExchangeRate, error) {
+	return s.rateRepo.ListRates(ctx)
+}
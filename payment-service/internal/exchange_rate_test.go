@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeRate(t *testing.T) {
+	tests := []struct {
+		rate    string
+		want    string
+		wantErr bool
+	}{
+		{rate: "1.50", want: "1.5"},
+		{rate: "0012.000", want: "12"},
+		{rate: " 0.0105 ", want: "0.0105"},
+		{rate: "0.0000000001", want: "0.0000000001"},
+		{rate: "1234567890", want: "1234567890"},
+		{rate: "0.00000000001", wantErr: true},
+		{rate: "12345678901", wantErr: true},
+		{rate: "0", wantErr: true},
+		{rate: "0.000", wantErr: true},
+		{rate: "-1", wantErr: true},
+		{rate: "1e3", wantErr: true},
+		{rate: "1,5", wantErr: true},
+		{rate: "1.2.3", wantErr: true},
+		{rate: ".5", wantErr: true},
+		{rate: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rate, func(t *testing.T) {
+			got, err := normalizeRate(tt.rate)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidExchangeRate)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestExchangeRate_Convert(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    ExchangeRate
+		amount  Money
+		want    Money
+		wantErr error
+	}{
+		{
+			name:   "between currencies with the same exponent",
+			rate:   ExchangeRate{Base: "RUB", Quote: "USD", Rate: "0.0105"},
+			amount: Money{Amount: 10000, Currency: "RUB"},
+			want:   Money{Amount: 105, Currency: "USD"},
+		},
+		{
+			name:   "into a currency without minor units",
+			rate:   ExchangeRate{Base: "USD", Quote: "JPY", Rate: "150.4"},
+			amount: Money{Amount: 1000, Currency: "USD"},
+			want:   Money{Amount: 1504, Currency: "JPY"},
+		},
+		{
+			name:   "from a currency without minor units",
+			rate:   ExchangeRate{Base: "JPY", Quote: "RUB", Rate: "0.6"},
+			amount: Money{Amount: 1, Currency: "JPY"},
+			want:   Money{Amount: 60, Currency: "RUB"},
+		},
+		{
+			name:   "rounds down below half",
+			rate:   ExchangeRate{Base: "USD", Quote: "JPY", Rate: "140"},
+			amount: Money{Amount: 1, Currency: "USD"},
+			want:   Money{Amount: 1, Currency: "JPY"},
+		},
+		{
+			name:   "rounds half away from zero",
+			rate:   ExchangeRate{Base: "USD", Quote: "JPY", Rate: "150"},
+			amount: Money{Amount: 1, Currency: "USD"},
+			want:   Money{Amount: 2, Currency: "JPY"},
+		},
+		{
+			name:   "rounds negative half away from zero",
+			rate:   ExchangeRate{Base: "USD", Quote: "JPY", Rate: "150"},
+			amount: Money{Amount: -1, Currency: "USD"},
+			want:   Money{Amount: -2, Currency: "JPY"},
+		},
+		{
+			name:   "rounds to zero below half a minor unit",
+			rate:   ExchangeRate{Base: "RUB", Quote: "USD", Rate: "0.0105"},
+			amount: Money{Amount: 1, Currency: "RUB"},
+			want:   Money{Amount: 0, Currency: "USD"},
+		},
+		{
+			name:    "amount in another currency",
+			rate:    ExchangeRate{Base: "RUB", Quote: "USD", Rate: "0.0105"},
+			amount:  Money{Amount: 100, Currency: "EUR"},
+			wantErr: ErrCurrencyMismatch,
+		},
+		{
+			name:    "result larger than the amount columns",
+			rate:    ExchangeRate{Base: "USD", Quote: "RUB", Rate: "100"},
+			amount:  Money{Amount: 9999999999, Currency: "USD"},
+			wantErr: ErrInvalidMoney,
+		},
+		{
+			name:    "result larger than int64",
+			rate:    ExchangeRate{Base: "USD", Quote: "RUB", Rate: "1234567890"},
+			amount:  Money{Amount: 9223372036854775807, Currency: "USD"},
+			wantErr: ErrInvalidMoney,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rate.Convert(tt.amount)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
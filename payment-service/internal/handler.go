@@ -2,7 +2,11 @@ package internal
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
 )
 
 type PaymentHandler struct {
@@ -15,7 +19,8 @@ func NewPaymentHandler(service PaymentService) *PaymentHandler {
 
 func (h *PaymentHandler) CreateAccount(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		UserID string `json:"user_id"`
+		UserID   string `json:"user_id"`
+		Currency string `json:"currency"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -23,8 +28,16 @@ func (h *PaymentHandler) CreateAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	account, err := h.service.CreateAccount(r.Context(), req.UserID)
+	account, err := h.service.CreateAccount(r.Context(), req.UserID, req.Currency)
 	if err != nil {
+		if errors.Is(err, ErrInvalidMoney) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, ErrAccountExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -42,6 +55,10 @@ func (h *PaymentHandler) GetAccount(w http.ResponseWriter, r *http.Request) {
 
 	account, err := h.service.GetAccount(r.Context(), userID)
 	if err != nil {
+		if errors.Is(err, ErrAccountNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -52,8 +69,8 @@ func (h *PaymentHandler) GetAccount(w http.ResponseWriter, r *http.Request) {
 
 func (h *PaymentHandler) Deposit(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		UserID string  `json:"user_id"`
-		Amount float64 `json:"amount"`
+		UserID string `json:"user_id"`
+		Amount Money  `json:"amount"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -62,18 +79,183 @@ func (h *PaymentHandler) Deposit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.service.Deposit(r.Context(), req.UserID, req.Amount); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeBalanceError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *PaymentHandler) Withdraw(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID string `json:"user_id"`
+		Amount Money  `json:"amount"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.Withdraw(r.Context(), req.UserID, req.Amount); err != nil {
+		writeBalanceError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// writeBalanceError maps the errors of deposits and withdrawals to statuses.
+func writeBalanceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidMoney), errors.Is(err, ErrCurrencyMismatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrAccountNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrAccountFrozen), errors.Is(err, ErrAccountClosed):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrInsufficientFunds):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *PaymentHandler) SetLimits(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID         string `json:"user_id"`
+		PerTransaction *Money `json:"per_transaction"`
+		Daily          *Money `json:"daily"`
+		Monthly        *Money `json:"monthly"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "user id is required", http.StatusBadRequest)
+		return
+	}
+
+	limits, err := h.service.SetSpendingLimits(r.Context(), req.UserID, SpendingLimits{
+		PerTransaction: req.PerTransaction,
+		Daily:          req.Daily,
+		Monthly:        req.Monthly,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidSpendingLimit):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrAccountNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
+
+func (h *PaymentHandler) FreezeAccount(w http.ResponseWriter, r *http.Request) {
+	h.setAccountStatus(w, r, AccountStatusFrozen)
+}
+
+func (h *PaymentHandler) UnfreezeAccount(w http.ResponseWriter, r *http.Request) {
+	h.setAccountStatus(w, r, AccountStatusActive)
+}
+
+func (h *PaymentHandler) CloseAccount(w http.ResponseWriter, r *http.Request) {
+	h.setAccountStatus(w, r, AccountStatusClosed)
+}
+
+func (h *PaymentHandler) setAccountStatus(w http.ResponseWriter, r *http.Request, status AccountStatus) {
+	userID := mux.Vars(r)["user_id"]
+	if userID == "" {
+		http.Error(w, "user id is required", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+
+	account, err := h.service.SetAccountStatus(r.Context(), userID, status, req.Reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrAccountNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrAccountStatusConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(account)
+}
+
+func (h *PaymentHandler) ListTransactions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	userID := query.Get("user_id")
+	if userID == "" {
+		http.Error(w, "user id is required", http.StatusBadRequest)
+		return
+	}
+
+	var limit int
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var cursor *LedgerCursor
+	if value := query.Get("cursor"); value != "" {
+		var err error
+		if cursor, err = DecodeLedgerCursor(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := h.service.ListTransactions(r.Context(), userID, cursor, limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidLedgerFilter):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrAccountNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
 func (h *PaymentHandler) ProcessPayment(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		OrderID string  `json:"order_id"`
-		UserID  string  `json:"user_id"`
-		Amount  float64 `json:"amount"`
+		OrderID string `json:"order_id"`
+		UserID  string `json:"user_id"`
+		Amount  Money  `json:"amount"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -99,3 +281,74 @@ func (h *PaymentHandler) ProcessPayment(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
 	}
 }
+
+func (h *PaymentHandler) Refund(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefundID string `json:"refund_id"`
+		OrderID  string `json:"order_id"`
+		Amount   *Money `json:"amount,omitempty"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	refund, err := h.service.RefundPayment(r.Context(), req.RefundID, req.OrderID, req.Amount)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidRefund), errors.Is(err, ErrInvalidMoney), errors.Is(err, ErrCurrencyMismatch):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrPaymentNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrRefundConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrAccountFrozen), errors.Is(err, ErrAccountClosed):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, ErrRefundExceedsPayment):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refund)
+}
+
+func (h *PaymentHandler) Transfer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TransferID string `json:"transfer_id"`
+		FromUserID string `json:"from_user_id"`
+		ToUserID   string `json:"to_user_id"`
+		Amount     Money  `json:"amount"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	transfer, err := h.service.Transfer(r.Context(), req.TransferID, req.FromUserID, req.ToUserID, req.Amount)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidTransfer), errors.Is(err, ErrInvalidMoney), errors.Is(err, ErrCurrencyMismatch):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrAccountNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrTransferConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, ErrAccountFrozen), errors.Is(err, ErrAccountClosed):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, ErrInsufficientFunds):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transfer)
+}
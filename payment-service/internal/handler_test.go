@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSQLMockPaymentHandler(t *testing.T) (*PaymentHandler, sqlmock.Sqlmock) {
+	service, mock := newSQLMockPaymentService(t)
+	return NewPaymentHandler(service), mock
+}
+
+func serve(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestPaymentHandler_CreateAccount(t *testing.T) {
+	t.Run("creates an account", func(t *testing.T) {
+		h, mock := newSQLMockPaymentHandler(t)
+
+		mock.ExpectQuery("INSERT INTO accounts (.+) ON CONFLICT \\(user_id\\) DO NOTHING").
+			WithArgs(sqlmock.AnyArg(), "alice", 0, "RUB").
+			WillReturnRows(accountRow("acc-a", "alice", "0.00"))
+
+		rec := serve(h.CreateAccount, http.MethodPost, "/api/payments/create-account", `{"user_id":"alice"}`)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"id":"acc-a"`)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("conflicts with an existing account", func(t *testing.T) {
+		h, mock := newSQLMockPaymentHandler(t)
+
+		mock.ExpectQuery("INSERT INTO accounts").
+			WithArgs(sqlmock.AnyArg(), "alice", 0, "RUB").
+			WillReturnRows(sqlmock.NewRows(accountColumnNames))
+
+		rec := serve(h.CreateAccount, http.MethodPost, "/api/payments/create-account", `{"user_id":"alice"}`)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rejects an unsupported currency", func(t *testing.T) {
+		h, mock := newSQLMockPaymentHandler(t)
+
+		rec := serve(h.CreateAccount, http.MethodPost, "/api/payments/create-account", `{"user_id":"alice","currency":"XXX"}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestPaymentHandler_GetAccount(t *testing.T) {
+	t.Run("unknown account", func(t *testing.T) {
+		h, mock := newSQLMockPaymentHandler(t)
+
+		mock.ExpectQuery("FROM accounts WHERE user_id = \\$1").
+			WithArgs("alice").
+			WillReturnError(sql.ErrNoRows)
+
+		rec := serve(h.GetAccount, http.MethodGet, "/api/payments/get-account?user_id=alice", "")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("missing user id", func(t *testing.T) {
+		h, mock := newSQLMockPaymentHandler(t)
+
+		rec := serve(h.GetAccount, http.MethodGet, "/api/payments/get-account", "")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestPaymentHandler_Withdraw(t *testing.T) {
+	const body = `{"user_id":"alice","amount":{"value":"10.00","currency":"RUB"}}`
+
+	expectLockedAccount := func(mock sqlmock.Sqlmock, balance string) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id FROM accounts WHERE user_id = \\$1 FOR UPDATE").
+			WithArgs("alice").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("acc-a"))
+		mock.ExpectQuery("FROM accounts WHERE id = \\$1$").
+			WithArgs("acc-a").
+			WillReturnRows(accountRow("acc-a", "alice", balance))
+	}
+
+	t.Run("withdraws to the external account", func(t *testing.T) {
+		h, mock := newSQLMockPaymentHandler(t)
+
+		expectLockedAccount(mock, "100.00")
+		mock.ExpectExec("INSERT INTO ledger_entries").
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "acc-a", LedgerDebit, "10.00", "RUB", LedgerOperationWithdrawal, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE accounts SET balance = balance - \\$1").
+			WithArgs("10.00", "acc-a", "RUB").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO ledger_entries").
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), SystemAccountExternal, LedgerCredit, "10.00", "RUB", LedgerOperationWithdrawal, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		rec := serve(h.Withdraw, http.MethodPost, "/api/payments/withdraw", body)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("insufficient funds", func(t *testing.T) {
+		h, mock := newSQLMockPaymentHandler(t)
+
+		expectLockedAccount(mock, "9.99")
+		mock.ExpectRollback()
+
+		rec := serve(h.Withdraw, http.MethodPost, "/api/payments/withdraw", body)
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown account", func(t *testing.T) {
+		h, mock := newSQLMockPaymentHandler(t)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id FROM accounts WHERE user_id = \\$1 FOR UPDATE").
+			WithArgs("alice").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		rec := serve(h.Withdraw, http.MethodPost, "/api/payments/withdraw", body)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("account in another currency", func(t *testing.T) {
+		h, mock := newSQLMockPaymentHandler(t)
+
+		expectLockedAccount(mock, "100.00")
+		mock.ExpectRollback()
+
+		rec := serve(h.Withdraw, http.MethodPost, "/api/payments/withdraw",
+			`{"user_id":"alice","amount":{"value":"10.00","currency":"USD"}}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestPaymentHandler_BadMoney(t *testing.T) {
+	h, mock := newSQLMockPaymentHandler(t)
+
+	amounts := []string{
+		`10`,
+		`{"value":10,"currency":"RUB"}`,
+		`{"value":"10.001","currency":"RUB"}`,
+		`{"value":"-10.00","currency":"RUB"}`,
+		`{"value":"0.00","currency":"RUB"}`,
+		`{"value":"10.00","currency":"XXX"}`,
+	}
+	handlers := map[string]http.HandlerFunc{
+		"deposit":  h.Deposit,
+		"withdraw": h.Withdraw,
+	}
+
+	for name, handler := range handlers {
+		for _, amount := range amounts {
+			t.Run(name+" "+amount, func(t *testing.T) {
+				rec := serve(handler, http.MethodPost, "/api/payments/"+name, `{"user_id":"alice","amount":`+amount+`}`)
+				assert.Equal(t, http.StatusBadRequest, rec.Code)
+			})
+		}
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPaymentHandler_FrozenAccount(t *testing.T) {
+	frozenRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows(accountColumnNames).AddRow("acc-a", "alice", "100.00", "RUB", "100.00", AccountStatusFrozen, "suspicious activity")
+	}
+
+	t.Run("deposit", func(t *testing.T) {
+		h, mock := newSQLMockPaymentHandler(t)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id FROM accounts WHERE user_id = \\$1 FOR UPDATE").
+			WithArgs("alice").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("acc-a"))
+		mock.ExpectQuery("FROM accounts WHERE id = \\$1$").
+			WithArgs("acc-a").
+			WillReturnRows(frozenRow())
+		mock.ExpectRollback()
+
+		rec := serve(h.Deposit, http.MethodPost, "/api/payments/deposit",
+			`{"user_id":"alice","amount":{"value":"10.00","currency":"RUB"}}`)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Contains(t, rec.Body.String(), "account is frozen: suspicious activity")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("refund", func(t *testing.T) {
+		h, mock := newSQLMockPaymentHandler(t)
+		payment := func() *sqlmock.Rows {
+			return sqlmock.NewRows([]string{"account_id", "currency", "charged", "refunded"}).AddRow("acc-a", "RUB", "100.00", "0.00")
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM ledger_entries WHERE reference_id = \\$1").
+			WithArgs("order1").
+			WillReturnRows(payment())
+		mock.ExpectQuery("SELECT id FROM accounts WHERE id = \\$1 FOR UPDATE").
+			WithArgs("acc-a").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("acc-a"))
+		mock.ExpectQuery("FROM accounts WHERE id = \\$1$").
+			WithArgs("acc-a").
+			WillReturnRows(frozenRow())
+		mock.ExpectQuery("FROM ledger_entries WHERE reference_id = \\$1").
+			WithArgs("order1").
+			WillReturnRows(payment())
+		mock.ExpectQuery("FROM refunds WHERE id = \\$1").
+			WithArgs("refund1").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		rec := serve(h.Refund, http.MethodPost, "/api/payments/refund", `{"refund_id":"refund1","order_id":"order1"}`)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
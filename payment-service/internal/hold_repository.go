@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type HoldRepository interface {
+	CreateHold(ctx context.Context, hold *Hold) error
+	LockHoldByOrderID(ctx context.Context, orderID string) (*Hold, error)
+	UpdateHoldStatus(ctx context.Context, id string, status HoldStatus) error
+	ClaimExpiredHolds(ctx context.Context, limit int) ([]*Hold, error)
+	SumSpentSince(ctx context.Context, accountID, currency string, since time.Time) (Money, error)
+}
+
+type holdRepository struct {
+	db DBTX
+}
+
+func NewHoldRepository(db *sql.DB) HoldRepository {
+	return &holdRepository{db: db}
+}
+
+// NewHoldRepositoryTx returns a repository whose operations all run inside
+// tx. Committing or rolling back tx is up to the caller.
+func NewHoldRepositoryTx(tx *sql.Tx) HoldRepository {
+	return &holdRepository{db: tx}
+}
+
+// Holds created before orders could be paid in another currency have no
+// order amount; it is the same as the held amount for them.
+const holdColumns = "id, order_id, account_id, amount, currency, COALESCE(order_amount, amount), COALESCE(order_currency, currency), exchange_rate, status, expires_at, created_at"
+
+// maxSumDigits bounds the integer part of a sum of amounts so that it still
+// fits into int64 minor units.
+const maxSumDigits = 15
+
+// CreateHold stores a new hold, which is active unless hold.Status says
+// otherwise.
+func (r *holdRepository) CreateHold(ctx context.Context, hold *Hold) error {
+	hold.ID = uuid.New().String()
+	if hold.Status == "" {
+		hold.Status = HoldStatusActive
+	}
+	if hold.OrderAmount.Currency == "" {
+		hold.OrderAmount = hold.Amount
+	}
+
+	var exchangeRate sql.NullString
+	if hold.ExchangeRate != "" {
+		exchangeRate = sql.NullString{String: hold.ExchangeRate, Valid: true}
+	}
+
+	return r.db.QueryRowContext(ctx,
+		"INSERT INTO holds (id, order_id, account_id, amount, currency, order_amount, order_currency, exchange_rate, status, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING created_at",
+		hold.ID, hold.OrderID, hold.AccountID, hold.Amount.Decimal(), hold.Amount.Currency,
+		hold.OrderAmount.Decimal(), hold.OrderAmount.Currency, exchangeRate, hold.Status, hold.ExpiresAt).
+		Scan(&hold.CreatedAt)
+}
+
+// LockHoldByOrderID reads the hold of an order with SELECT ... FOR UPDATE.
+// It returns nil when no funds have been held for the order.
+func (r *holdRepository) LockHoldByOrderID(ctx context.Context, orderID string) (*Hold, error) {
+	hold, err := scanHold(r.db.QueryRowContext(ctx,
+		"SELECT "+holdColumns+" FROM holds WHERE order_id = $1 FOR UPDATE", orderID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to lock hold: %w", err)
+	}
+	return hold, nil
+}
+
+func (r *holdRepository) UpdateHoldStatus(ctx context.Context, id string, status HoldStatus) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE holds SET status = $1, updated_at = NOW() WHERE id = $2", status, id)
+	if err != nil {
+		return fmt.Errorf("failed to update hold status: %w", err)
+	}
+	return nil
+}
+
+// ClaimExpiredHolds locks up to limit active holds whose expiry time has
+// passed. Holds locked by another instance are skipped.
+func (r *holdRepository) ClaimExpiredHolds(ctx context.Context, limit int) ([]*Hold, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+holdColumns+" FROM holds WHERE status = $1 AND expires_at <= NOW() ORDER BY expires_at LIMIT $2 FOR UPDATE SKIP LOCKED",
+		HoldStatusActive, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim expired holds: %w", err)
+	}
+	defer rows.Close()
+
+	var holds []*Hold
+	for rows.Next() {
+		hold, err := scanHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+	return holds, rows.Err()
+}
+
+// SumSpentSince adds up the holds placed on an account for orders since the
+// given time that are still active or have been captured. Released and
+// expired holds were never spent and do not count.
+func (r *holdRepository) SumSpentSince(ctx context.Context, accountID, currency string, since time.Time) (Money, error) {
+	var sum string
+	err := r.db.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(amount), 0) FROM holds WHERE account_id = $1 AND created_at >= $2 AND (status = $3 OR (status = $4 AND expires_at > NOW()))",
+		accountID, since, HoldStatusCaptured, HoldStatusActive).Scan(&sum)
+	if err != nil {
+		return Money{}, fmt.Errorf("failed to sum spending: %w", err)
+	}
+	// Spending over a month can add up to more than a single amount column
+	// holds.
+	return parseMoney(sum, currency, maxSumDigits)
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanHold(row rowScanner) (*Hold, error) {
+	var hold Hold
+	var amount, currency, orderAmount, orderCurrency string
+	var exchangeRate sql.NullString
+	err := row.Scan(&hold.ID, &hold.OrderID, &hold.AccountID, &amount, &currency,
+		&orderAmount, &orderCurrency, &exchangeRate, &hold.Status, &hold.ExpiresAt, &hold.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if hold.Amount, err = ParseMoney(amount, currency); err != nil {
+		return nil, fmt.Errorf("failed to read amount of hold %s: %w", hold.ID, err)
+	}
+	if hold.OrderAmount, err = ParseMoney(orderAmount, orderCurrency); err != nil {
+		return nil, fmt.Errorf("failed to read order amount of hold %s: %w", hold.ID, err)
+	}
+	if exchangeRate.Valid {
+		if hold.ExchangeRate, err = normalizeRate(exchangeRate.String); err != nil {
+			return nil, fmt.Errorf("failed to read exchange rate of hold %s: %w", hold.ID, err)
+		}
+	}
+	return &hold, nil
+}
@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func holdRow(id, orderID string, status HoldStatus, expiresAt time.Time) []driver.Value {
+	return []driver.Value{id, orderID, "acc-a", "10.00", "RUB", "10.00", "RUB", nil, status, expiresAt, time.Now()}
+}
+
+// beginHoldTx starts the transaction the hold operations run in and expects
+// the hold of order1 to be locked. An empty status means there is no hold.
+func beginHoldTx(t *testing.T, db *sql.DB, mock sqlmock.Sqlmock, status HoldStatus, expiresAt time.Time) *sql.Tx {
+	mock.ExpectBegin()
+	rows := sqlmock.NewRows(holdColumnNames)
+	if status != "" {
+		rows.AddRow(holdRow("hold1", "order1", status, expiresAt)...)
+	}
+	mock.ExpectQuery("SELECT (.+) FROM holds WHERE order_id = \\$1 FOR UPDATE").
+		WithArgs("order1").
+		WillReturnRows(rows)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+	return tx
+}
+
+func TestPaymentService_AuthorizeOrder(t *testing.T) {
+	amount := Money{Amount: 1000, Currency: "RUB"}
+	service := &paymentService{holdTTL: time.Hour}
+
+	t.Run("holds the funds", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		tx := beginHoldTx(t, db, mock, "", time.Time{})
+		mock.ExpectQuery("SELECT id FROM accounts WHERE user_id = \\$1 FOR UPDATE").
+			WithArgs("alice").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("acc-a"))
+		mock.ExpectQuery("FROM accounts WHERE id = \\$1$").
+			WithArgs("acc-a").
+			WillReturnRows(accountRow("acc-a", "alice", "100.00"))
+		mock.ExpectQuery("FROM account_limits WHERE account_id = \\$1").
+			WithArgs("acc-a").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery("INSERT INTO holds").
+			WithArgs(sqlmock.AnyArg(), "order1", "acc-a", "10.00", "RUB", "10.00", "RUB", nil, HoldStatusActive, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+
+		result, err := service.authorizeOrder(context.Background(), tx, "order1", "alice", amount)
+		assert.NoError(t, err)
+		assert.True(t, result.Success)
+		assert.Equal(t, "funds authorized", result.Message)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns the existing hold when authorized twice", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		tx := beginHoldTx(t, db, mock, HoldStatusActive, time.Now().Add(time.Hour))
+
+		result, err := service.authorizeOrder(context.Background(), tx, "order1", "alice", amount)
+		assert.NoError(t, err)
+		assert.True(t, result.Success)
+		assert.Equal(t, "funds for the order are already active", result.Message)
+		assert.Equal(t, &amount, result.Amount)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestCaptureOrder(t *testing.T) {
+	t.Run("takes the held funds", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		tx := beginHoldTx(t, db, mock, HoldStatusActive, time.Now().Add(time.Hour))
+		expectAccountLock(mock, "acc-a", "alice", "100.00")
+		mock.ExpectExec("INSERT INTO ledger_entries").
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "acc-a", LedgerDebit, "10.00", "RUB", LedgerOperationOrderPayment, "order1").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE accounts SET balance = balance - \\$1").
+			WithArgs("10.00", "acc-a", "RUB").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO ledger_entries").
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), SystemAccountRevenue, LedgerCredit, "10.00", "RUB", LedgerOperationOrderPayment, "order1").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE holds SET status = \\$1").
+			WithArgs(HoldStatusCaptured, "hold1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		result, err := captureOrder(context.Background(), tx, "order1")
+		assert.NoError(t, err)
+		assert.True(t, result.Success)
+		assert.Equal(t, "payment captured", result.Message)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	tests := []struct {
+		name        string
+		status      HoldStatus
+		expiresAt   time.Time
+		wantSuccess bool
+		wantMessage string
+	}{
+		{name: "already captured", status: HoldStatusCaptured, expiresAt: time.Now(), wantSuccess: true, wantMessage: "payment already captured"},
+		{name: "released", status: HoldStatusReleased, expiresAt: time.Now().Add(time.Hour), wantMessage: "authorization is released"},
+		{name: "expired", status: HoldStatusExpired, expiresAt: time.Now().Add(-time.Hour), wantMessage: "authorization is expired"},
+		{name: "past its expiry time", status: HoldStatusActive, expiresAt: time.Now().Add(-time.Minute), wantMessage: "authorization is expired"},
+		{name: "without a hold", wantMessage: "no funds are held for the order"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newSQLMock(t)
+
+			// Nothing is posted to the ledger and the hold is left as it is.
+			tx := beginHoldTx(t, db, mock, tt.status, tt.expiresAt)
+
+			result, err := captureOrder(context.Background(), tx, "order1")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantSuccess, result.Success)
+			assert.Equal(t, tt.wantMessage, result.Message)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestReleaseOrder(t *testing.T) {
+	t.Run("releases an active hold", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		tx := beginHoldTx(t, db, mock, HoldStatusActive, time.Now().Add(time.Hour))
+		mock.ExpectExec("UPDATE holds SET status = \\$1").
+			WithArgs(HoldStatusReleased, "hold1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		result, err := releaseOrder(context.Background(), tx, "order1")
+		assert.NoError(t, err)
+		assert.True(t, result.Success)
+		assert.Equal(t, "hold released", result.Message)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	for _, status := range []HoldStatus{HoldStatusCaptured, HoldStatusReleased, HoldStatusExpired} {
+		t.Run("does nothing to a "+string(status)+" hold", func(t *testing.T) {
+			db, mock := newSQLMock(t)
+
+			tx := beginHoldTx(t, db, mock, status, time.Now())
+
+			result, err := releaseOrder(context.Background(), tx, "order1")
+			assert.NoError(t, err)
+			assert.True(t, result.Success)
+			assert.Equal(t, "no active hold for the order", result.Message)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPaymentService_ExpireHolds(t *testing.T) {
+	t.Run("expires active holds past their expiry time", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+		expiresAt := time.Now().Add(-time.Minute)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM holds WHERE status = \\$1 AND expires_at <= NOW\\(\\) ORDER BY expires_at LIMIT \\$2 FOR UPDATE SKIP LOCKED").
+			WithArgs(HoldStatusActive, 10).
+			WillReturnRows(sqlmock.NewRows(holdColumnNames).
+				AddRow(holdRow("hold1", "order1", HoldStatusActive, expiresAt)...).
+				AddRow(holdRow("hold2", "order2", HoldStatusActive, expiresAt)...))
+		for _, hold := range []struct{ id, orderID string }{{"hold1", "order1"}, {"hold2", "order2"}} {
+			mock.ExpectExec("UPDATE holds SET status = \\$1").
+				WithArgs(HoldStatusExpired, hold.id).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("INSERT INTO outbox_messages").
+				WithArgs(sqlmock.AnyArg(), hold.orderID, payloadContains("authorization expired"), false).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+
+		expired, err := service.ExpireHolds(context.Background(), 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, expired)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("nothing to expire", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM holds WHERE status = \\$1 AND expires_at <= NOW\\(\\)").
+			WithArgs(HoldStatusActive, 10).
+			WillReturnRows(sqlmock.NewRows(holdColumnNames))
+		mock.ExpectCommit()
+
+		expired, err := service.ExpireHolds(context.Background(), 10)
+		assert.NoError(t, err)
+		assert.Zero(t, expired)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
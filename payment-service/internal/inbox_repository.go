@@ -3,51 +3,92 @@ package internal
 import (
 	"context"
 	"database/sql"
-	"github.com/google/uuid"
+	"errors"
+	"time"
 )
 
 type InboxRepository interface {
-	CreateInboxMessage(ctx context.Context, orderID, payload string) error
-	GetUnprocessedMessages(ctx context.Context) ([]*InboxMessage, error)
+	CreateInboxMessage(ctx context.Context, msg *InboxMessage) (bool, error)
+	ClaimNextMessage(ctx context.Context) (*InboxMessage, error)
 	MarkMessageAsProcessed(ctx context.Context, id string) error
+	RecordFailure(ctx context.Context, id, lastError string, nextAttemptAt time.Time) error
 }
 
 type inboxRepository struct {
-	db *sql.DB
+	db DBTX
 }
 
 func NewInboxRepository(db *sql.DB) InboxRepository {
 	return &inboxRepository{db: db}
 }
 
-func (r *inboxRepository) CreateInboxMessage(ctx context.Context, orderID, payload string) error {
-	_, err := r.db.ExecContext(ctx,
-		"INSERT INTO inbox_messages (id, order_id, payload, processed) VALUES ($1, $2, $3, $4)",
-		uuid.New().String(), orderID, payload, false)
-	return err
+// NewInboxRepositoryTx returns a repository whose operations all run inside
+// tx. Committing or rolling back tx is up to the caller.
+func NewInboxRepositoryTx(tx *sql.Tx) InboxRepository {
+	return &inboxRepository{db: tx}
 }
 
-func (r *inboxRepository) GetUnprocessedMessages(ctx context.Context) ([]*InboxMessage, error) {
-	rows, err := r.db.QueryContext(ctx,
-		"SELECT id, order_id, payload, processed FROM inbox_messages WHERE processed = false")
+// CreateInboxMessage stores a received message under its message ID. It
+// reports false without an error when a message with the same ID has already
+// been stored, i.e. when the broker delivered it again.
+func (r *inboxRepository) CreateInboxMessage(ctx context.Context, msg *InboxMessage) (bool, error) {
+	res, err := r.db.ExecContext(ctx,
+		"INSERT INTO inbox_messages (id, event_type, order_id, payload, processed) VALUES ($1, $2, $3, $4, false) ON CONFLICT (id) DO NOTHING",
+		msg.ID, msg.EventType, msg.OrderID, msg.Payload)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	defer rows.Close()
 
-	var messages []*InboxMessage
-	for rows.Next() {
-		var msg InboxMessage
-		if err := rows.Scan(&msg.ID, &msg.OrderID, &msg.Payload, &msg.Processed); err != nil {
-			return nil, err
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// ClaimNextMessage locks the oldest unprocessed message whose order has no
+// older unprocessed message, so the messages of one order are applied one at
+// a time and in the order they arrived. A message that failed is skipped
+// until its next attempt is due, while the messages of other orders go on.
+// It must run inside a transaction and returns nil when there is nothing to
+// do.
+func (r *inboxRepository) ClaimNextMessage(ctx context.Context) (*InboxMessage, error) {
+	var msg InboxMessage
+	err := r.db.QueryRowContext(ctx, `
+		SELECT m.id, m.event_type, m.order_id, m.payload, m.processed, m.attempts, COALESCE(m.last_error, ''), m.received_at
+		FROM inbox_messages m
+		WHERE m.processed = false
+			AND m.next_attempt_at <= NOW()
+			AND NOT EXISTS (
+				SELECT 1 FROM inbox_messages e
+				WHERE e.order_id = m.order_id
+					AND e.processed = false
+					AND (e.received_at, e.id) < (m.received_at, m.id)
+			)
+		ORDER BY m.received_at, m.id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`).
+		Scan(&msg.ID, &msg.EventType, &msg.OrderID, &msg.Payload, &msg.Processed, &msg.Attempts, &msg.LastError, &msg.ReceivedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
 		}
-		messages = append(messages, &msg)
+		return nil, err
 	}
-	return messages, nil
+	return &msg, nil
 }
 
 func (r *inboxRepository) MarkMessageAsProcessed(ctx context.Context, id string) error {
 	_, err := r.db.ExecContext(ctx,
-		"UPDATE inbox_messages SET processed = true WHERE id = $1", id)
+		"UPDATE inbox_messages SET processed = true, processed_at = NOW() WHERE id = $1", id)
+	return err
+}
+
+// RecordFailure counts a failed attempt to apply the message and postpones
+// the next one.
+func (r *inboxRepository) RecordFailure(ctx context.Context, id, lastError string, nextAttemptAt time.Time) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE inbox_messages SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3 WHERE id = $1",
+		id, lastError, nextAttemptAt)
 	return err
 }
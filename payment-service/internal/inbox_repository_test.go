@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var inboxColumns = []string{"id", "event_type", "order_id", "payload", "processed", "attempts", "last_error", "received_at"}
+
+// releaseRequest returns a stored release request for order1 that has
+// already failed attempts times.
+func releaseRequest(t *testing.T, attempts int) *sqlmock.Rows {
+	envelope, err := NewEventEnvelope(EventTypeRelease, "order1", "", PaymentRequest{
+		OrderID: "order1",
+		UserID:  "alice",
+		Amount:  Money{Amount: 1000, Currency: "RUB"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create envelope: %v", err)
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("failed to marshal envelope: %v", err)
+	}
+	return sqlmock.NewRows(inboxColumns).
+		AddRow("msg1", EventTypeRelease, "order1", string(payload), false, attempts, "", time.Now())
+}
+
+// payloadContains matches an outbox payload that contains the given text.
+type payloadContains string
+
+func (p payloadContains) Match(v driver.Value) bool {
+	payload, ok := v.(string)
+	return ok && strings.Contains(payload, string(p))
+}
+
+func TestInboxRepository_CreateInboxMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		affected    int64
+		wantCreated bool
+	}{
+		{name: "new message", affected: 1, wantCreated: true},
+		{name: "redelivered message", affected: 0, wantCreated: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newSQLMock(t)
+
+			mock.ExpectExec("INSERT INTO inbox_messages (.+) ON CONFLICT \\(id\\) DO NOTHING").
+				WithArgs("msg1", EventTypePayment, "order1", "{}").
+				WillReturnResult(sqlmock.NewResult(0, tt.affected))
+
+			created, err := NewInboxRepository(db).CreateInboxMessage(context.Background(), &InboxMessage{
+				ID:        "msg1",
+				EventType: EventTypePayment,
+				OrderID:   "order1",
+				Payload:   "{}",
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantCreated, created)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestInboxRepository_ClaimNextMessage(t *testing.T) {
+	// Only the oldest unprocessed message of an order may be claimed, and
+	// messages locked by another instance are skipped.
+	claimQuery := "WHERE m.processed = false AND m.next_attempt_at <= NOW\\(\\) " +
+		"AND NOT EXISTS \\( SELECT 1 FROM inbox_messages e WHERE e.order_id = m.order_id AND e.processed = false " +
+		"AND \\(e.received_at, e.id\\) < \\(m.received_at, m.id\\) \\) " +
+		"ORDER BY m.received_at, m.id LIMIT 1 FOR UPDATE SKIP LOCKED"
+
+	t.Run("claims the next message", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		mock.ExpectQuery(claimQuery).
+			WillReturnRows(releaseRequest(t, 1))
+
+		msg, err := NewInboxRepository(db).ClaimNextMessage(context.Background())
+		assert.NoError(t, err)
+		if assert.NotNil(t, msg) {
+			assert.Equal(t, "msg1", msg.ID)
+			assert.Equal(t, 1, msg.Attempts)
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("nothing to claim", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		mock.ExpectQuery(claimQuery).
+			WillReturnRows(sqlmock.NewRows(inboxColumns))
+
+		msg, err := NewInboxRepository(db).ClaimNextMessage(context.Background())
+		assert.NoError(t, err)
+		assert.Nil(t, msg)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestPaymentService_ProcessInboxMessages(t *testing.T) {
+	retry := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute}
+	newService := func(t *testing.T) (PaymentService, sqlmock.Sqlmock) {
+		db, mock := newSQLMock(t)
+		service := NewPaymentService(db, NewAccountRepository(db), NewInboxRepository(db), NewLedgerRepository(db), time.Hour, retry)
+		return service, mock
+	}
+
+	t.Run("applies a redelivered request once", func(t *testing.T) {
+		service, mock := newService(t)
+		msg := &InboxMessage{ID: "msg1", EventType: EventTypeRelease, OrderID: "order1", Payload: "{}"}
+
+		mock.ExpectExec("INSERT INTO inbox_messages").
+			WithArgs("msg1", EventTypeRelease, "order1", "{}").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO inbox_messages").
+			WithArgs("msg1", EventTypeRelease, "order1", "{}").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM inbox_messages m").
+			WillReturnRows(releaseRequest(t, 0))
+		mock.ExpectExec("SAVEPOINT apply_inbox_message").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("FROM holds WHERE order_id = \\$1 FOR UPDATE").
+			WithArgs("order1").
+			WillReturnRows(sqlmock.NewRows(holdColumnNames))
+		mock.ExpectExec("INSERT INTO outbox_messages").
+			WithArgs(sqlmock.AnyArg(), "order1", payloadContains("no active hold for the order"), false).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE inbox_messages SET processed = true").
+			WithArgs("msg1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		// The stored request has been processed, so there is nothing left.
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM inbox_messages m").
+			WillReturnRows(sqlmock.NewRows(inboxColumns))
+		mock.ExpectRollback()
+
+		assert.NoError(t, service.ReceivePaymentRequest(context.Background(), msg))
+		assert.NoError(t, service.ReceivePaymentRequest(context.Background(), msg))
+
+		processed, err := service.ProcessInboxMessages(context.Background(), 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, processed)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	expectFailedAttempt := func(t *testing.T, mock sqlmock.Sqlmock, attempts int) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM inbox_messages m").
+			WillReturnRows(releaseRequest(t, attempts))
+		mock.ExpectExec("SAVEPOINT apply_inbox_message").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("FROM holds WHERE order_id = \\$1 FOR UPDATE").
+			WithArgs("order1").
+			WillReturnError(errors.New("connection reset"))
+		mock.ExpectExec("ROLLBACK TO SAVEPOINT apply_inbox_message").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("UPDATE inbox_messages SET attempts = attempts \\+ 1").
+			WithArgs("msg1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	t.Run("records a failed attempt and retries later", func(t *testing.T) {
+		service, mock := newService(t)
+
+		expectFailedAttempt(t, mock, 0)
+		mock.ExpectCommit()
+
+		processed, err := service.ProcessInboxMessages(context.Background(), 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, processed)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("answers with a failure after the last attempt", func(t *testing.T) {
+		service, mock := newService(t)
+
+		expectFailedAttempt(t, mock, 2)
+		mock.ExpectExec("INSERT INTO outbox_messages").
+			WithArgs(sqlmock.AnyArg(), "order1", payloadContains("request failed after 3 attempts"), false).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE inbox_messages SET processed = true").
+			WithArgs("msg1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		processed, err := service.ProcessInboxMessages(context.Background(), 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, processed)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
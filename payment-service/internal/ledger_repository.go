@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type LedgerRepository interface {
+	Post(ctx context.Context, txn LedgerTransaction) (string, error)
+	ListEntries(ctx context.Context, filter LedgerFilter) ([]*LedgerEntry, error)
+	GetOrderPayment(ctx context.Context, orderID string) (*OrderPayment, error)
+}
+
+type ledgerRepository struct {
+	db DBTX
+}
+
+func NewLedgerRepository(db *sql.DB) LedgerRepository {
+	return &ledgerRepository{db: db}
+}
+
+// NewLedgerRepositoryTx returns a repository whose operations all run inside
+// tx. Committing or rolling back tx is up to the caller.
+func NewLedgerRepositoryTx(tx *sql.Tx) LedgerRepository {
+	return &ledgerRepository{db: tx}
+}
+
+// Post records txn and applies it to the balances of the customer accounts
+// involved. It is the only place where balances change, so a balance always
+// equals the credits minus the debits of its account. Post has to run inside
+// a transaction, and the customer accounts must already be locked by the
+// caller when the balance is checked first.
+func (r *ledgerRepository) Post(ctx context.Context, txn LedgerTransaction) (string, error) {
+	if !txn.Amount.IsPositive() {
+		return "", fmt.Errorf("%w: ledger amount must be positive", ErrInvalidMoney)
+	}
+
+	transactionID := uuid.New().String()
+	legs := []struct {
+		accountID string
+		direction LedgerDirection
+		sign      string
+	}{
+		{txn.DebitAccountID, LedgerDebit, "-"},
+		{txn.CreditAccountID, LedgerCredit, "+"},
+	}
+
+	for _, leg := range legs {
+		_, err := r.db.ExecContext(ctx,
+			"INSERT INTO ledger_entries (id, transaction_id, account_id, direction, amount, currency, operation, reference_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			uuid.New().String(), transactionID, leg.accountID, leg.direction,
+			txn.Amount.Decimal(), txn.Amount.Currency, txn.Operation, txn.ReferenceID)
+		if err != nil {
+			return "", fmt.Errorf("failed to insert ledger entry: %w", err)
+		}
+
+		if isSystemAccount(leg.accountID) {
+			continue
+		}
+
+		res, err := r.db.ExecContext(ctx,
+			"UPDATE accounts SET balance = balance "+leg.sign+" $1 WHERE id = $2 AND currency = $3",
+			txn.Amount.Decimal(), leg.accountID, txn.Amount.Currency)
+		if err != nil {
+			return "", fmt.Errorf("failed to update balance: %w", err)
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return "", err
+		}
+		if affected == 0 {
+			return "", fmt.Errorf("failed to update balance: no %s account %s", txn.Amount.Currency, leg.accountID)
+		}
+	}
+
+	return transactionID, nil
+}
+
+func isSystemAccount(accountID string) bool {
+	return strings.HasPrefix(accountID, "system:")
+}
+
+// ListEntries returns up to filter.Limit entries of an account, newest first,
+// starting after filter.Cursor when it is set.
+func (r *ledgerRepository) ListEntries(ctx context.Context, filter LedgerFilter) ([]*LedgerEntry, error) {
+	query := "SELECT id, transaction_id, account_id, direction, amount, currency, operation, reference_id, created_at FROM ledger_entries WHERE account_id = $1"
+	args := []interface{}{filter.AccountID}
+
+	if filter.Cursor != nil {
+		args = append(args, filter.Cursor.CreatedAt, filter.Cursor.ID)
+		query += fmt.Sprintf(" AND (created_at, id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*LedgerEntry
+	for rows.Next() {
+		var entry LedgerEntry
+		var amount, currency string
+		if err := rows.Scan(&entry.ID, &entry.TransactionID, &entry.AccountID, &entry.Direction,
+			&amount, &currency, &entry.Operation, &entry.ReferenceID, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		if entry.Amount, err = ParseMoney(amount, currency); err != nil {
+			return nil, fmt.Errorf("failed to read amount of ledger entry %s: %w", entry.ID, err)
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+// GetOrderPayment sums up the payment and refund entries of an order on the
+// customer account. It returns nil when nothing was charged for the order.
+func (r *ledgerRepository) GetOrderPayment(ctx context.Context, orderID string) (*OrderPayment, error) {
+	payment := OrderPayment{OrderID: orderID}
+	var currency, charged, refunded string
+	err := r.db.QueryRowContext(ctx, `
+		SELECT account_id, currency,
+			COALESCE(SUM(amount) FILTER (WHERE operation = 'ORDER_PAYMENT' AND direction = 'DEBIT'), 0),
+			COALESCE(SUM(amount) FILTER (WHERE operation = 'REFUND' AND direction = 'CREDIT'), 0)
+		FROM ledger_entries
+		WHERE reference_id = $1 AND account_id NOT LIKE 'system:%'
+		GROUP BY account_id, currency
+		HAVING COUNT(*) FILTER (WHERE operation = 'ORDER_PAYMENT') > 0`,
+		orderID).Scan(&payment.AccountID, &currency, &charged, &refunded)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if payment.Charged, err = ParseMoney(charged, currency); err != nil {
+		return nil, fmt.Errorf("failed to read payment of order %s: %w", orderID, err)
+	}
+	if payment.Refunded, err = ParseMoney(refunded, currency); err != nil {
+		return nil, fmt.Errorf("failed to read refunds of order %s: %w", orderID, err)
+	}
+	return &payment, nil
+}
@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func expectLedgerEntry(mock sqlmock.Sqlmock, accountID string, direction LedgerDirection, operation LedgerOperation) {
+	mock.ExpectExec("INSERT INTO ledger_entries").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), accountID, direction, "10.00", "RUB", operation, "ref1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestLedgerRepository_Post(t *testing.T) {
+	amount := Money{Amount: 1000, Currency: "RUB"}
+
+	t.Run("deposit credits the account from the external system account", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		expectLedgerEntry(mock, SystemAccountExternal, LedgerDebit, LedgerOperationDeposit)
+		expectLedgerEntry(mock, "acc-a", LedgerCredit, LedgerOperationDeposit)
+		mock.ExpectExec("UPDATE accounts SET balance = balance \\+ \\$1 WHERE id = \\$2 AND currency = \\$3").
+			WithArgs("10.00", "acc-a", "RUB").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		_, err := NewLedgerRepository(db).Post(context.Background(), LedgerTransaction{
+			Operation:       LedgerOperationDeposit,
+			ReferenceID:     "ref1",
+			DebitAccountID:  SystemAccountExternal,
+			CreditAccountID: "acc-a",
+			Amount:          amount,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("payment debits the account to the revenue system account", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		expectLedgerEntry(mock, "acc-a", LedgerDebit, LedgerOperationOrderPayment)
+		mock.ExpectExec("UPDATE accounts SET balance = balance - \\$1 WHERE id = \\$2 AND currency = \\$3").
+			WithArgs("10.00", "acc-a", "RUB").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectLedgerEntry(mock, SystemAccountRevenue, LedgerCredit, LedgerOperationOrderPayment)
+
+		_, err := NewLedgerRepository(db).Post(context.Background(), LedgerTransaction{
+			Operation:       LedgerOperationOrderPayment,
+			ReferenceID:     "ref1",
+			DebitAccountID:  "acc-a",
+			CreditAccountID: SystemAccountRevenue,
+			Amount:          amount,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("transfer moves the amount between two accounts", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		expectLedgerEntry(mock, "acc-a", LedgerDebit, LedgerOperationTransfer)
+		mock.ExpectExec("UPDATE accounts SET balance = balance - \\$1").
+			WithArgs("10.00", "acc-a", "RUB").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectLedgerEntry(mock, "acc-b", LedgerCredit, LedgerOperationTransfer)
+		mock.ExpectExec("UPDATE accounts SET balance = balance \\+ \\$1").
+			WithArgs("10.00", "acc-b", "RUB").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		_, err := NewLedgerRepository(db).Post(context.Background(), LedgerTransaction{
+			Operation:       LedgerOperationTransfer,
+			ReferenceID:     "ref1",
+			DebitAccountID:  "acc-a",
+			CreditAccountID: "acc-b",
+			Amount:          amount,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("fails when the account is in another currency", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		expectLedgerEntry(mock, SystemAccountExternal, LedgerDebit, LedgerOperationDeposit)
+		expectLedgerEntry(mock, "acc-a", LedgerCredit, LedgerOperationDeposit)
+		mock.ExpectExec("UPDATE accounts SET balance = balance \\+ \\$1 WHERE id = \\$2 AND currency = \\$3").
+			WithArgs("10.00", "acc-a", "RUB").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		_, err := NewLedgerRepository(db).Post(context.Background(), LedgerTransaction{
+			Operation:       LedgerOperationDeposit,
+			ReferenceID:     "ref1",
+			DebitAccountID:  SystemAccountExternal,
+			CreditAccountID: "acc-a",
+			Amount:          amount,
+		})
+		assert.ErrorContains(t, err, "no RUB account acc-a")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rejects a non-positive amount", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		_, err := NewLedgerRepository(db).Post(context.Background(), LedgerTransaction{
+			Operation:       LedgerOperationDeposit,
+			ReferenceID:     "ref1",
+			DebitAccountID:  SystemAccountExternal,
+			CreditAccountID: "acc-a",
+			Amount:          Money{Currency: "RUB"},
+		})
+		assert.ErrorIs(t, err, ErrInvalidMoney)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestLedgerRepository_GetOrderPayment(t *testing.T) {
+	columns := []string{"account_id", "currency", "charged", "refunded"}
+
+	t.Run("sums payments and refunds", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		mock.ExpectQuery("FROM ledger_entries WHERE reference_id = \\$1 AND account_id NOT LIKE 'system:%'").
+			WithArgs("order1").
+			WillReturnRows(sqlmock.NewRows(columns).AddRow("acc-a", "RUB", "100.00", "25.50"))
+
+		payment, err := NewLedgerRepository(db).GetOrderPayment(context.Background(), "order1")
+		assert.NoError(t, err)
+		assert.Equal(t, &OrderPayment{
+			OrderID:   "order1",
+			AccountID: "acc-a",
+			Charged:   Money{Amount: 10000, Currency: "RUB"},
+			Refunded:  Money{Amount: 2550, Currency: "RUB"},
+		}, payment)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("order without a payment", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		mock.ExpectQuery("FROM ledger_entries").
+			WithArgs("order1").
+			WillReturnError(sql.ErrNoRows)
+
+		payment, err := NewLedgerRepository(db).GetOrderPayment(context.Background(), "order1")
+		assert.NoError(t, err)
+		assert.Nil(t, payment)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+var ledgerEntryColumns = []string{"id", "transaction_id", "account_id", "direction", "amount", "currency", "operation", "reference_id", "created_at"}
+
+func TestLedgerRepository_ListEntries(t *testing.T) {
+	createdAt := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("first page", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		mock.ExpectQuery("WHERE account_id = \\$1 ORDER BY created_at DESC, id DESC LIMIT \\$2").
+			WithArgs("acc-a", 10).
+			WillReturnRows(sqlmock.NewRows(ledgerEntryColumns).
+				AddRow("entry1", "txn1", "acc-a", LedgerCredit, "10.00", "RUB", LedgerOperationDeposit, "ref1", createdAt))
+
+		entries, err := NewLedgerRepository(db).ListEntries(context.Background(), LedgerFilter{AccountID: "acc-a", Limit: 10})
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, Money{Amount: 1000, Currency: "RUB"}, entries[0].Amount)
+			assert.Equal(t, LedgerOperationDeposit, entries[0].Operation)
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("page after a cursor", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		mock.ExpectQuery("WHERE account_id = \\$1 AND \\(created_at, id\\) < \\(\\$2, \\$3\\) ORDER BY created_at DESC, id DESC LIMIT \\$4").
+			WithArgs("acc-a", createdAt, "entry1", 10).
+			WillReturnRows(sqlmock.NewRows(ledgerEntryColumns))
+
+		entries, err := NewLedgerRepository(db).ListEntries(context.Background(), LedgerFilter{
+			AccountID: "acc-a",
+			Cursor:    &LedgerCursor{CreatedAt: createdAt, ID: "entry1"},
+			Limit:     10,
+		})
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestPaymentService_ListTransactions(t *testing.T) {
+	createdAt := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	entries := func(ids ...string) *sqlmock.Rows {
+		rows := sqlmock.NewRows(ledgerEntryColumns)
+		for i, id := range ids {
+			rows.AddRow(id, "txn-"+id, "acc-a", LedgerCredit, "10.00", "RUB", LedgerOperationDeposit, "ref1", createdAt.Add(-time.Duration(i)*time.Minute))
+		}
+		return rows
+	}
+
+	t.Run("sets the next cursor when there are more entries", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		mock.ExpectQuery("FROM accounts WHERE user_id = \\$1").
+			WithArgs("alice").
+			WillReturnRows(accountRow("acc-a", "alice", "30.00"))
+		mock.ExpectQuery("FROM ledger_entries WHERE account_id = \\$1 ORDER BY").
+			WithArgs("acc-a", 3).
+			WillReturnRows(entries("entry1", "entry2", "entry3"))
+
+		page, err := service.ListTransactions(context.Background(), "alice", nil, 2)
+		assert.NoError(t, err)
+		assert.Len(t, page.Transactions, 2)
+
+		cursor, err := DecodeLedgerCursor(page.NextCursor)
+		assert.NoError(t, err)
+		assert.Equal(t, "entry2", cursor.ID)
+		assert.True(t, createdAt.Add(-time.Minute).Equal(cursor.CreatedAt))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("continues after the cursor and ends without one", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+		cursor := &LedgerCursor{CreatedAt: createdAt.Add(-time.Minute), ID: "entry2"}
+
+		mock.ExpectQuery("FROM accounts WHERE user_id = \\$1").
+			WithArgs("alice").
+			WillReturnRows(accountRow("acc-a", "alice", "30.00"))
+		mock.ExpectQuery("FROM ledger_entries WHERE account_id = \\$1 AND \\(created_at, id\\) <").
+			WithArgs("acc-a", cursor.CreatedAt, "entry2", 3).
+			WillReturnRows(entries("entry3"))
+
+		page, err := service.ListTransactions(context.Background(), "alice", cursor, 2)
+		assert.NoError(t, err)
+		assert.Len(t, page.Transactions, 1)
+		assert.Empty(t, page.NextCursor)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown account", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		mock.ExpectQuery("FROM accounts WHERE user_id = \\$1").
+			WithArgs("alice").
+			WillReturnError(sql.ErrNoRows)
+
+		_, err := service.ListTransactions(context.Background(), "alice", nil, 2)
+		assert.ErrorIs(t, err, ErrAccountNotFound)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
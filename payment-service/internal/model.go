@@ -1,35 +1,289 @@
 package internal
 
+import (
+	"fmt"
+	"time"
+)
+
+// Event types carried in the event_type of the envelope of messages exchanged
+// with order-service. Messages without a type are treated as payments, which
+// charge the user at once. Authorize places a hold on the funds, which is
+// later captured or released.
+const (
+	EventTypePayment   = "payment"
+	EventTypeRefund    = "refund"
+	EventTypeAuthorize = "authorize"
+	EventTypeCapture   = "capture"
+	EventTypeRelease   = "release"
+)
+
+type AccountStatus string
+
+const (
+	AccountStatusActive AccountStatus = "ACTIVE"
+	// AccountStatusFrozen blocks every payment, deposit, withdrawal and
+	// transfer until the account is unfrozen.
+	AccountStatusFrozen AccountStatus = "FROZEN"
+	AccountStatusClosed AccountStatus = "CLOSED"
+)
+
+// accountStatusTransitions lists the statuses an account may move to from a
+// given status. A closed account stays closed.
+var accountStatusTransitions = map[AccountStatus][]AccountStatus{
+	AccountStatusActive: {AccountStatusFrozen, AccountStatusClosed},
+	AccountStatusFrozen: {AccountStatusActive, AccountStatusClosed},
+	AccountStatusClosed: {},
+}
+
+// CanTransitionTo reports whether an account in status s may move to next.
+func (s AccountStatus) CanTransitionTo(next AccountStatus) bool {
+	for _, allowed := range accountStatusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Account carries two balances: Balance is the ledger balance, and
+// AvailableBalance is what is left of it after the active holds.
+// StatusReason explains the last status change.
 type Account struct {
-	ID      string  `json:"id" db:"id"`
-	UserID  string  `json:"user_id" db:"user_id"`
-	Balance float64 `json:"balance" db:"balance"`
+	ID               string        `json:"id" db:"id"`
+	UserID           string        `json:"user_id" db:"user_id"`
+	Balance          Money         `json:"balance" db:"balance"`
+	AvailableBalance Money         `json:"available_balance" db:"available_balance"`
+	Status           AccountStatus `json:"status" db:"status"`
+	StatusReason     string        `json:"status_reason,omitempty" db:"status_reason"`
+}
+
+// CheckActive returns an error saying why money cannot be moved on the
+// account when it is frozen or closed.
+func (a *Account) CheckActive() error {
+	var err error
+	switch a.Status {
+	case AccountStatusFrozen:
+		err = ErrAccountFrozen
+	case AccountStatusClosed:
+		err = ErrAccountClosed
+	default:
+		return nil
+	}
+	if a.StatusReason != "" {
+		return fmt.Errorf("%w: %s", err, a.StatusReason)
+	}
+	return err
 }
 
 type PaymentResult struct {
-	Success bool    `json:"success"`
-	Message string  `json:"message"`
-	OrderID string  `json:"order_id"`
-	Amount  float64 `json:"amount,omitempty"`
+	Success  bool   `json:"success"`
+	Message  string `json:"message"`
+	OrderID  string `json:"order_id"`
+	Amount   *Money `json:"amount,omitempty"`
+	RefundID string `json:"refund_id,omitempty"`
+	Partial  bool   `json:"partial,omitempty"`
 }
 
 type PaymentEvent struct {
-	OrderID string  `json:"order_id" db:"order_id"`
-	UserID  string  `json:"user_id" db:"user_id"`
-	Amount  float64 `json:"amount" db:"amount"`
-	Success bool    `json:"success" db:"success"`
+	OrderID string `json:"order_id" db:"order_id"`
+	UserID  string `json:"user_id" db:"user_id"`
+	Amount  Money  `json:"amount" db:"amount"`
+	Success bool   `json:"success" db:"success"`
 }
 
+type OutboxStatus string
+
+const (
+	OutboxStatusPending   OutboxStatus = "PENDING"
+	OutboxStatusProcessed OutboxStatus = "PROCESSED"
+	// OutboxStatusFailed is terminal: the relay gave up on the message and
+	// it stays there until an operator replays or discards it.
+	OutboxStatusFailed    OutboxStatus = "FAILED"
+	OutboxStatusDiscarded OutboxStatus = "DISCARDED"
+)
+
 type OutboxMessage struct {
-	ID        string `json:"id" db:"id"`
-	OrderID   string `json:"order_id" db:"order_id"`
-	Payload   string `json:"payload" db:"payload"`
-	Processed bool   `json:"processed" db:"processed"`
+	ID            string       `json:"id" db:"id"`
+	OrderID       string       `json:"order_id" db:"order_id"`
+	Payload       string       `json:"payload" db:"payload"`
+	Processed     bool         `json:"processed" db:"processed"`
+	Status        OutboxStatus `json:"status" db:"status"`
+	Attempts      int          `json:"attempts" db:"attempts"`
+	LastError     string       `json:"last_error,omitempty" db:"last_error"`
+	NextAttemptAt time.Time    `json:"next_attempt_at" db:"next_attempt_at"`
+	CreatedAt     time.Time    `json:"created_at" db:"created_at"`
 }
 
+// InboxMessage is a payment or refund request received from order-service.
+// ID is the message ID of the envelope, so a redelivered message maps to the
+// same row. Attempts counts the failed attempts to apply it.
 type InboxMessage struct {
-	ID        string `json:"id" db:"id"`
-	OrderID   string `json:"order_id" db:"order_id"`
-	Payload   string `json:"payload" db:"payload"`
-	Processed bool   `json:"processed" db:"processed"`
+	ID         string    `json:"id" db:"id"`
+	EventType  string    `json:"event_type" db:"event_type"`
+	OrderID    string    `json:"order_id" db:"order_id"`
+	Payload    string    `json:"payload" db:"payload"`
+	Processed  bool      `json:"processed" db:"processed"`
+	Attempts   int       `json:"attempts" db:"attempts"`
+	LastError  string    `json:"last_error,omitempty" db:"last_error"`
+	ReceivedAt time.Time `json:"received_at" db:"received_at"`
+}
+
+// Accounts on the other side of customer balance movements. They only exist
+// in the ledger and have no row in accounts.
+const (
+	// SystemAccountExternal is where deposited money comes from.
+	SystemAccountExternal = "system:external"
+	// SystemAccountRevenue receives order payments and pays out refunds.
+	SystemAccountRevenue = "system:revenue"
+)
+
+type LedgerDirection string
+
+const (
+	LedgerDebit  LedgerDirection = "DEBIT"
+	LedgerCredit LedgerDirection = "CREDIT"
+)
+
+type LedgerOperation string
+
+const (
+	LedgerOperationDeposit        LedgerOperation = "DEPOSIT"
+	LedgerOperationWithdrawal     LedgerOperation = "WITHDRAWAL"
+	LedgerOperationOrderPayment   LedgerOperation = "ORDER_PAYMENT"
+	LedgerOperationRefund         LedgerOperation = "REFUND"
+	LedgerOperationTransfer       LedgerOperation = "TRANSFER"
+	LedgerOperationOpeningBalance LedgerOperation = "OPENING_BALANCE"
+)
+
+// LedgerTransaction moves Amount from DebitAccountID to CreditAccountID. It
+// is recorded as a debit and a credit entry of the same amount, so the ledger
+// always balances.
+type LedgerTransaction struct {
+	Operation       LedgerOperation
+	ReferenceID     string
+	DebitAccountID  string
+	CreditAccountID string
+	Amount          Money
+}
+
+// LedgerEntry is one side of a ledger transaction. ReferenceID is the order
+// for payments and refunds, the transfer ID for transfers and the operation
+// ID for deposits and withdrawals.
+type LedgerEntry struct {
+	ID            string          `json:"id" db:"id"`
+	TransactionID string          `json:"transaction_id" db:"transaction_id"`
+	AccountID     string          `json:"account_id" db:"account_id"`
+	Direction     LedgerDirection `json:"direction" db:"direction"`
+	Amount        Money           `json:"amount" db:"amount"`
+	Operation     LedgerOperation `json:"operation" db:"operation"`
+	ReferenceID   string          `json:"reference_id" db:"reference_id"`
+	CreatedAt     time.Time       `json:"created_at" db:"created_at"`
+}
+
+// OrderPayment sums up the ledger entries of an order: what was charged from
+// the customer account and how much of it has been refunded since.
+type OrderPayment struct {
+	OrderID   string
+	AccountID string
+	Charged   Money
+	Refunded  Money
+}
+
+// Refundable returns the part of the payment that has not been refunded yet.
+func (p *OrderPayment) Refundable() (Money, error) {
+	return p.Charged.Sub(p.Refunded)
+}
+
+type Refund struct {
+	ID        string    `json:"id" db:"id"`
+	OrderID   string    `json:"order_id" db:"order_id"`
+	AccountID string    `json:"account_id" db:"account_id"`
+	Amount    Money     `json:"amount" db:"amount"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Transfer is a movement of money from one user's account to another's.
+type Transfer struct {
+	ID            string    `json:"id" db:"id"`
+	FromAccountID string    `json:"from_account_id" db:"from_account_id"`
+	ToAccountID   string    `json:"to_account_id" db:"to_account_id"`
+	Amount        Money     `json:"amount" db:"amount"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+}
+
+type HoldStatus string
+
+const (
+	HoldStatusActive   HoldStatus = "ACTIVE"
+	HoldStatusCaptured HoldStatus = "CAPTURED"
+	HoldStatusReleased HoldStatus = "RELEASED"
+	HoldStatusExpired  HoldStatus = "EXPIRED"
+)
+
+// Hold reserves funds on an account for an order. It lowers the available
+// balance but not the ledger balance until it is captured. A payment taken
+// at once is recorded as a hold that is captured right away.
+//
+// Amount is in the account currency. When the order is priced in another
+// currency, OrderAmount keeps the original price and ExchangeRate the rate
+// it was converted at.
+type Hold struct {
+	ID           string     `json:"id" db:"id"`
+	OrderID      string     `json:"order_id" db:"order_id"`
+	AccountID    string     `json:"account_id" db:"account_id"`
+	Amount       Money      `json:"amount" db:"amount"`
+	OrderAmount  Money      `json:"order_amount" db:"order_amount"`
+	ExchangeRate string     `json:"exchange_rate,omitempty" db:"exchange_rate"`
+	Status       HoldStatus `json:"status" db:"status"`
+	ExpiresAt    time.Time  `json:"expires_at" db:"expires_at"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+}
+
+// IsActive reports whether the hold still reserves funds at now. A hold past
+// its expiry time no longer does, even before it is marked as expired.
+func (h *Hold) IsActive(now time.Time) bool {
+	return h.Status == HoldStatusActive && now.Before(h.ExpiresAt)
+}
+
+// SpendingLimits caps what can be spent on orders from an account, in the
+// account currency. A nil limit means there is no limit of that kind. Daily
+// and monthly limits apply to calendar days and months in UTC.
+type SpendingLimits struct {
+	AccountID      string    `json:"account_id" db:"account_id"`
+	PerTransaction *Money    `json:"per_transaction,omitempty" db:"per_transaction"`
+	Daily          *Money    `json:"daily,omitempty" db:"daily"`
+	Monthly        *Money    `json:"monthly,omitempty" db:"monthly"`
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Check returns ErrSpendingLimitExceeded when spending amount on top of what
+// has already been spent today and this month would breach one of the limits.
+func (l *SpendingLimits) Check(amount, spentToday, spentThisMonth Money) error {
+	if err := checkLimit("per-transaction", l.PerTransaction, amount, Money{Currency: amount.Currency}); err != nil {
+		return err
+	}
+	if err := checkLimit("daily", l.Daily, amount, spentToday); err != nil {
+		return err
+	}
+	return checkLimit("monthly", l.Monthly, amount, spentThisMonth)
+}
+
+func checkLimit(name string, limit *Money, amount, spent Money) error {
+	if limit == nil {
+		return nil
+	}
+	// spent can be larger than any single amount, so it is compared with
+	// what is left of the limit instead of being added to amount.
+	left, err := limit.Sub(amount)
+	if err != nil {
+		return err
+	}
+	cmp, err := spent.Cmp(left)
+	if err != nil {
+		return err
+	}
+	if cmp > 0 {
+		return fmt.Errorf("%w: %s limit is %s, already spent %s", ErrSpendingLimitExceeded, name, limit, spent)
+	}
+	return nil
 }
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpendingLimits_Check(t *testing.T) {
+	rub := func(amount int64) *Money {
+		return &Money{Amount: amount, Currency: "RUB"}
+	}
+
+	tests := []struct {
+		name           string
+		limits         SpendingLimits
+		amount         int64
+		spentToday     int64
+		spentThisMonth int64
+		wantErr        bool
+	}{
+		{name: "no limits", amount: 1000000, spentToday: 1000000, spentThisMonth: 1000000},
+		{name: "per-transaction limit reached", limits: SpendingLimits{PerTransaction: rub(1000)}, amount: 1000},
+		{name: "per-transaction limit exceeded", limits: SpendingLimits{PerTransaction: rub(1000)}, amount: 1001, wantErr: true},
+		{name: "per-transaction limit ignores earlier spending", limits: SpendingLimits{PerTransaction: rub(1000)}, amount: 1000, spentToday: 5000, spentThisMonth: 5000},
+		{name: "daily limit reached", limits: SpendingLimits{Daily: rub(5000)}, amount: 1000, spentToday: 4000},
+		{name: "daily limit exceeded", limits: SpendingLimits{Daily: rub(5000)}, amount: 1000, spentToday: 4001, wantErr: true},
+		{name: "daily limit exceeded by the amount alone", limits: SpendingLimits{Daily: rub(5000)}, amount: 5001, wantErr: true},
+		{name: "monthly limit reached", limits: SpendingLimits{Monthly: rub(50000)}, amount: 1000, spentThisMonth: 49000},
+		{name: "monthly limit exceeded", limits: SpendingLimits{Monthly: rub(50000)}, amount: 1000, spentThisMonth: 49001, wantErr: true},
+		{
+			name:           "monthly spending above the amount columns",
+			limits:         SpendingLimits{Monthly: rub(9999999999)},
+			amount:         1000,
+			spentThisMonth: 100000000000000,
+			wantErr:        true,
+		},
+		{
+			name:           "all limits reached",
+			limits:         SpendingLimits{PerTransaction: rub(1000), Daily: rub(5000), Monthly: rub(50000)},
+			amount:         1000,
+			spentToday:     4000,
+			spentThisMonth: 49000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.Check(*rub(tt.amount), *rub(tt.spentToday), *rub(tt.spentThisMonth))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrSpendingLimitExceeded)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestOrderPayment_Refundable(t *testing.T) {
+	tests := []struct {
+		name     string
+		charged  Money
+		refunded Money
+		want     Money
+		wantErr  error
+	}{
+		{
+			name:     "nothing refunded",
+			charged:  Money{Amount: 1000, Currency: "RUB"},
+			refunded: Money{Amount: 0, Currency: "RUB"},
+			want:     Money{Amount: 1000, Currency: "RUB"},
+		},
+		{
+			name:     "partly refunded",
+			charged:  Money{Amount: 1000, Currency: "RUB"},
+			refunded: Money{Amount: 250, Currency: "RUB"},
+			want:     Money{Amount: 750, Currency: "RUB"},
+		},
+		{
+			name:     "fully refunded",
+			charged:  Money{Amount: 1000, Currency: "RUB"},
+			refunded: Money{Amount: 1000, Currency: "RUB"},
+			want:     Money{Amount: 0, Currency: "RUB"},
+		},
+		{
+			name:     "refunded in another currency",
+			charged:  Money{Amount: 1000, Currency: "RUB"},
+			refunded: Money{Amount: 100, Currency: "USD"},
+			wantErr:  ErrCurrencyMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payment := OrderPayment{OrderID: "order1", Charged: tt.charged, Refunded: tt.refunded}
+			got, err := payment.Refundable()
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type OutboxHandler struct {
+	service OutboxService
+}
+
+func NewOutboxHandler(service OutboxService) *OutboxHandler {
+	return &OutboxHandler{service: service}
+}
+
+func (h *OutboxHandler) ListFailedMessages(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	messages, err := h.service.ListFailedMessages(r.Context(), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []*OutboxMessage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+func (h *OutboxHandler) ReplayMessage(w http.ResponseWriter, r *http.Request) {
+	h.handleFailedMessage(w, r, h.service.ReplayMessage)
+}
+
+func (h *OutboxHandler) DiscardMessage(w http.ResponseWriter, r *http.Request) {
+	h.handleFailedMessage(w, r, h.service.DiscardMessage)
+}
+
+func (h *OutboxHandler) handleFailedMessage(w http.ResponseWriter, r *http.Request, action func(ctx context.Context, id string) error) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		http.Error(w, "message id is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := action(r.Context(), id); err != nil {
+		if errors.Is(err, ErrOutboxMessageNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RetryPolicy decides when a message that failed to publish is tried again
+// and when the relay gives up on it.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// NextDelay returns the exponential backoff before the attempt that follows
+// the given number of failed attempts.
+func (p RetryPolicy) NextDelay(failedAttempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < failedAttempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// OutboxService exposes the dead-lettered outbox messages to operators.
+type OutboxService interface {
+	ListFailedMessages(ctx context.Context, limit int) ([]*OutboxMessage, error)
+	ReplayMessage(ctx context.Context, id string) error
+	DiscardMessage(ctx context.Context, id string) error
+}
+
+type outboxService struct {
+	outboxRepo OutboxRepository
+}
+
+func NewOutboxService(outboxRepo OutboxRepository) OutboxService {
+	return &outboxService{outboxRepo: outboxRepo}
+}
+
+func (s *outboxService) ListFailedMessages(ctx context.Context, limit int) ([]*OutboxMessage, error) {
+	messages, err := s.outboxRepo.GetFailedMessages(ctx, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get failed outbox messages: %w", err)
+	}
+	return messages, nil
+}
+
+func (s *outboxService) ReplayMessage(ctx context.Context, id string) error {
+	return s.outboxRepo.ReplayFailedMessage(ctx, id)
+}
+
+func (s *outboxService) DiscardMessage(ctx context.Context, id string) error {
+	return s.outboxRepo.DiscardFailedMessage(ctx, id)
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLedgerPageSize = 50
+	maxLedgerPageSize     = 200
+)
+
+// LedgerFilter selects a page of the entries of one account, newest first.
+type LedgerFilter struct {
+	AccountID string
+	Cursor    *LedgerCursor
+	Limit     int
+}
+
+type LedgerPage struct {
+	Transactions []*LedgerEntry `json:"transactions"`
+	NextCursor   string         `json:"next_cursor,omitempty"`
+}
+
+// LedgerCursor points at the last entry of a page. Entries are sorted by
+// creation time with the id as a tie breaker.
+type LedgerCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func (c LedgerCursor) Encode() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeLedgerCursor(cursor string) (*LedgerCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidLedgerFilter)
+	}
+
+	createdAt, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidLedgerFilter)
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidLedgerFilter)
+	}
+	return &LedgerCursor{CreatedAt: t, ID: id}, nil
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// ParkedMessageQueue gives operators access to the messages parked after
+// they could not be handled.
+type ParkedMessageQueue interface {
+	ListParked(ctx context.Context, limit int) ([]*ParkedMessage, error)
+	RedriveParked(ctx context.Context, limit int) (int, error)
+}
+
+type ParkingHandler struct {
+	queue ParkedMessageQueue
+}
+
+func NewParkingHandler(queue ParkedMessageQueue) *ParkingHandler {
+	return &ParkingHandler{queue: queue}
+}
+
+func (h *ParkingHandler) ListParkedMessages(w http.ResponseWriter, r *http.Request) {
+	limit, ok := parkingLimit(w, r)
+	if !ok {
+		return
+	}
+
+	messages, err := h.queue.ListParked(r.Context(), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []*ParkedMessage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+func (h *ParkingHandler) RedriveParkedMessages(w http.ResponseWriter, r *http.Request) {
+	limit, ok := parkingLimit(w, r)
+	if !ok {
+		return
+	}
+
+	redriven, err := h.queue.RedriveParked(r.Context(), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"redriven": redriven})
+}
+
+func parkingLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return 0, false
+		}
+		limit = parsed
+	}
+	return limit, true
+}
@@ -2,80 +2,12 @@ package internal
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"time"
 
 	amqp "github.com/streadway/amqp"
 )
 
-type RabbitMQ struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
-	url     string
-}
-
-func NewRabbitMQ(url string) (*RabbitMQ, error) {
-	var conn *amqp.Connection
-	var err error
-
-	retryDelay := 5 * time.Second
-	maxRetries := 10
-
-	for i := 0; i < maxRetries; i++ {
-		conn, err = amqp.Dial(url)
-		if err == nil {
-			break
-		}
-
-		log.Printf("Attempt %d/%d: Failed to connect to RabbitMQ at %s: %v",
-			i+1, maxRetries, url, err)
-
-		if i == maxRetries-1 {
-			return nil, fmt.Errorf("failed after %d attempts: %w", maxRetries, err)
-		}
-
-		time.Sleep(retryDelay)
-	}
-
-	ch, err := conn.Channel()
-	if err != nil {
-		return nil, fmt.Errorf("failed to open channel: %w", err)
-	}
-
-	err = ch.ExchangeDeclare(
-		"payments",
-		"direct",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to declare exchange: %w", err)
-	}
-
-	log.Println("Successfully connected to RabbitMQ")
-
-	return &RabbitMQ{
-		conn:    conn,
-		channel: ch,
-		url:     url,
-	}, nil
-}
-
-func (r *RabbitMQ) Close() error {
-	if err := r.channel.Close(); err != nil {
-		return fmt.Errorf("failed to close channel: %w", err)
-	}
-	if err := r.conn.Close(); err != nil {
-		return fmt.Errorf("failed to close connection: %w", err)
-	}
-	return nil
-}
-
 type RabbitMQPaymentQueue struct {
 	rabbitMQ     *RabbitMQ
 	exchangeName string
@@ -97,54 +29,54 @@ func NewRabbitMQPaymentQueue(
 	}
 }
 
-func (q *RabbitMQPaymentQueue) PublishPaymentRequest(ctx context.Context, message []byte) error {
-	err := q.rabbitMQ.channel.Publish(
-		q.exchangeName,
-		q.routingKey,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        message,
-		},
-	)
+// PublishPaymentRequest publishes message with the given AMQP message ID and
+// returns once the broker has confirmed it. The outbox message ID is used, so
+// order-service can recognise a result that is published again after a
+// failure.
+func (q *RabbitMQPaymentQueue) PublishPaymentRequest(ctx context.Context, messageID string, message []byte) error {
+	err := q.rabbitMQ.Publish(ctx, q.exchangeName, q.routingKey, amqp.Publishing{
+		ContentType:  "application/json",
+		MessageId:    messageID,
+		DeliveryMode: amqp.Persistent,
+		Body:         message,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to publish message: %w", err)
 	}
 	return nil
 }
 
+// SubscribeToPaymentUpdates passes every received request to callback as an
+// inbox message keyed by its AMQP message ID. Messages published without an
+// ID get one derived from their type and order, so that at most one payment
+// and one refund is taken from them per order. A request is acknowledged only
+// once callback has returned, and at most config.Prefetch requests are
+// delivered before they are acknowledged. Failed requests are retried or
+// parked as described by config.Retry.
 func (q *RabbitMQPaymentQueue) SubscribeToPaymentUpdates(
 	ctx context.Context,
-	callback func(orderID, userID string, amount float64),
+	config ConsumerConfig,
+	callback func(msg *InboxMessage) error,
 ) error {
-	_, err := q.rabbitMQ.channel.QueueDeclare(
-		q.queueName,
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to declare queue: %w", err)
+	// The consumer is set up again on the new channel after a reconnect.
+	return q.rabbitMQ.Setup(func(ch *amqp.Channel) error {
+		return q.consume(ctx, ch, config, callback)
+	})
+}
+
+func (q *RabbitMQPaymentQueue) consume(ctx context.Context, ch *amqp.Channel, config ConsumerConfig, callback func(msg *InboxMessage) error) error {
+	if err := ch.Qos(config.Prefetch, 0, false); err != nil {
+		return fmt.Errorf("failed to set prefetch: %w", err)
 	}
 
-	err = q.rabbitMQ.channel.QueueBind(
-		q.queueName,
-		q.routingKey,
-		q.exchangeName,
-		false,
-		nil,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to bind queue: %w", err)
+	if err := q.declareConsumerTopology(ch, config.Retry); err != nil {
+		return err
 	}
 
-	msgs, err := q.rabbitMQ.channel.Consume(
+	msgs, err := ch.Consume(
 		q.queueName,
 		"",
-		true,
+		false,
 		false,
 		false,
 		false,
@@ -164,21 +96,62 @@ func (q *RabbitMQPaymentQueue) SubscribeToPaymentUpdates(
 					return
 				}
 
-				var request struct {
-					OrderID string  `json:"order_id"`
-					UserID  string  `json:"user_id"`
-					Amount  float64 `json:"amount"`
-				}
-
-				if err := json.Unmarshal(msg.Body, &request); err != nil {
-					log.Printf("Failed to unmarshal payment request: %v", err)
+				inboxMessage, err := decodeInboxMessage(msg)
+				if err != nil {
+					q.settleDelivery(ctx, msg, config.Retry, err)
 					continue
 				}
 
-				callback(request.OrderID, request.UserID, request.Amount)
+				q.settleDelivery(ctx, msg, config.Retry, callback(inboxMessage))
 			}
 		}
 	}()
 
 	return nil
 }
+
+// decodeInboxMessage reads the envelope of a received request. The message is
+// stored under the message ID of its envelope, falling back to the AMQP
+// message ID and then to its type and order for legacy messages.
+func decodeInboxMessage(msg amqp.Delivery) (*InboxMessage, error) {
+	envelope, err := DecodeEventEnvelope(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch envelope.EventType {
+	case EventTypePayment, EventTypeRefund, EventTypeAuthorize, EventTypeCapture, EventTypeRelease:
+	default:
+		return nil, fmt.Errorf("%w: unknown event type %q", ErrUnprocessableMessage, envelope.EventType)
+	}
+
+	var request PaymentRequest
+	if err := envelope.DecodePayload(&request); err != nil {
+		return nil, err
+	}
+	if request.OrderID == "" {
+		return nil, fmt.Errorf("%w: payment request without an order id", ErrUnprocessableMessage)
+	}
+
+	messageID := envelope.MessageID
+	if messageID == "" {
+		messageID = msg.MessageId
+	}
+	if messageID == "" {
+		messageID = envelope.EventType + ":" + request.OrderID
+	}
+
+	return &InboxMessage{
+		ID:        messageID,
+		EventType: envelope.EventType,
+		OrderID:   request.OrderID,
+		Payload:   string(msg.Body),
+	}, nil
+}
+
+// isPermanentFailure reports whether handling a request failed in a way that
+// would not change if the request were delivered again.
+func isPermanentFailure(err error) bool {
+	return errors.Is(err, ErrUnprocessableMessage) ||
+		errors.Is(err, ErrUnsupportedSchemaVersion)
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+type RefundRepository interface {
+	CreateRefund(ctx context.Context, refund *Refund) error
+	GetRefund(ctx context.Context, id string) (*Refund, error)
+}
+
+type refundRepository struct {
+	db DBTX
+}
+
+func NewRefundRepository(db *sql.DB) RefundRepository {
+	return &refundRepository{db: db}
+}
+
+// NewRefundRepositoryTx returns a repository whose operations all run inside
+// tx. Committing or rolling back tx is up to the caller.
+func NewRefundRepositoryTx(tx *sql.Tx) RefundRepository {
+	return &refundRepository{db: tx}
+}
+
+func (r *refundRepository) CreateRefund(ctx context.Context, refund *Refund) error {
+	return r.db.QueryRowContext(ctx,
+		"INSERT INTO refunds (id, order_id, account_id, amount, currency) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		refund.ID, refund.OrderID, refund.AccountID, refund.Amount.Decimal(), refund.Amount.Currency).
+		Scan(&refund.CreatedAt)
+}
+
+func (r *refundRepository) GetRefund(ctx context.Context, id string) (*Refund, error) {
+	var refund Refund
+	var amount, currency string
+	err := r.db.QueryRowContext(ctx,
+		"SELECT id, order_id, account_id, amount, currency, created_at FROM refunds WHERE id = $1", id).
+		Scan(&refund.ID, &refund.OrderID, &refund.AccountID, &amount, &currency, &refund.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if refund.Amount, err = ParseMoney(amount, currency); err != nil {
+		return nil, fmt.Errorf("failed to read amount of refund %s: %w", refund.ID, err)
+	}
+	return &refund, nil
+}
@@ -7,77 +7,401 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 type PaymentService interface {
-	CreateAccount(ctx context.Context, userID string) (*Account, error)
+	CreateAccount(ctx context.Context, userID, currency string) (*Account, error)
 	GetAccount(ctx context.Context, userID string) (*Account, error)
-	Deposit(ctx context.Context, userID string, amount float64) error
-	ProcessOrderPayment(ctx context.Context, orderID, userID string, amount float64) (*PaymentResult, error)
+	Deposit(ctx context.Context, userID string, amount Money) error
+	Withdraw(ctx context.Context, userID string, amount Money) error
+	Transfer(ctx context.Context, transferID, fromUserID, toUserID string, amount Money) (*Transfer, error)
+	SetAccountStatus(ctx context.Context, userID string, status AccountStatus, reason string) (*Account, error)
+	SetSpendingLimits(ctx context.Context, userID string, limits SpendingLimits) (*SpendingLimits, error)
+	ListTransactions(ctx context.Context, userID string, cursor *LedgerCursor, limit int) (*LedgerPage, error)
+	ProcessOrderPayment(ctx context.Context, orderID, userID string, amount Money) (*PaymentResult, error)
+	RefundPayment(ctx context.Context, refundID, orderID string, amount *Money) (*Refund, error)
+	ReceivePaymentRequest(ctx context.Context, msg *InboxMessage) error
+	ProcessInboxMessages(ctx context.Context, limit int) (int, error)
+	ExpireHolds(ctx context.Context, limit int) (int, error)
 }
 
 type paymentService struct {
 	db          *sql.DB
 	accountRepo AccountRepository
 	inboxRepo   InboxRepository
-	queue       *RabbitMQPaymentQueue
+	ledgerRepo  LedgerRepository
+	holdTTL     time.Duration
+	inboxRetry  RetryPolicy
 }
 
+// NewPaymentService creates the service. A stored request that fails to
+// apply is tried again as described by inboxRetry and answered with a failed
+// result once it has used up inboxRetry.MaxAttempts.
 func NewPaymentService(
 	db *sql.DB,
 	accountRepo AccountRepository,
 	inboxRepo InboxRepository,
-	queue *RabbitMQPaymentQueue,
+	ledgerRepo LedgerRepository,
+	holdTTL time.Duration,
+	inboxRetry RetryPolicy,
 ) PaymentService {
 	return &paymentService{
 		db:          db,
 		accountRepo: accountRepo,
 		inboxRepo:   inboxRepo,
-		queue:       queue,
+		ledgerRepo:  ledgerRepo,
+		holdTTL:     holdTTL,
+		inboxRetry:  inboxRetry,
+	}
+}
+
+// CreateAccount opens an account in the given currency, or in the default
+// currency when none is given. The currency of an account never changes.
+func (s *paymentService) CreateAccount(ctx context.Context, userID, currency string) (*Account, error) {
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	if _, err := currencyExponent(currency); err != nil {
+		return nil, err
 	}
+	return s.accountRepo.CreateAccount(ctx, userID, currency)
+}
+
+func (s *paymentService) GetAccount(ctx context.Context, userID string) (*Account, error) {
+	return s.accountRepo.GetAccountByUserID(ctx, userID)
+}
+
+func (s *paymentService) Deposit(ctx context.Context, userID string, amount Money) error {
+	return s.moveFunds(ctx, userID, amount, func(account *Account) (LedgerTransaction, error) {
+		if _, err := account.Balance.Add(amount); err != nil {
+			return LedgerTransaction{}, err
+		}
+		return LedgerTransaction{
+			Operation:       LedgerOperationDeposit,
+			ReferenceID:     uuid.New().String(),
+			DebitAccountID:  SystemAccountExternal,
+			CreditAccountID: account.ID,
+			Amount:          amount,
+		}, nil
+	})
+}
+
+func (s *paymentService) Withdraw(ctx context.Context, userID string, amount Money) error {
+	return s.moveFunds(ctx, userID, amount, func(account *Account) (LedgerTransaction, error) {
+		cmp, err := account.AvailableBalance.Cmp(amount)
+		if err != nil {
+			return LedgerTransaction{}, err
+		}
+		if cmp < 0 {
+			return LedgerTransaction{}, fmt.Errorf("%w: available balance is %s", ErrInsufficientFunds, account.AvailableBalance)
+		}
+		return LedgerTransaction{
+			Operation:       LedgerOperationWithdrawal,
+			ReferenceID:     uuid.New().String(),
+			DebitAccountID:  account.ID,
+			CreditAccountID: SystemAccountExternal,
+			Amount:          amount,
+		}, nil
+	})
 }
 
-func (s *paymentService) CreateAccount(ctx context.Context, userID string) (*Account, error) {
-	account, err := s.accountRepo.GetAccountByUserID(ctx, userID)
+// moveFunds locks the user's account and posts the ledger transaction built
+// by posting for it. It is shared by deposits and withdrawals, which move
+// money between the account and the outside world.
+func (s *paymentService) moveFunds(ctx context.Context, userID string, amount Money, posting func(account *Account) (LedgerTransaction, error)) error {
+	if !amount.IsPositive() {
+		return fmt.Errorf("%w: amount must be positive", ErrInvalidMoney)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	account, err := NewAccountRepositoryTx(tx).LockAccountByUserID(ctx, userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check account existence: %w", err)
+		return err
+	}
+	if err := account.CheckActive(); err != nil {
+		return err
 	}
-	if account != nil {
-		return nil, errors.New("account already exists")
+	if account.Balance.Currency != amount.Currency {
+		return fmt.Errorf("%w: account is in %s", ErrCurrencyMismatch, account.Balance.Currency)
 	}
 
-	return s.accountRepo.CreateAccount(ctx, userID)
+	txn, err := posting(account)
+	if err != nil {
+		return err
+	}
+	if _, err := NewLedgerRepositoryTx(tx).Post(ctx, txn); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
 }
 
-func (s *paymentService) GetAccount(ctx context.Context, userID string) (*Account, error) {
-	account, err := s.accountRepo.GetAccountByUserID(ctx, userID)
+// Transfer moves amount from one user's account to another's. A repeated
+// call with the same transfer ID returns the transfer made by the first call.
+func (s *paymentService) Transfer(ctx context.Context, transferID, fromUserID, toUserID string, amount Money) (*Transfer, error) {
+	if transferID == "" {
+		return nil, fmt.Errorf("%w: transfer id is required", ErrInvalidTransfer)
+	}
+	if fromUserID == "" || toUserID == "" {
+		return nil, fmt.Errorf("%w: both users are required", ErrInvalidTransfer)
+	}
+	if fromUserID == toUserID {
+		return nil, fmt.Errorf("%w: cannot transfer to the same account", ErrInvalidTransfer)
+	}
+	if !amount.IsPositive() {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidMoney)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	from, to, err := lockTransferAccounts(ctx, NewAccountRepositoryTx(tx), fromUserID, toUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	transfers := NewTransferRepositoryTx(tx)
+	existing, err := transfers.GetTransfer(ctx, transferID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer: %w", err)
+	}
+	if existing != nil {
+		return replayTransfer(existing, from, to, amount)
+	}
+
+	if err := from.CheckActive(); err != nil {
+		return nil, err
+	}
+	if err := to.CheckActive(); err != nil {
+		return nil, err
+	}
+	if from.Balance.Currency != amount.Currency || to.Balance.Currency != amount.Currency {
+		return nil, fmt.Errorf("%w: accounts are in %s and %s", ErrCurrencyMismatch, from.Balance.Currency, to.Balance.Currency)
+	}
+	cmp, err := from.AvailableBalance.Cmp(amount)
+	if err != nil {
+		return nil, err
+	}
+	if cmp < 0 {
+		return nil, fmt.Errorf("%w: available balance is %s", ErrInsufficientFunds, from.AvailableBalance)
+	}
+	if _, err := to.Balance.Add(amount); err != nil {
+		return nil, err
+	}
+
+	// A concurrent request with the same ID between other accounts is not
+	// held back by the account locks, so the insert can still find the ID
+	// taken. The transfer is stored before the money moves so that the
+	// losing request never posts to the ledger.
+	transfer := &Transfer{ID: transferID, FromAccountID: from.ID, ToAccountID: to.ID, Amount: amount}
+	created, err := transfers.CreateTransfer(ctx, transfer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transfer: %w", err)
+	}
+	if !created {
+		existing, err := transfers.GetTransfer(ctx, transferID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get transfer: %w", err)
+		}
+		if existing == nil {
+			return nil, fmt.Errorf("failed to get transfer %s after a conflicting insert", transferID)
+		}
+		return replayTransfer(existing, from, to, amount)
+	}
+
+	_, err = NewLedgerRepositoryTx(tx).Post(ctx, LedgerTransaction{
+		Operation:       LedgerOperationTransfer,
+		ReferenceID:     transferID,
+		DebitAccountID:  from.ID,
+		CreditAccountID: to.ID,
+		Amount:          amount,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get account: %w", err)
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
-	if account == nil {
-		return nil, errors.New("account not found")
+	return transfer, nil
+}
+
+// replayTransfer answers a repeated transfer ID with the stored transfer, or
+// with ErrTransferConflict when the request differs from it.
+func replayTransfer(existing *Transfer, from, to *Account, amount Money) (*Transfer, error) {
+	if existing.FromAccountID != from.ID || existing.ToAccountID != to.ID || existing.Amount != amount {
+		return nil, ErrTransferConflict
+	}
+	return existing, nil
+}
+
+// lockTransferAccounts locks both accounts of a transfer in the order of their
+// IDs, so that two opposite transfers between the same users cannot deadlock.
+func lockTransferAccounts(ctx context.Context, accounts AccountRepository, fromUserID, toUserID string) (*Account, *Account, error) {
+	from, err := accounts.GetAccountByUserID(ctx, fromUserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	to, err := accounts.GetAccountByUserID(ctx, toUserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := []string{from.ID, to.ID}
+	sort.Strings(ids)
+
+	locked := make(map[string]*Account, len(ids))
+	for _, id := range ids {
+		if locked[id], err = accounts.LockAccountByID(ctx, id); err != nil {
+			return nil, nil, err
+		}
+	}
+	return locked[from.ID], locked[to.ID], nil
+}
+
+// SetAccountStatus freezes, unfreezes or closes the user's account. Only an
+// account without money on it and without active holds can be closed.
+func (s *paymentService) SetAccountStatus(ctx context.Context, userID string, status AccountStatus, reason string) (*Account, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	accounts := NewAccountRepositoryTx(tx)
+	account, err := accounts.LockAccountByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !account.Status.CanTransitionTo(status) {
+		return nil, fmt.Errorf("%w: account is %s", ErrAccountStatusConflict, strings.ToLower(string(account.Status)))
+	}
+	if status == AccountStatusClosed && (!account.Balance.IsZero() || !account.AvailableBalance.IsZero()) {
+		return nil, fmt.Errorf("%w: account still holds %s", ErrAccountStatusConflict, account.Balance)
+	}
+
+	if err := accounts.UpdateAccountStatus(ctx, account.ID, status, reason); err != nil {
+		return nil, err
+	}
+	account.Status = status
+	account.StatusReason = reason
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 	return account, nil
 }
 
-func (s *paymentService) Deposit(ctx context.Context, userID string, amount float64) error {
-	if amount <= 0 {
-		return errors.New("amount must be positive")
+// SetSpendingLimits replaces the spending limits of the user's account. The
+// limits are in the account currency; a nil limit removes that limit.
+func (s *paymentService) SetSpendingLimits(ctx context.Context, userID string, limits SpendingLimits) (*SpendingLimits, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	account, err := s.accountRepo.GetAccountByUserID(ctx, userID)
+	// The account is locked so that the limits cannot change while a payment
+	// from it is being checked against them.
+	account, err := NewAccountRepositoryTx(tx).LockAccountByUserID(ctx, userID)
 	if err != nil {
-		return fmt.Errorf("failed to check account existence: %w", err)
+		return nil, err
 	}
-	if account == nil {
-		return errors.New("account not found")
+	for _, limit := range []*Money{limits.PerTransaction, limits.Daily, limits.Monthly} {
+		if limit == nil {
+			continue
+		}
+		if limit.Currency != account.Balance.Currency {
+			return nil, fmt.Errorf("%w: account is in %s", ErrInvalidSpendingLimit, account.Balance.Currency)
+		}
+		if !limit.IsPositive() {
+			return nil, fmt.Errorf("%w: limits must be positive", ErrInvalidSpendingLimit)
+		}
 	}
 
-	return s.accountRepo.Deposit(ctx, userID, amount)
+	limits.AccountID = account.ID
+	if err := NewSpendingLimitRepositoryTx(tx).UpsertLimits(ctx, &limits); err != nil {
+		return nil, fmt.Errorf("failed to set spending limits: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &limits, nil
 }
 
-func (s *paymentService) ProcessOrderPayment(ctx context.Context, orderID, userID string, amount float64) (*PaymentResult, error) {
-	log.Printf("Processing payment: OrderID=%s, UserID=%s, Amount=%.2f", orderID, userID, amount)
+func (s *paymentService) ListTransactions(ctx context.Context, userID string, cursor *LedgerCursor, limit int) (*LedgerPage, error) {
+	account, err := s.GetAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit <= 0 {
+		limit = defaultLedgerPageSize
+	}
+	if limit > maxLedgerPageSize {
+		limit = maxLedgerPageSize
+	}
+
+	// Ask for one extra entry to find out whether there is a next page.
+	entries, err := s.ledgerRepo.ListEntries(ctx, LedgerFilter{
+		AccountID: account.ID,
+		Cursor:    cursor,
+		Limit:     limit + 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list transactions: %w", err)
+	}
+
+	page := &LedgerPage{Transactions: entries}
+	if len(entries) > limit {
+		page.Transactions = entries[:limit]
+		last := page.Transactions[limit-1]
+		page.NextCursor = LedgerCursor{CreatedAt: last.CreatedAt, ID: last.ID}.Encode()
+	}
+	if page.Transactions == nil {
+		page.Transactions = []*LedgerEntry{}
+	}
+	return page, nil
+}
+
+func (s *paymentService) ProcessOrderPayment(ctx context.Context, orderID, userID string, amount Money) (*PaymentResult, error) {
+	return s.applyInTx(ctx, EventTypePayment, func(tx *sql.Tx) (*PaymentResult, error) {
+		return chargeAccount(ctx, tx, orderID, userID, amount)
+	})
+}
+
+// RefundPayment gives back amount of the payment taken for an order, or all
+// of what has not been refunded yet when amount is nil. A repeated call with
+// the same refund ID returns the refund made by the first call. Nothing is
+// refunded to a frozen or closed account. The refund is announced to
+// order-service through the outbox.
+func (s *paymentService) RefundPayment(ctx context.Context, refundID, orderID string, amount *Money) (*Refund, error) {
+	if refundID == "" {
+		return nil, fmt.Errorf("%w: refund id is required", ErrInvalidRefund)
+	}
+	if orderID == "" {
+		return nil, fmt.Errorf("%w: order id is required", ErrInvalidRefund)
+	}
+	if amount != nil && !amount.IsPositive() {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidRefund)
+	}
 
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -85,76 +409,676 @@ func (s *paymentService) ProcessOrderPayment(ctx context.Context, orderID, userI
 	}
 	defer tx.Rollback()
 
-	var accountID string
-	var balance float64
-	err = tx.QueryRowContext(ctx,
-		"SELECT id, balance FROM accounts WHERE user_id = $1 FOR UPDATE",
-		userID).Scan(&accountID, &balance)
+	payment, account, err := lockOrderPayment(ctx, tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if payment == nil {
+		return nil, ErrPaymentNotFound
+	}
 
+	existing, err := NewRefundRepositoryTx(tx).GetRefund(ctx, refundID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			result := &PaymentResult{
-				OrderID: orderID,
-				Success: false,
-				Message: "account not found",
-			}
-			if err := s.sendPaymentResponse(ctx, result); err != nil {
-				log.Printf("Failed to send payment response: %v", err)
-			}
-			return result, nil
+		return nil, fmt.Errorf("failed to get refund: %w", err)
+	}
+	if existing != nil {
+		if existing.OrderID != orderID || (amount != nil && *amount != existing.Amount) {
+			return nil, ErrRefundConflict
 		}
-		return nil, fmt.Errorf("failed to get account: %w", err)
+		return existing, nil
+	}
+	if err := account.CheckActive(); err != nil {
+		return nil, err
 	}
 
-	log.Printf("Current balance: %.2f, Payment amount: %.2f", balance, amount)
-
-	if balance < amount {
-		result := &PaymentResult{
-			OrderID: orderID,
-			Success: false,
-			Message: "insufficient funds",
+	refundable, err := payment.Refundable()
+	if err != nil {
+		return nil, err
+	}
+	value := refundable
+	if amount != nil {
+		cmp, err := amount.Cmp(refundable)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidRefund, err)
 		}
-		if err := s.sendPaymentResponse(ctx, result); err != nil {
-			log.Printf("Failed to send payment response: %v", err)
+		if cmp > 0 {
+			return nil, fmt.Errorf("%w: %s left to refund", ErrRefundExceedsPayment, refundable)
 		}
-		return result, nil
+		value = *amount
+	}
+	if !value.IsPositive() {
+		return nil, fmt.Errorf("%w: the order has already been fully refunded", ErrRefundExceedsPayment)
 	}
 
-	_, err = tx.ExecContext(ctx,
-		"UPDATE accounts SET balance = balance - $1 WHERE id = $2",
-		amount, accountID)
+	refund := &Refund{ID: refundID, OrderID: orderID, AccountID: payment.AccountID, Amount: value}
+	if err := postRefund(ctx, tx, refund); err != nil {
+		return nil, err
+	}
+
+	result := refundResult(refund)
+	result.Partial = value != refundable
+	if err := storePaymentResponse(ctx, NewOutboxRepositoryTx(tx), EventTypeRefund, "", result); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return refund, nil
+}
+
+// applyInTx runs fn in a new transaction and stores its result for
+// order-service in the outbox of the same transaction, so the balance change
+// and the message about it are committed together.
+func (s *paymentService) applyInTx(ctx context.Context, eventType string, fn func(tx *sql.Tx) (*PaymentResult, error)) (*PaymentResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to update balance: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := fn(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := storePaymentResponse(ctx, NewOutboxRepositoryTx(tx), eventType, "", result); err != nil {
+		return nil, err
 	}
 
 	if err := tx.Commit(); err != nil {
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
+	return result, nil
+}
+
+// chargeAccount takes the payment for an order from the user's balance at
+// once and records it as a captured hold. A missing account or a lack of
+// funds is reported in the result rather than as an error, since
+// order-service has to be told about it.
+func chargeAccount(ctx context.Context, tx *sql.Tx, orderID, userID string, amount Money) (*PaymentResult, error) {
+	log.Printf("Processing payment: OrderID=%s, UserID=%s, Amount=%s", orderID, userID, amount)
+
+	holds := NewHoldRepositoryTx(tx)
+	existing, err := holds.LockHoldByOrderID(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existingHoldResult(existing), nil
+	}
 
-	log.Printf("Payment successful. New balance: %.2f", balance-amount)
+	hold, failure, err := prepareHold(ctx, tx, orderID, userID, amount)
+	if hold == nil {
+		return failure, err
+	}
+
+	_, err = NewLedgerRepositoryTx(tx).Post(ctx, LedgerTransaction{
+		Operation:       LedgerOperationOrderPayment,
+		ReferenceID:     orderID,
+		DebitAccountID:  hold.AccountID,
+		CreditAccountID: SystemAccountRevenue,
+		Amount:          hold.Amount,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hold.Status = HoldStatusCaptured
+	hold.ExpiresAt = time.Now()
+	if err := holds.CreateHold(ctx, hold); err != nil {
+		return nil, fmt.Errorf("failed to record payment: %w", err)
+	}
 
-	result := &PaymentResult{
+	log.Printf("Payment successful. Charged %s", hold.Amount)
+
+	return &PaymentResult{
 		OrderID: orderID,
 		Success: true,
 		Message: "payment processed successfully",
+		Amount:  &hold.Amount,
+	}, nil
+}
+
+// prepareHold locks the user's account and works out what the order costs
+// in the account currency, converting the amount at the current exchange
+// rate when the currencies differ. When the account cannot pay, the hold is
+// nil and the failure to report to order-service is returned instead.
+func prepareHold(ctx context.Context, tx *sql.Tx, orderID, userID string, amount Money) (*Hold, *PaymentResult, error) {
+	failure := func(message string) (*Hold, *PaymentResult, error) {
+		return nil, &PaymentResult{OrderID: orderID, Success: false, Message: message}, nil
 	}
-	if err := s.sendPaymentResponse(ctx, result); err != nil {
-		log.Printf("Failed to send payment response: %v", err)
+
+	if !amount.IsPositive() {
+		return failure("amount must be positive")
 	}
 
-	return result, nil
+	account, err := NewAccountRepositoryTx(tx).LockAccountByUserID(ctx, userID)
+	if errors.Is(err, ErrAccountNotFound) {
+		return failure(err.Error())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := account.CheckActive(); err != nil {
+		return failure(err.Error())
+	}
+
+	hold := &Hold{OrderID: orderID, AccountID: account.ID, Amount: amount, OrderAmount: amount}
+	if currency := account.Balance.Currency; currency != amount.Currency {
+		rate, err := NewExchangeRateRepositoryTx(tx).GetRate(ctx, amount.Currency, currency)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rate == nil {
+			return failure(fmt.Sprintf("%v: no exchange rate from %s to %s", ErrCurrencyMismatch, amount.Currency, currency))
+		}
+		// An amount too large for the account currency fails the payment
+		// instead of the insert of the hold.
+		if hold.Amount, err = rate.Convert(amount); err != nil {
+			return failure(err.Error())
+		}
+		if !hold.Amount.IsPositive() {
+			return failure(fmt.Sprintf("%s is less than the smallest %s amount", amount, currency))
+		}
+		hold.ExchangeRate = rate.Rate
+	}
+
+	log.Printf("Current balance: %s, available: %s, requested amount: %s", account.Balance, account.AvailableBalance, hold.Amount)
+
+	cmp, err := account.AvailableBalance.Cmp(hold.Amount)
+	if err != nil {
+		return failure(err.Error())
+	}
+	if cmp < 0 {
+		return failure(ErrInsufficientFunds.Error())
+	}
+
+	err = checkSpendingLimits(ctx, tx, account, hold.Amount, time.Now())
+	if errors.Is(err, ErrSpendingLimitExceeded) {
+		return failure(err.Error())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return hold, nil, nil
+}
+
+// checkSpendingLimits checks that spending amount from the account does not
+// breach its limits. The caller must hold the lock on the account, so that
+// concurrent payments from it are counted one after another.
+func checkSpendingLimits(ctx context.Context, tx *sql.Tx, account *Account, amount Money, now time.Time) error {
+	currency := account.Balance.Currency
+	limits, err := NewSpendingLimitRepositoryTx(tx).GetLimits(ctx, account.ID, currency)
+	if err != nil {
+		return err
+	}
+	if limits == nil {
+		return nil
+	}
+
+	now = now.UTC()
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	holds := NewHoldRepositoryTx(tx)
+	spentToday, err := holds.SumSpentSince(ctx, account.ID, currency, startOfDay)
+	if err != nil {
+		return err
+	}
+	spentThisMonth, err := holds.SumSpentSince(ctx, account.ID, currency, startOfMonth)
+	if err != nil {
+		return err
+	}
+	return limits.Check(amount, spentToday, spentThisMonth)
+}
+
+// existingHoldResult answers a repeated payment or authorization of an order
+// that already has a hold.
+func existingHoldResult(hold *Hold) *PaymentResult {
+	return &PaymentResult{
+		OrderID: hold.OrderID,
+		Success: hold.Status == HoldStatusActive || hold.Status == HoldStatusCaptured,
+		Message: fmt.Sprintf("funds for the order are already %s", strings.ToLower(string(hold.Status))),
+		Amount:  &hold.Amount,
+	}
+}
+
+// authorizeOrder places a hold on the funds for an order. The funds stay on
+// the account until the hold is captured, released or expires.
+func (s *paymentService) authorizeOrder(ctx context.Context, tx *sql.Tx, orderID, userID string, amount Money) (*PaymentResult, error) {
+	log.Printf("Processing authorization: OrderID=%s, UserID=%s, Amount=%s", orderID, userID, amount)
+
+	holds := NewHoldRepositoryTx(tx)
+	existing, err := holds.LockHoldByOrderID(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existingHoldResult(existing), nil
+	}
+
+	hold, failure, err := prepareHold(ctx, tx, orderID, userID, amount)
+	if hold == nil {
+		return failure, err
+	}
+
+	hold.ExpiresAt = time.Now().Add(s.holdTTL)
+	if err := holds.CreateHold(ctx, hold); err != nil {
+		return nil, fmt.Errorf("failed to create hold: %w", err)
+	}
+
+	return &PaymentResult{
+		OrderID: orderID,
+		Success: true,
+		Message: "funds authorized",
+		Amount:  &hold.Amount,
+	}, nil
+}
+
+// captureOrder takes the held funds of an order from the account. It fails
+// when the hold has already been released or has expired, and releases the
+// hold when the account has been frozen or closed since the authorization.
+func captureOrder(ctx context.Context, tx *sql.Tx, orderID string) (*PaymentResult, error) {
+	log.Printf("Processing capture: OrderID=%s", orderID)
+
+	hold, err := NewHoldRepositoryTx(tx).LockHoldByOrderID(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if hold == nil {
+		return &PaymentResult{
+			OrderID: orderID,
+			Success: false,
+			Message: "no funds are held for the order",
+		}, nil
+	}
+
+	switch {
+	case hold.Status == HoldStatusCaptured:
+		return &PaymentResult{
+			OrderID: orderID,
+			Success: true,
+			Message: "payment already captured",
+			Amount:  &hold.Amount,
+		}, nil
+	case !hold.IsActive(time.Now()):
+		status := hold.Status
+		if status == HoldStatusActive {
+			status = HoldStatusExpired
+		}
+		return &PaymentResult{
+			OrderID: orderID,
+			Success: false,
+			Message: fmt.Sprintf("authorization is %s", strings.ToLower(string(status))),
+		}, nil
+	}
+
+	account, err := NewAccountRepositoryTx(tx).LockAccountByID(ctx, hold.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if err := account.CheckActive(); err != nil {
+		if err := NewHoldRepositoryTx(tx).UpdateHoldStatus(ctx, hold.ID, HoldStatusReleased); err != nil {
+			return nil, err
+		}
+		return &PaymentResult{
+			OrderID: orderID,
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	_, err = NewLedgerRepositoryTx(tx).Post(ctx, LedgerTransaction{
+		Operation:       LedgerOperationOrderPayment,
+		ReferenceID:     orderID,
+		DebitAccountID:  hold.AccountID,
+		CreditAccountID: SystemAccountRevenue,
+		Amount:          hold.Amount,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := NewHoldRepositoryTx(tx).UpdateHoldStatus(ctx, hold.ID, HoldStatusCaptured); err != nil {
+		return nil, err
+	}
+
+	return &PaymentResult{
+		OrderID: orderID,
+		Success: true,
+		Message: "payment captured",
+		Amount:  &hold.Amount,
+	}, nil
+}
+
+// releaseOrder gives the held funds of an order back to the available
+// balance. Releasing a hold that is no longer active does nothing.
+func releaseOrder(ctx context.Context, tx *sql.Tx, orderID string) (*PaymentResult, error) {
+	log.Printf("Processing release: OrderID=%s", orderID)
+
+	holds := NewHoldRepositoryTx(tx)
+	hold, err := holds.LockHoldByOrderID(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if hold == nil || hold.Status != HoldStatusActive {
+		return &PaymentResult{
+			OrderID: orderID,
+			Success: true,
+			Message: "no active hold for the order",
+		}, nil
+	}
+
+	if err := holds.UpdateHoldStatus(ctx, hold.ID, HoldStatusReleased); err != nil {
+		return nil, err
+	}
+
+	return &PaymentResult{
+		OrderID: orderID,
+		Success: true,
+		Message: "hold released",
+		Amount:  &hold.Amount,
+	}, nil
+}
+
+// ExpireHolds marks up to limit holds that are past their expiry time as
+// expired and tells order-service about each of them with a release event.
+func (s *paymentService) ExpireHolds(ctx context.Context, limit int) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	holdRepo := NewHoldRepositoryTx(tx)
+	outbox := NewOutboxRepositoryTx(tx)
+
+	holds, err := holdRepo.ClaimExpiredHolds(ctx, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, hold := range holds {
+		if err := holdRepo.UpdateHoldStatus(ctx, hold.ID, HoldStatusExpired); err != nil {
+			return 0, err
+		}
+
+		result := &PaymentResult{
+			OrderID: hold.OrderID,
+			Success: true,
+			Message: "authorization expired",
+			Amount:  &hold.Amount,
+		}
+		if err := storePaymentResponse(ctx, outbox, EventTypeRelease, "", result); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return len(holds), nil
+}
+
+// refundOrder handles a refund requested by order-service when a paid order
+// is cancelled. Such a refund always gives back everything that has not been
+// refunded through the API yet.
+func refundOrder(ctx context.Context, tx *sql.Tx, refundID, orderID string) (*PaymentResult, error) {
+	log.Printf("Processing refund: OrderID=%s", orderID)
+
+	payment, account, err := lockOrderPayment(ctx, tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if payment == nil {
+		// Only money the ledger shows as charged for the order is given
+		// back; the amount sent by order-service is never trusted. The
+		// order then stays paid.
+		return &PaymentResult{
+			OrderID: orderID,
+			Success: false,
+			Message: ErrPaymentNotFound.Error(),
+		}, nil
+	}
+	if err := account.CheckActive(); err != nil {
+		// The order stays paid and can be cancelled again once the
+		// account is unfrozen.
+		return &PaymentResult{
+			OrderID: orderID,
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	refundable, err := payment.Refundable()
+	if err != nil {
+		return nil, err
+	}
+	if !refundable.IsPositive() {
+		return &PaymentResult{
+			OrderID: orderID,
+			Success: true,
+			Message: "order has already been refunded",
+		}, nil
+	}
+
+	refund := &Refund{ID: refundID, OrderID: orderID, AccountID: payment.AccountID, Amount: refundable}
+	if err := postRefund(ctx, tx, refund); err != nil {
+		return nil, err
+	}
+	return refundResult(refund), nil
 }
 
-func (s *paymentService) sendPaymentResponse(ctx context.Context, result *PaymentResult) error {
-	response := map[string]interface{}{
-		"order_id": result.OrderID,
-		"success":  result.Success,
+// lockOrderPayment locks the account charged for the order and then reads
+// the payment, so that concurrent refunds of the order are applied one after
+// another and never give back more than was charged. It returns the locked
+// account along with the payment.
+func lockOrderPayment(ctx context.Context, tx *sql.Tx, orderID string) (*OrderPayment, *Account, error) {
+	ledger := NewLedgerRepositoryTx(tx)
+
+	payment, err := ledger.GetOrderPayment(ctx, orderID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get order payment: %w", err)
+	}
+	if payment == nil {
+		return nil, nil, nil
 	}
 
-	responseBytes, err := json.Marshal(response)
+	account, err := NewAccountRepositoryTx(tx).LockAccountByID(ctx, payment.AccountID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payment, err = ledger.GetOrderPayment(ctx, orderID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get order payment: %w", err)
+	}
+	return payment, account, nil
+}
+
+// postRefund moves the refund from the revenue account back to the customer
+// and records it.
+func postRefund(ctx context.Context, tx *sql.Tx, refund *Refund) error {
+	_, err := NewLedgerRepositoryTx(tx).Post(ctx, LedgerTransaction{
+		Operation:       LedgerOperationRefund,
+		ReferenceID:     refund.OrderID,
+		DebitAccountID:  SystemAccountRevenue,
+		CreditAccountID: refund.AccountID,
+		Amount:          refund.Amount,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := NewRefundRepositoryTx(tx).CreateRefund(ctx, refund); err != nil {
+		return fmt.Errorf("failed to create refund: %w", err)
+	}
+	return nil
+}
+
+func refundResult(refund *Refund) *PaymentResult {
+	amount := refund.Amount
+	return &PaymentResult{
+		OrderID:  refund.OrderID,
+		Success:  true,
+		Message:  "refund processed successfully",
+		Amount:   &amount,
+		RefundID: refund.ID,
+	}
+}
+
+// ReceivePaymentRequest stores a request received from the broker in the
+// inbox. A message that has already been stored is ignored, so a redelivery
+// never charges the customer twice.
+func (s *paymentService) ReceivePaymentRequest(ctx context.Context, msg *InboxMessage) error {
+	created, err := s.inboxRepo.CreateInboxMessage(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("failed to store inbox message: %w", err)
+	}
+	if !created {
+		log.Printf("Ignoring duplicate %s request %s for order %s", msg.EventType, msg.ID, msg.OrderID)
+	}
+	return nil
+}
+
+// ProcessInboxMessages applies up to limit stored requests and returns how
+// many of them were processed. Each request is applied and marked as
+// processed in the same transaction as the balance change.
+func (s *paymentService) ProcessInboxMessages(ctx context.Context, limit int) (int, error) {
+	processed := 0
+	for processed < limit {
+		ok, err := s.processNextInboxMessage(ctx)
+		if err != nil {
+			return processed, err
+		}
+		if !ok {
+			break
+		}
+		processed++
+	}
+	return processed, nil
+}
+
+func (s *paymentService) processNextInboxMessage(ctx context.Context) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	inbox := NewInboxRepositoryTx(tx)
+
+	msg, err := inbox.ClaimNextMessage(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim inbox message: %w", err)
+	}
+	if msg == nil {
+		return false, nil
+	}
+
+	// The savepoint undoes a failed attempt while keeping the message
+	// locked, so the failure is recorded before anyone else can claim it.
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT apply_inbox_message"); err != nil {
+		return false, fmt.Errorf("failed to create savepoint: %w", err)
+	}
+
+	result, applyErr := s.applyInboxMessage(ctx, tx, msg)
+	if applyErr != nil {
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT apply_inbox_message"); err != nil {
+			return false, fmt.Errorf("failed to process inbox message %s: %w", msg.ID, applyErr)
+		}
+
+		attempts := msg.Attempts + 1
+		log.Printf("Failed to process inbox message %s (attempt %d/%d): %v", msg.ID, attempts, s.inboxRetry.MaxAttempts, applyErr)
+
+		nextAttemptAt := time.Now().Add(s.inboxRetry.NextDelay(attempts))
+		if err := inbox.RecordFailure(ctx, msg.ID, applyErr.Error(), nextAttemptAt); err != nil {
+			return false, fmt.Errorf("failed to record inbox message failure: %w", err)
+		}
+		if attempts < s.inboxRetry.MaxAttempts {
+			if err := tx.Commit(); err != nil {
+				return false, fmt.Errorf("failed to commit transaction: %w", err)
+			}
+			return true, nil
+		}
+
+		// The request is given up on and answered as failed, so that the
+		// order does not wait for it forever.
+		result = &PaymentResult{
+			OrderID: msg.OrderID,
+			Success: false,
+			Message: fmt.Sprintf("request failed after %d attempts", attempts),
+		}
+	}
+
+	if result != nil {
+		if err := storePaymentResponse(ctx, NewOutboxRepositoryTx(tx), msg.EventType, msg.ID, result); err != nil {
+			return false, err
+		}
+	}
+
+	if err := inbox.MarkMessageAsProcessed(ctx, msg.ID); err != nil {
+		return false, fmt.Errorf("failed to mark inbox message as processed: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return true, nil
+}
+
+// applyInboxMessage applies a stored request within tx. It returns a nil
+// result for messages that cannot be answered, which are only marked as
+// processed so that they do not block the other requests of the order.
+func (s *paymentService) applyInboxMessage(ctx context.Context, tx *sql.Tx, msg *InboxMessage) (*PaymentResult, error) {
+	var request PaymentRequest
+	envelope, err := DecodeEventEnvelope([]byte(msg.Payload))
+	if err == nil {
+		err = envelope.DecodePayload(&request)
+	}
+	if err != nil {
+		log.Printf("Rejecting malformed %s request %s: %v", msg.EventType, msg.ID, err)
+		return &PaymentResult{
+			OrderID: msg.OrderID,
+			Success: false,
+			Message: fmt.Sprintf("invalid request: %v", err),
+		}, nil
+	}
+
+	switch msg.EventType {
+	case EventTypePayment:
+		return chargeAccount(ctx, tx, msg.OrderID, request.UserID, request.Amount)
+	case EventTypeRefund:
+		return refundOrder(ctx, tx, msg.ID, msg.OrderID)
+	case EventTypeAuthorize:
+		return s.authorizeOrder(ctx, tx, msg.OrderID, request.UserID, request.Amount)
+	case EventTypeCapture:
+		return captureOrder(ctx, tx, msg.OrderID)
+	case EventTypeRelease:
+		return releaseOrder(ctx, tx, msg.OrderID)
+	default:
+		log.Printf("Skipping inbox message %s of unknown type %q", msg.ID, msg.EventType)
+		return nil, nil
+	}
+}
+
+// storePaymentResponse writes the result for order-service to the outbox.
+// The outbox relay publishes it to payment.response. causationID is the ID
+// of the request being answered, if any.
+func storePaymentResponse(ctx context.Context, outbox OutboxRepository, eventType, causationID string, result *PaymentResult) error {
+	envelope, err := NewEventEnvelope(eventType, result.OrderID, causationID, result)
+	if err != nil {
+		return err
+	}
+
+	responseBytes, err := json.Marshal(envelope)
 	if err != nil {
 		return fmt.Errorf("failed to marshal response: %w", err)
 	}
 
-	return s.queue.PublishPaymentRequest(ctx, responseBytes)
+	if err := outbox.CreateOutboxMessage(ctx, result.OrderID, string(responseBytes)); err != nil {
+		return fmt.Errorf("failed to create outbox message: %w", err)
+	}
+	return nil
 }
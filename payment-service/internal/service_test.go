@@ -0,0 +1,699 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSQLMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, mock
+}
+
+func newSQLMockPaymentService(t *testing.T) (PaymentService, sqlmock.Sqlmock) {
+	db, mock := newSQLMock(t)
+	service := NewPaymentService(db, NewAccountRepository(db), NewInboxRepository(db), NewLedgerRepository(db), time.Hour, RetryPolicy{})
+	return service, mock
+}
+
+var accountColumnNames = []string{"id", "user_id", "balance", "currency", "available", "status", "status_reason"}
+
+func accountRow(id, userID, balance string) *sqlmock.Rows {
+	return sqlmock.NewRows(accountColumnNames).AddRow(id, userID, balance, "RUB", balance, AccountStatusActive, "")
+}
+
+var holdColumnNames = []string{"id", "order_id", "account_id", "amount", "currency", "order_amount", "order_currency", "exchange_rate", "status", "expires_at", "created_at"}
+
+// expectAccountLock expects the account to be locked by ID and read again.
+func expectAccountLock(mock sqlmock.Sqlmock, id, userID, balance string) {
+	mock.ExpectQuery("SELECT id FROM accounts WHERE id = \\$1 FOR UPDATE").
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+	mock.ExpectQuery("FROM accounts WHERE id = \\$1$").
+		WithArgs(id).
+		WillReturnRows(accountRow(id, userID, balance))
+}
+
+func TestLockTransferAccounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		fromID    string
+		toID      string
+		lockOrder []string
+	}{
+		{name: "sender first", fromID: "acc-a", toID: "acc-b", lockOrder: []string{"acc-a", "acc-b"}},
+		{name: "recipient first", fromID: "acc-b", toID: "acc-a", lockOrder: []string{"acc-a", "acc-b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newSQLMock(t)
+			userIDs := map[string]string{tt.fromID: "alice", tt.toID: "bob"}
+
+			mock.ExpectQuery("FROM accounts WHERE user_id = \\$1$").
+				WithArgs("alice").
+				WillReturnRows(accountRow(tt.fromID, "alice", "100.00"))
+			mock.ExpectQuery("FROM accounts WHERE user_id = \\$1$").
+				WithArgs("bob").
+				WillReturnRows(accountRow(tt.toID, "bob", "0.00"))
+			for _, id := range tt.lockOrder {
+				expectAccountLock(mock, id, userIDs[id], "100.00")
+			}
+
+			from, to, err := lockTransferAccounts(context.Background(), NewAccountRepository(db), "alice", "bob")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.fromID, from.ID)
+			assert.Equal(t, tt.toID, to.ID)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPaymentService_Transfer(t *testing.T) {
+	amount := Money{Amount: 1000, Currency: "RUB"}
+
+	t.Run("rejects a transfer to the same account", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		_, err := service.Transfer(context.Background(), "transfer1", "alice", "alice", amount)
+		assert.ErrorIs(t, err, ErrInvalidTransfer)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	transferColumns := []string{"id", "from_account_id", "to_account_id", "amount", "currency", "created_at"}
+	expectLockedAccounts := func(mock sqlmock.Sqlmock) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM accounts WHERE user_id = \\$1$").
+			WithArgs("alice").
+			WillReturnRows(accountRow("acc-a", "alice", "100.00"))
+		mock.ExpectQuery("FROM accounts WHERE user_id = \\$1$").
+			WithArgs("bob").
+			WillReturnRows(accountRow("acc-b", "bob", "0.00"))
+		expectAccountLock(mock, "acc-a", "alice", "100.00")
+		expectAccountLock(mock, "acc-b", "bob", "0.00")
+	}
+
+	t.Run("returns the stored transfer for a repeated id", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		expectLockedAccounts(mock)
+		mock.ExpectQuery("FROM transfers WHERE id = \\$1").
+			WithArgs("transfer1").
+			WillReturnRows(sqlmock.NewRows(transferColumns).AddRow("transfer1", "acc-a", "acc-b", "10.00", "RUB", time.Now()))
+		mock.ExpectRollback()
+
+		transfer, err := service.Transfer(context.Background(), "transfer1", "alice", "bob", amount)
+		assert.NoError(t, err)
+		assert.Equal(t, amount, transfer.Amount)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	conflicts := []struct {
+		name   string
+		fromID string
+		toID   string
+		amount string
+	}{
+		{name: "different amount", fromID: "acc-a", toID: "acc-b", amount: "20.00"},
+		{name: "different recipient", fromID: "acc-a", toID: "acc-c", amount: "10.00"},
+		{name: "opposite direction", fromID: "acc-b", toID: "acc-a", amount: "10.00"},
+	}
+	for _, tt := range conflicts {
+		t.Run("rejects a repeated id with a "+tt.name, func(t *testing.T) {
+			service, mock := newSQLMockPaymentService(t)
+
+			expectLockedAccounts(mock)
+			mock.ExpectQuery("FROM transfers WHERE id = \\$1").
+				WithArgs("transfer1").
+				WillReturnRows(sqlmock.NewRows(transferColumns).AddRow("transfer1", tt.fromID, tt.toID, tt.amount, "RUB", time.Now()))
+			mock.ExpectRollback()
+
+			_, err := service.Transfer(context.Background(), "transfer1", "alice", "bob", amount)
+			assert.ErrorIs(t, err, ErrTransferConflict)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	// A concurrent request stores the same ID between the check and the
+	// insert. The loser must not post to the ledger.
+	races := []struct {
+		name    string
+		amount  string
+		wantErr error
+	}{
+		{name: "replays a transfer stored concurrently", amount: "10.00"},
+		{name: "rejects a different transfer stored concurrently", amount: "20.00", wantErr: ErrTransferConflict},
+	}
+	for _, tt := range races {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mock := newSQLMockPaymentService(t)
+
+			expectLockedAccounts(mock)
+			mock.ExpectQuery("FROM transfers WHERE id = \\$1").
+				WithArgs("transfer1").
+				WillReturnError(sql.ErrNoRows)
+			mock.ExpectQuery("INSERT INTO transfers (.+) ON CONFLICT \\(id\\) DO NOTHING").
+				WithArgs("transfer1", "acc-a", "acc-b", "10.00", "RUB").
+				WillReturnRows(sqlmock.NewRows([]string{"created_at"}))
+			mock.ExpectQuery("FROM transfers WHERE id = \\$1").
+				WithArgs("transfer1").
+				WillReturnRows(sqlmock.NewRows(transferColumns).AddRow("transfer1", "acc-a", "acc-b", tt.amount, "RUB", time.Now()))
+			mock.ExpectRollback()
+
+			transfer, err := service.Transfer(context.Background(), "transfer1", "alice", "bob", amount)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, amount, transfer.Amount)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestPrepareHold_SpendingLimits(t *testing.T) {
+	amount := Money{Amount: 1000, Currency: "RUB"}
+	limitColumns := []string{"per_transaction", "daily", "monthly", "updated_at"}
+
+	tests := []struct {
+		name        string
+		daily       string
+		spentToday  string
+		wantSuccess bool
+	}{
+		{name: "within the daily limit", daily: "50.00", spentToday: "40.00", wantSuccess: true},
+		{name: "above the daily limit", daily: "50.00", spentToday: "40.01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newSQLMock(t)
+
+			// The limits and the spending are read only once the account is
+			// locked, so concurrent payments cannot both pass the check.
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT id FROM accounts WHERE user_id = \\$1 FOR UPDATE").
+				WithArgs("alice").
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("acc-a"))
+			mock.ExpectQuery("FROM accounts WHERE id = \\$1$").
+				WithArgs("acc-a").
+				WillReturnRows(accountRow("acc-a", "alice", "100.00"))
+			mock.ExpectQuery("FROM account_limits WHERE account_id = \\$1").
+				WithArgs("acc-a").
+				WillReturnRows(sqlmock.NewRows(limitColumns).AddRow(nil, tt.daily, nil, time.Now()))
+			mock.ExpectQuery("SELECT COALESCE\\(SUM\\(amount\\), 0\\) FROM holds").
+				WithArgs("acc-a", sqlmock.AnyArg(), HoldStatusCaptured, HoldStatusActive).
+				WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(tt.spentToday))
+			mock.ExpectQuery("SELECT COALESCE\\(SUM\\(amount\\), 0\\) FROM holds").
+				WithArgs("acc-a", sqlmock.AnyArg(), HoldStatusCaptured, HoldStatusActive).
+				WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(tt.spentToday))
+
+			tx, err := db.Begin()
+			assert.NoError(t, err)
+
+			hold, result, err := prepareHold(context.Background(), tx, "order1", "alice", amount)
+			assert.NoError(t, err)
+			if tt.wantSuccess {
+				assert.Nil(t, result)
+				assert.Equal(t, amount, hold.Amount)
+			} else {
+				assert.Nil(t, hold)
+				assert.False(t, result.Success)
+				assert.Contains(t, result.Message, ErrSpendingLimitExceeded.Error())
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	t.Run("without limits", func(t *testing.T) {
+		db, mock := newSQLMock(t)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id FROM accounts WHERE user_id = \\$1 FOR UPDATE").
+			WithArgs("alice").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("acc-a"))
+		mock.ExpectQuery("FROM accounts WHERE id = \\$1$").
+			WithArgs("acc-a").
+			WillReturnRows(accountRow("acc-a", "alice", "100.00"))
+		mock.ExpectQuery("FROM account_limits WHERE account_id = \\$1").
+			WithArgs("acc-a").
+			WillReturnError(sql.ErrNoRows)
+
+		tx, err := db.Begin()
+		assert.NoError(t, err)
+
+		hold, result, err := prepareHold(context.Background(), tx, "order1", "alice", amount)
+		assert.NoError(t, err)
+		assert.Nil(t, result)
+		assert.Equal(t, amount, hold.Amount)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+// refundEvent matches an outbox payload announcing a refund that is partial
+// or not.
+type refundEvent struct {
+	partial bool
+}
+
+func (e refundEvent) Match(v driver.Value) bool {
+	payload, ok := v.(string)
+	if !ok {
+		return false
+	}
+	envelope, err := DecodeEventEnvelope([]byte(payload))
+	if err != nil || envelope.EventType != EventTypeRefund {
+		return false
+	}
+	var result PaymentResult
+	if err := envelope.DecodePayload(&result); err != nil {
+		return false
+	}
+	return result.Success && result.Partial == e.partial
+}
+
+func TestPaymentService_RefundPayment(t *testing.T) {
+	paymentColumns := []string{"account_id", "currency", "charged", "refunded"}
+	refundColumns := []string{"id", "order_id", "account_id", "amount", "currency", "created_at"}
+	rub := func(amount int64) *Money {
+		return &Money{Amount: amount, Currency: "RUB"}
+	}
+
+	// expectPayment expects the payment of order1 to be read, its account
+	// locked and the payment read again, and the refund to be looked up.
+	expectPayment := func(mock sqlmock.Sqlmock, refunded string, existing *sqlmock.Rows) {
+		payment := func() *sqlmock.Rows {
+			return sqlmock.NewRows(paymentColumns).AddRow("acc-a", "RUB", "100.00", refunded)
+		}
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM ledger_entries WHERE reference_id = \\$1").
+			WithArgs("order1").
+			WillReturnRows(payment())
+		expectAccountLock(mock, "acc-a", "alice", "0.00")
+		mock.ExpectQuery("FROM ledger_entries WHERE reference_id = \\$1").
+			WithArgs("order1").
+			WillReturnRows(payment())
+		mock.ExpectQuery("FROM refunds WHERE id = \\$1").
+			WithArgs("refund1").
+			WillReturnRows(existing)
+	}
+
+	refunds := []struct {
+		name     string
+		refunded string
+		amount   *Money
+		want     string
+		partial  bool
+	}{
+		{name: "everything", refunded: "0.00", want: "100.00"},
+		{name: "what is left", refunded: "25.00", want: "75.00"},
+		{name: "part of the payment", refunded: "0.00", amount: rub(2500), want: "25.00", partial: true},
+		{name: "the rest by amount", refunded: "25.00", amount: rub(7500), want: "75.00"},
+	}
+	for _, tt := range refunds {
+		t.Run("refunds "+tt.name, func(t *testing.T) {
+			service, mock := newSQLMockPaymentService(t)
+
+			expectPayment(mock, tt.refunded, sqlmock.NewRows(refundColumns))
+			mock.ExpectExec("INSERT INTO ledger_entries").
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), SystemAccountRevenue, LedgerDebit, tt.want, "RUB", LedgerOperationRefund, "order1").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT INTO ledger_entries").
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "acc-a", LedgerCredit, tt.want, "RUB", LedgerOperationRefund, "order1").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("UPDATE accounts SET balance = balance \\+ \\$1").
+				WithArgs(tt.want, "acc-a", "RUB").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery("INSERT INTO refunds").
+				WithArgs("refund1", "order1", "acc-a", tt.want, "RUB").
+				WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+			mock.ExpectExec("INSERT INTO outbox_messages").
+				WithArgs(sqlmock.AnyArg(), "order1", refundEvent{partial: tt.partial}, false).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+
+			refund, err := service.RefundPayment(context.Background(), "refund1", "order1", tt.amount)
+			assert.NoError(t, err)
+			if assert.NotNil(t, refund) {
+				assert.Equal(t, tt.want, refund.Amount.Decimal())
+				assert.Equal(t, "acc-a", refund.AccountID)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	t.Run("returns the stored refund for a repeated id", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		expectPayment(mock, "25.00", sqlmock.NewRows(refundColumns).
+			AddRow("refund1", "order1", "acc-a", "25.00", "RUB", time.Now()))
+		mock.ExpectRollback()
+
+		refund, err := service.RefundPayment(context.Background(), "refund1", "order1", rub(2500))
+		assert.NoError(t, err)
+		if assert.NotNil(t, refund) {
+			assert.Equal(t, *rub(2500), refund.Amount)
+		}
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	failures := []struct {
+		name     string
+		refunded string
+		existing *sqlmock.Rows
+		amount   *Money
+		wantErr  error
+	}{
+		{
+			name:     "rejects a repeated id with a different amount",
+			refunded: "25.00",
+			existing: sqlmock.NewRows(refundColumns).AddRow("refund1", "order1", "acc-a", "25.00", "RUB", time.Now()),
+			amount:   rub(3000),
+			wantErr:  ErrRefundConflict,
+		},
+		{
+			name:     "rejects a repeated id for another order",
+			refunded: "25.00",
+			existing: sqlmock.NewRows(refundColumns).AddRow("refund1", "order2", "acc-a", "25.00", "RUB", time.Now()),
+			amount:   rub(2500),
+			wantErr:  ErrRefundConflict,
+		},
+		{
+			name:     "rejects more than is left to refund",
+			refunded: "80.00",
+			existing: sqlmock.NewRows(refundColumns),
+			amount:   rub(2001),
+			wantErr:  ErrRefundExceedsPayment,
+		},
+		{
+			name:     "rejects a refund of a fully refunded order",
+			refunded: "100.00",
+			existing: sqlmock.NewRows(refundColumns),
+			wantErr:  ErrRefundExceedsPayment,
+		},
+	}
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mock := newSQLMockPaymentService(t)
+
+			expectPayment(mock, tt.refunded, tt.existing)
+			mock.ExpectRollback()
+
+			_, err := service.RefundPayment(context.Background(), "refund1", "order1", tt.amount)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	t.Run("rejects an order without a payment", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM ledger_entries WHERE reference_id = \\$1").
+			WithArgs("order1").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		_, err := service.RefundPayment(context.Background(), "refund1", "order1", nil)
+		assert.ErrorIs(t, err, ErrPaymentNotFound)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestPaymentService_ProcessOrderPayment_Atomic(t *testing.T) {
+	amount := Money{Amount: 1000, Currency: "RUB"}
+
+	// expectCharge expects the payment of order1 to be taken from alice's
+	// account with a balance of balance.
+	expectCharge := func(mock sqlmock.Sqlmock, balance string) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM holds WHERE order_id = \\$1 FOR UPDATE").
+			WithArgs("order1").
+			WillReturnRows(sqlmock.NewRows(holdColumnNames))
+		mock.ExpectQuery("SELECT id FROM accounts WHERE user_id = \\$1 FOR UPDATE").
+			WithArgs("alice").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("acc-a"))
+		mock.ExpectQuery("FROM accounts WHERE id = \\$1$").
+			WithArgs("acc-a").
+			WillReturnRows(accountRow("acc-a", "alice", balance))
+	}
+	expectPosting := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery("FROM account_limits WHERE account_id = \\$1").
+			WithArgs("acc-a").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec("INSERT INTO ledger_entries").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE accounts SET balance = balance - \\$1").
+			WithArgs("10.00", "acc-a", "RUB").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO ledger_entries").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery("INSERT INTO holds").
+			WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	}
+
+	t.Run("commits the charge and the outbox message together", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		expectCharge(mock, "100.00")
+		expectPosting(mock)
+		mock.ExpectExec("INSERT INTO outbox_messages").
+			WithArgs(sqlmock.AnyArg(), "order1", payloadContains("payment processed successfully"), false).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		result, err := service.ProcessOrderPayment(context.Background(), "order1", "alice", amount)
+		assert.NoError(t, err)
+		assert.True(t, result.Success)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("commits a declined payment with its outbox message", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		expectCharge(mock, "5.00")
+		mock.ExpectExec("INSERT INTO outbox_messages").
+			WithArgs(sqlmock.AnyArg(), "order1", payloadContains(ErrInsufficientFunds.Error()), false).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		result, err := service.ProcessOrderPayment(context.Background(), "order1", "alice", amount)
+		assert.NoError(t, err)
+		assert.False(t, result.Success)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rolls back without an outbox message when the charge fails", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		expectCharge(mock, "100.00")
+		mock.ExpectQuery("FROM account_limits WHERE account_id = \\$1").
+			WithArgs("acc-a").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec("INSERT INTO ledger_entries").WillReturnError(sql.ErrConnDone)
+		mock.ExpectRollback()
+
+		_, err := service.ProcessOrderPayment(context.Background(), "order1", "alice", amount)
+		assert.ErrorIs(t, err, sql.ErrConnDone)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rolls back the charge when the outbox insert fails", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		expectCharge(mock, "100.00")
+		expectPosting(mock)
+		mock.ExpectExec("INSERT INTO outbox_messages").WillReturnError(sql.ErrConnDone)
+		mock.ExpectRollback()
+
+		_, err := service.ProcessOrderPayment(context.Background(), "order1", "alice", amount)
+		assert.ErrorIs(t, err, sql.ErrConnDone)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("reports a failed commit", func(t *testing.T) {
+		service, mock := newSQLMockPaymentService(t)
+
+		expectCharge(mock, "100.00")
+		expectPosting(mock)
+		mock.ExpectExec("INSERT INTO outbox_messages").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit().WillReturnError(sql.ErrTxDone)
+
+		_, err := service.ProcessOrderPayment(context.Background(), "order1", "alice", amount)
+		assert.ErrorIs(t, err, sql.ErrTxDone)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestPaymentService_InactiveAccount(t *testing.T) {
+	amount := Money{Amount: 1000, Currency: "RUB"}
+	statuses := []struct {
+		status  AccountStatus
+		wantErr error
+	}{
+		{status: AccountStatusFrozen, wantErr: ErrAccountFrozen},
+		{status: AccountStatusClosed, wantErr: ErrAccountClosed},
+	}
+
+	for _, st := range statuses {
+		inactiveRow := func(id, userID string) *sqlmock.Rows {
+			return sqlmock.NewRows(accountColumnNames).AddRow(id, userID, "100.00", "RUB", "100.00", st.status, "suspicious activity")
+		}
+		expectInactiveLock := func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id FROM accounts WHERE user_id = \\$1 FOR UPDATE").
+				WithArgs("alice").
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("acc-a"))
+			mock.ExpectQuery("FROM accounts WHERE id = \\$1$").
+				WithArgs("acc-a").
+				WillReturnRows(inactiveRow("acc-a", "alice"))
+		}
+
+		t.Run(string(st.status), func(t *testing.T) {
+			t.Run("blocks deposits and withdrawals", func(t *testing.T) {
+				service, mock := newSQLMockPaymentService(t)
+
+				for i := 0; i < 2; i++ {
+					mock.ExpectBegin()
+					expectInactiveLock(mock)
+					mock.ExpectRollback()
+				}
+
+				err := service.Deposit(context.Background(), "alice", amount)
+				assert.ErrorIs(t, err, st.wantErr)
+				assert.ErrorContains(t, err, "suspicious activity")
+				assert.ErrorIs(t, service.Withdraw(context.Background(), "alice", amount), st.wantErr)
+				assert.NoError(t, mock.ExpectationsWereMet())
+			})
+
+			t.Run("declines authorizations", func(t *testing.T) {
+				db, mock := newSQLMock(t)
+
+				tx := beginHoldTx(t, db, mock, "", time.Time{})
+				expectInactiveLock(mock)
+
+				result, err := (&paymentService{holdTTL: time.Hour}).authorizeOrder(context.Background(), tx, "order1", "alice", amount)
+				assert.NoError(t, err)
+				assert.False(t, result.Success)
+				assert.Contains(t, result.Message, st.wantErr.Error()+": suspicious activity")
+				assert.NoError(t, mock.ExpectationsWereMet())
+			})
+
+			transfers := []struct {
+				name           string
+				senderStatus   AccountStatus
+				receiverStatus AccountStatus
+			}{
+				{name: "blocks transfers from the account", senderStatus: st.status, receiverStatus: AccountStatusActive},
+				{name: "blocks transfers to the account", senderStatus: AccountStatusActive, receiverStatus: st.status},
+			}
+			for _, tt := range transfers {
+				t.Run(tt.name, func(t *testing.T) {
+					service, mock := newSQLMockPaymentService(t)
+					row := func(id, userID string, status AccountStatus) *sqlmock.Rows {
+						return sqlmock.NewRows(accountColumnNames).AddRow(id, userID, "100.00", "RUB", "100.00", status, "")
+					}
+
+					mock.ExpectBegin()
+					mock.ExpectQuery("FROM accounts WHERE user_id = \\$1$").
+						WithArgs("alice").
+						WillReturnRows(row("acc-a", "alice", tt.senderStatus))
+					mock.ExpectQuery("FROM accounts WHERE user_id = \\$1$").
+						WithArgs("bob").
+						WillReturnRows(row("acc-b", "bob", tt.receiverStatus))
+					for _, account := range []struct {
+						id, userID string
+						status     AccountStatus
+					}{{"acc-a", "alice", tt.senderStatus}, {"acc-b", "bob", tt.receiverStatus}} {
+						mock.ExpectQuery("SELECT id FROM accounts WHERE id = \\$1 FOR UPDATE").
+							WithArgs(account.id).
+							WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(account.id))
+						mock.ExpectQuery("FROM accounts WHERE id = \\$1$").
+							WithArgs(account.id).
+							WillReturnRows(row(account.id, account.userID, account.status))
+					}
+					mock.ExpectQuery("FROM transfers WHERE id = \\$1").
+						WithArgs("transfer1").
+						WillReturnError(sql.ErrNoRows)
+					mock.ExpectRollback()
+
+					_, err := service.Transfer(context.Background(), "transfer1", "alice", "bob", amount)
+					assert.ErrorIs(t, err, st.wantErr)
+					assert.NoError(t, mock.ExpectationsWereMet())
+				})
+			}
+
+			expectOrderPayment := func(mock sqlmock.Sqlmock) {
+				payment := func() *sqlmock.Rows {
+					return sqlmock.NewRows([]string{"account_id", "currency", "charged", "refunded"}).AddRow("acc-a", "RUB", "100.00", "0.00")
+				}
+				mock.ExpectQuery("FROM ledger_entries WHERE reference_id = \\$1").
+					WithArgs("order1").
+					WillReturnRows(payment())
+				mock.ExpectQuery("SELECT id FROM accounts WHERE id = \\$1 FOR UPDATE").
+					WithArgs("acc-a").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("acc-a"))
+				mock.ExpectQuery("FROM accounts WHERE id = \\$1$").
+					WithArgs("acc-a").
+					WillReturnRows(inactiveRow("acc-a", "alice"))
+				mock.ExpectQuery("FROM ledger_entries WHERE reference_id = \\$1").
+					WithArgs("order1").
+					WillReturnRows(payment())
+			}
+
+			t.Run("blocks refunds", func(t *testing.T) {
+				service, mock := newSQLMockPaymentService(t)
+
+				mock.ExpectBegin()
+				expectOrderPayment(mock)
+				mock.ExpectQuery("FROM refunds WHERE id = \\$1").
+					WithArgs("refund1").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+
+				_, err := service.RefundPayment(context.Background(), "refund1", "order1", nil)
+				assert.ErrorIs(t, err, st.wantErr)
+				assert.NoError(t, mock.ExpectationsWereMet())
+			})
+
+			t.Run("declines the refund of a cancelled order", func(t *testing.T) {
+				db, mock := newSQLMock(t)
+
+				mock.ExpectBegin()
+				expectOrderPayment(mock)
+				tx, err := db.Begin()
+				assert.NoError(t, err)
+
+				result, err := refundOrder(context.Background(), tx, "msg1", "order1")
+				assert.NoError(t, err)
+				assert.False(t, result.Success)
+				assert.Contains(t, result.Message, st.wantErr.Error())
+				assert.NoError(t, mock.ExpectationsWereMet())
+			})
+
+			t.Run("still shows the balance", func(t *testing.T) {
+				service, mock := newSQLMockPaymentService(t)
+
+				mock.ExpectQuery("FROM accounts WHERE user_id = \\$1$").
+					WithArgs("alice").
+					WillReturnRows(inactiveRow("acc-a", "alice"))
+
+				account, err := service.GetAccount(context.Background(), "alice")
+				assert.NoError(t, err)
+				if assert.NotNil(t, account) {
+					assert.Equal(t, st.status, account.Status)
+					assert.Equal(t, Money{Amount: 10000, Currency: "RUB"}, account.Balance)
+				}
+				assert.NoError(t, mock.ExpectationsWereMet())
+			})
+		})
+	}
+}
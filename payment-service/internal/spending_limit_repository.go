@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+type SpendingLimitRepository interface {
+	UpsertLimits(ctx context.Context, limits *SpendingLimits) error
+	GetLimits(ctx context.Context, accountID, currency string) (*SpendingLimits, error)
+}
+
+type spendingLimitRepository struct {
+	db DBTX
+}
+
+func NewSpendingLimitRepository(db *sql.DB) SpendingLimitRepository {
+	return &spendingLimitRepository{db: db}
+}
+
+// NewSpendingLimitRepositoryTx returns a repository whose operations all run
+// inside tx. Committing or rolling back tx is up to the caller.
+func NewSpendingLimitRepositoryTx(tx *sql.Tx) SpendingLimitRepository {
+	return &spendingLimitRepository{db: tx}
+}
+
+// UpsertLimits replaces all limits of the account.
+func (r *spendingLimitRepository) UpsertLimits(ctx context.Context, limits *SpendingLimits) error {
+	return r.db.QueryRowContext(ctx, `
+		INSERT INTO account_limits (account_id, per_transaction, daily, monthly, updated_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (account_id) DO UPDATE
+		SET per_transaction = EXCLUDED.per_transaction,
+			daily = EXCLUDED.daily,
+			monthly = EXCLUDED.monthly,
+			updated_at = EXCLUDED.updated_at
+		RETURNING updated_at`,
+		limits.AccountID, limitValue(limits.PerTransaction), limitValue(limits.Daily), limitValue(limits.Monthly)).
+		Scan(&limits.UpdatedAt)
+}
+
+// GetLimits returns the limits of the account, whose amounts are in
+// currency, or nil when none have been set.
+func (r *spendingLimitRepository) GetLimits(ctx context.Context, accountID, currency string) (*SpendingLimits, error) {
+	limits := SpendingLimits{AccountID: accountID}
+	var perTransaction, daily, monthly sql.NullString
+	err := r.db.QueryRowContext(ctx,
+		"SELECT per_transaction, daily, monthly, updated_at FROM account_limits WHERE account_id = $1", accountID).
+		Scan(&perTransaction, &daily, &monthly, &limits.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get spending limits: %w", err)
+	}
+
+	if limits.PerTransaction, err = scanLimit(perTransaction, currency); err != nil {
+		return nil, err
+	}
+	if limits.Daily, err = scanLimit(daily, currency); err != nil {
+		return nil, err
+	}
+	if limits.Monthly, err = scanLimit(monthly, currency); err != nil {
+		return nil, err
+	}
+	return &limits, nil
+}
+
+func limitValue(limit *Money) sql.NullString {
+	if limit == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: limit.Decimal(), Valid: true}
+}
+
+func scanLimit(value sql.NullString, currency string) (*Money, error) {
+	if !value.Valid {
+		return nil, nil
+	}
+	limit, err := ParseMoney(value.String, currency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spending limit: %w", err)
+	}
+	return &limit, nil
+}
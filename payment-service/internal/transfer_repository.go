@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+type TransferRepository interface {
+	CreateTransfer(ctx context.Context, transfer *Transfer) (bool, error)
+	GetTransfer(ctx context.Context, id string) (*Transfer, error)
+}
+
+type transferRepository struct {
+	db DBTX
+}
+
+func NewTransferRepository(db *sql.DB) TransferRepository {
+	return &transferRepository{db: db}
+}
+
+// NewTransferRepositoryTx returns a repository whose operations all run inside
+// tx. Committing or rolling back tx is up to the caller.
+func NewTransferRepositoryTx(tx *sql.Tx) TransferRepository {
+	return &transferRepository{db: tx}
+}
+
+// CreateTransfer stores the transfer. It reports false without an error when
+// a transfer with the same ID has been stored in the meantime by a
+// concurrent request.
+func (r *transferRepository) CreateTransfer(ctx context.Context, transfer *Transfer) (bool, error) {
+	err := r.db.QueryRowContext(ctx,
+		"INSERT INTO transfers (id, from_account_id, to_account_id, amount, currency) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (id) DO NOTHING RETURNING created_at",
+		transfer.ID, transfer.FromAccountID, transfer.ToAccountID, transfer.Amount.Decimal(), transfer.Amount.Currency).
+		Scan(&transfer.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *transferRepository) GetTransfer(ctx context.Context, id string) (*Transfer, error) {
+	var transfer Transfer
+	var amount, currency string
+	err := r.db.QueryRowContext(ctx,
+		"SELECT id, from_account_id, to_account_id, amount, currency, created_at FROM transfers WHERE id = $1", id).
+		Scan(&transfer.ID, &transfer.FromAccountID, &transfer.ToAccountID, &amount, &currency, &transfer.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if transfer.Amount, err = ParseMoney(amount, currency); err != nil {
+		return nil, fmt.Errorf("failed to read amount of transfer %s: %w", transfer.ID, err)
+	}
+	return &transfer, nil
+}